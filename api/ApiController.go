@@ -6,6 +6,8 @@ import (
 	"os"
 
 	"github.com/gorilla/mux"
+	"github.com/matba/slyde-server/internals/config"
+	"github.com/matba/slyde-server/internals/jobs"
 )
 
 // Controller represent the controller which handles http connections
@@ -39,8 +41,43 @@ func (c *controllerInstance) Start() {
 		}
 	}
 
+	if _, err := os.Stat(filesDirectory + exportsDirectory); os.IsNotExist(err) {
+		err := os.Mkdir(filesDirectory+exportsDirectory, 0777)
+		if err != nil {
+			log.Fatal("The files directory does not have proper permissions: " + filesDirectory)
+		}
+	}
+
 	c.active = true
 
+	// the archives of background exports are removed after their links expire
+	go cleanupExpiredExports()
+
+	loadVariantCache()
+
+	err := ensureSearchIndexes()
+	if err != nil {
+		log.Printf("Cannot create the indexes of image search: %s", err.Error())
+	}
+
+	registerImageJobs()
+	registerUsageJobs()
+	registerSearchJobs()
+	registerPlaceholderJobs()
+	registerProfileJobs()
+	registerExportJobs()
+	jobs.GetQueue().Start(config.GetServerConfig().ImageWorkers)
+
+	// the usage of users is recomputed periodically to fix any drift of the incremental updates
+	go recomputeUsagePeriodically()
+	// the search entries are rebuilt so the images indexed by an older version can be found
+	go reindexAllImages()
+	// the images are purged when they have been in trash longer than the retention
+	go purgeExpiredTrash()
+	go startMailReceiver()
+	// the owners of frames are alerted when their frames stop sending heartbeats
+	go watchOfflineDevices()
+
 	router := mux.NewRouter().StrictSlash(true)
 	// the endpoint for registering new users
 	router.HandleFunc("/signup", SignUp)
@@ -52,7 +89,70 @@ func (c *controllerInstance) Start() {
 	router.HandleFunc("/signout", Signout)
 	// the end point for for getting uploaded images
 	router.HandleFunc("/images", HandleImage)
+	// the end point for the non-destructive edits of images
+	router.HandleFunc("/images/edits", HandleImageEdit)
+	// the end point for importing images from urls
+	router.HandleFunc("/images/import", HandleImageImport)
+	// the end point for the side by side composites of portrait images shown by slideshows
+	router.HandleFunc("/images/composite", HandleImageComposite)
+	// the end points for the captions and tags of images and searching them
+	router.HandleFunc("/images/metadata", HandleImageMetadata)
+	router.HandleFunc("/images/search", HandleImageSearch)
+	router.HandleFunc("/images/tags", HandleTagSuggestions)
+	// the end point for importing many images or a zip archive at once
+	router.HandleFunc("/images/bulk", HandleImageBulk)
+	// the end point for listing, restoring and purging deleted images
+	router.HandleFunc("/images/trash", HandleTrash)
+	// the end point for managing albums
+	router.HandleFunc("/albums", HandleAlbum)
+	// the end points for shared libraries, their members and invitations
+	router.HandleFunc("/libraries", HandleLibrary)
+	router.HandleFunc("/libraries/members", HandleLibraryMember)
+	router.HandleFunc("/libraries/invitations", HandleLibraryInvitation)
+	// the end point for managing slideshows
+	router.HandleFunc("/slideshows", HandleSlideshow)
+	// the end point for the images taken on this day in previous years
+	router.HandleFunc("/memories", HandleMemories)
+	// the end points for the email addresses photos can be sent to and who can send them
+	router.HandleFunc("/inboxes", HandleMailInbox)
+	router.HandleFunc("/inboxes/senders", HandleMailSenders)
+	// the end point for the device profiles images are pre-rendered for
+	router.HandleFunc("/profiles", HandleDeviceProfile)
+	// the end points for the frames of user and their health, a frame fetches its own configuration and
+	// sends its heartbeats with its token
+	router.HandleFunc("/devices", HandleDevice)
+	router.HandleFunc("/devices/status", HandleDeviceStatus)
+	router.HandleFunc("/device/config", HandleDeviceConfig)
+	router.HandleFunc("/device/heartbeat", HandleDeviceHeartbeat)
+	// the end points for share links, the owner manages them and the shared content is reachable without a session
+	router.HandleFunc("/shares", HandleShareLink)
+	router.HandleFunc("/shared", HandleShared)
+	router.HandleFunc("/shared/images", HandleSharedImage)
+	// the end points for exporting the library as a zip archive
+	router.HandleFunc("/export", HandleExport)
+	router.HandleFunc("/export/jobs", HandleExportJob)
+	router.HandleFunc(exportDownloadPath, HandleExportDownload)
+	// the end points for following the background jobs
+	router.HandleFunc("/jobs", HandleJob)
+	router.HandleFunc("/jobs/events", HandleJobEvents)
+	// the end point for getting the statistics of rendered variants cache
+	router.HandleFunc("/admin/variants", HandleAdminVariantCache)
+	// the end point for recomputing the storage usage of users
+	router.HandleFunc("/admin/usage", HandleAdminUsage)
+	// the end point for rebuilding the search entries of images
+	router.HandleFunc("/admin/search", HandleAdminSearchIndex)
+	// the end point for computing the placeholders of the images uploaded before they were introduced
+	router.HandleFunc("/admin/placeholders", HandleAdminPlaceholders)
+	// the end point for checking the records of images against the files on disk and repairing them
+	router.HandleFunc("/admin/fsck", HandleAdminFsck)
 	// the end point for for getting user information
 	router.HandleFunc("/user", HandleUser)
+	// the end point for getting the storage usage of user
+	router.HandleFunc("/user/usage", HandleUserUsage)
+	// the end point for the passwords of apps that can not sign in with a session
+	router.HandleFunc("/user/apppasswords", HandleAppPassword)
+	// the library of user over WebDAV, authenticated with app passwords
+	router.HandleFunc(webdavPath, HandleWebDAV)
+	router.PathPrefix(webdavPath + "/").HandlerFunc(HandleWebDAV)
 	log.Fatal(http.ListenAndServe(":8080", router))
 }
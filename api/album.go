@@ -0,0 +1,327 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/matba/slyde-server/internals/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const albumService = "ALBUM"
+
+// HandleAlbum handles API calls for albums
+func HandleAlbum(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	log.Printf("Incoming call for albums")
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, albumService)
+	if err != nil {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		handleAlbumGet(w, user)
+	case "POST":
+		handleAlbumPost(w, r, user)
+	case "PUT":
+		handleAlbumPut(w, r, user)
+	case "DELETE":
+		handleAlbumDel(w, r, user)
+	default:
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+}
+
+func handleAlbumGet(w http.ResponseWriter, user *db.User) {
+	albums := []userAlbum{}
+	for _, album := range user.Albums {
+		albums = append(albums, toUserAlbum(album))
+	}
+	js, _ := json.Marshal(userAlbums{AlbumList: albums})
+	w.Write(js)
+}
+
+func handleAlbumPost(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request albumRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, albumService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+	if len(request.Name) == 0 {
+		log.Printf(errLogTemplate, errLogMissingField, albumService, user.Email, "Album name not provided.")
+		WriteErrorOnResponse(errBadRequest, &w, http.StatusBadRequest)
+		return
+	}
+
+	id, _ := uuid.NewUUID()
+	album := db.Album{
+		ID:           id.String(),
+		Name:         request.Name,
+		ImageIDs:     filterUserImageIds(user, request.ImageIds),
+		CreationDate: time.Now(),
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, albumService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	err = insertAlbum(collection, user.ID, album)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, albumService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(toUserAlbum(album))
+	w.Write(js)
+}
+
+func handleAlbumPut(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request albumRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, albumService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	album := findUserAlbum(user, request.ID)
+	if album == nil {
+		log.Printf(errLogTemplate, errLogNotFound, albumService, user.Email, request.ID)
+		WriteErrorOnResponse(errAlbumNotFound, &w, http.StatusNotFound)
+		return
+	}
+	if len(request.Name) > 0 {
+		album.Name = request.Name
+	}
+	if request.ImageIds != nil {
+		album.ImageIDs = filterUserImageIds(user, request.ImageIds)
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, albumService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	err = updateAlbum(collection, user.ID, *album)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, albumService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(toUserAlbum(*album))
+	w.Write(js)
+}
+
+func handleAlbumDel(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request albumDeleteRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, albumService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	deleteRequestSet := make(map[string]bool)
+	for _, albumID := range request.AlbumIds {
+		deleteRequestSet[albumID] = true
+	}
+	deletedAlbums := []string{}
+	for _, album := range user.Albums {
+		if deleteRequestSet[album.ID] {
+			deletedAlbums = append(deletedAlbums, album.ID)
+		}
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, albumService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	err = deleteAlbums(collection, user.ID, deletedAlbums)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, albumService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(albumDeleteResponse{
+		NumberDeleted: len(deletedAlbums),
+	})
+	w.Write(js)
+}
+
+// insertAlbum adds the album to the albums of user
+func insertAlbum(collection *mongo.Collection, userID string, album db.Album) error {
+	filter := bson.D{{"id", userID}}
+	update := bson.D{
+		{"$push", bson.D{
+			{"albums", album},
+		}},
+	}
+	_, err := collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		return err
+	}
+	updateSearchAlbum(userID, album.ID, album.ImageIDs)
+	return nil
+}
+
+// updateAlbum saves the name and the images of album
+func updateAlbum(collection *mongo.Collection, userID string, album db.Album) error {
+	filter := bson.D{{"id", userID}, {"albums.id", album.ID}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"albums.$.name", album.Name},
+			{"albums.$.imageids", album.ImageIDs},
+		}},
+	}
+	_, err := collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		return err
+	}
+	updateSearchAlbum(userID, album.ID, album.ImageIDs)
+	return nil
+}
+
+// deleteAlbums removes the albums with the ids from user, their images are kept
+func deleteAlbums(collection *mongo.Collection, userID string, albumIds []string) error {
+	filter := bson.D{{"id", userID}}
+	update := bson.D{
+		{"$pull", bson.D{
+			{"albums", bson.D{
+				{"id", bson.D{
+					{"$in", albumIds},
+				}},
+			}},
+		}},
+	}
+	_, err := collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		return err
+	}
+	removeSearchAlbums(userID, albumIds)
+	return nil
+}
+
+// removeImagesFromAlbums removes the references to images from all albums of user
+func removeImagesFromAlbums(collection *mongo.Collection, userID string, images []db.ImageInfo) error {
+	imageIds := []string{}
+	for _, img := range images {
+		imageIds = append(imageIds, img.ID)
+	}
+	filter := bson.D{{"id", userID}}
+	update := bson.D{
+		{"$pull", bson.D{
+			{"albums.$[].imageids", bson.D{
+				{"$in", imageIds},
+			}},
+		}},
+	}
+	_, err := collection.UpdateOne(context.TODO(), filter, update)
+	return err
+}
+
+// addImagesToAlbum appends the images to the end of album of user, the album is left as is if it does not exist
+func addImagesToAlbum(collection *mongo.Collection, user *db.User, albumID string, imageIds []string) error {
+	album := findUserAlbum(user, albumID)
+	if album == nil {
+		return nil
+	}
+	filter := bson.D{{"id", user.ID}, {"albums.id", albumID}}
+	update := bson.D{
+		{"$push", bson.D{
+			{"albums.$.imageids", bson.D{
+				{"$each", imageIds},
+			}},
+		}},
+	}
+	_, err := collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		return err
+	}
+	album.ImageIDs = append(album.ImageIDs, imageIds...)
+	updateSearchAlbum(user.ID, album.ID, album.ImageIDs)
+	return nil
+}
+
+// findUserAlbum returns the album of user with the id or nil if the user does not have such album
+func findUserAlbum(user *db.User, albumID string) *db.Album {
+	for i := range user.Albums {
+		if user.Albums[i].ID == albumID {
+			return &user.Albums[i]
+		}
+	}
+	return nil
+}
+
+// getAlbumImages returns the images of user that are in the album in the order of the album
+func getAlbumImages(user *db.User, album *db.Album) []db.ImageInfo {
+	userImages := make(map[string]db.ImageInfo)
+	for _, img := range getActiveImages(user) {
+		userImages[img.ID] = img
+	}
+	images := []db.ImageInfo{}
+	for _, imgID := range album.ImageIDs {
+		if img, ok := userImages[imgID]; ok {
+			images = append(images, img)
+		}
+	}
+	return images
+}
+
+// filterUserImageIds drops the ids that do not belong to the images of user and the duplicates
+func filterUserImageIds(user *db.User, imageIds []string) []string {
+	userImages := make(map[string]bool)
+	for _, img := range getActiveImages(user) {
+		userImages[img.ID] = true
+	}
+	filtered := []string{}
+	for _, imgID := range imageIds {
+		if userImages[imgID] {
+			filtered = append(filtered, imgID)
+			userImages[imgID] = false
+		}
+	}
+	return filtered
+}
+
+func toUserAlbum(album db.Album) userAlbum {
+	imageIds := album.ImageIDs
+	if imageIds == nil {
+		imageIds = []string{}
+	}
+	return userAlbum{
+		ID:           album.ID,
+		Name:         album.Name,
+		ImageIds:     imageIds,
+		CreationDate: album.CreationDate,
+	}
+}
@@ -9,13 +9,26 @@ const minImageDimension = 400
 const thumbnailsSize = 150
 const resizeSize = 3840
 
+const maxUploadSize = 10 << 20
+const maxBulkArchiveSize = 2 << 30
+
+const maxSyncExportImages = 100
+const exportRetention = twentyfourHours
+const manifestFileName = "manifest.json"
+const exportArchiveName = "slyde-export.zip"
+const exportDownloadPath = "/export/download"
+
 const emailRegex = `^[^\s@]+@[^\s@]+\.[^\s@]+$`
 const nameRegex = `^([a-z]|[0-9]|-)+$`
 
 const sessionTokenKey = "session_token"
 const jpegExtension = ".jpg"
+const zipExtension = ".zip"
 
 const filesDirectory = "/fourame"
 const userDirectory = "/users"
 const thumbnailsDirectory = "/thumbnails"
 const imagesDiretory = "/images"
+const exportsDirectory = "/exports"
+const originalsDirectory = "/originals"
+const profilesDirectory = "/profiles"
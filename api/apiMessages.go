@@ -23,6 +23,8 @@ const errLogImageValidationError = "Image Validation Error."
 const errLogImageSavingError = "Image Saving Error."
 const errLogMissingField = "Missing Field."
 const errLogIoError = "IO Error."
+const errLogNotAdmin = "Not an administrator."
+const errLogInvalidSignature = "Invalid url signature."
 
 const errCannotDecode = "Invalid JSON object."
 const errInternalError = "Processing request failed because of an internal error"
@@ -39,6 +41,65 @@ const errUnsupportedImage = "Uploaded Image is not supported. Currently, only jp
 const errImageTooBig = "Image is too big the max dimension supported is 10,000 pixel."
 const errImageTooSmall = "Image is too small the min dimension supported is 400 pixel."
 const errNotFound = "Image with such id was not found."
+const errAlbumNotFound = "Album with such id was not found."
+const errExportNotFound = "Export with such id was not found or its download link has expired."
+const errExportTooBig = "The library is too big to be exported directly, start a background export instead."
+const errInvalidRenderSize = "Requested width or height is not one of the supported sizes."
+const errInvalidRenderFit = "Fit mode should be one of contain, cover, fill or pad."
+const errInvalidRenderColor = "Background color should be in rrggbb format."
+const errInvalidRenderFocalPoint = "Focal point coordinates should be between 0 and 1."
+const errInvalidRenderQuality = "Quality should be between 1 and 100."
+const errUnsupportedRenderFormat = "Requested format is not supported. Currently, only jpeg and png can be rendered."
+const errImageNotReady = "Image is still being processed or its processing has failed."
+const errJobNotFound = "Job with such id was not found."
+const errInvalidImportURL = "URL should be an absolute http or https url."
+const errImportAddressNotAllowed = "URL points to an address that can not be imported from."
+const errImportFailed = "Image could not be fetched from the url."
+const errInvalidAppPassword = "App password should have a name of at most 100 characters."
+const errInvalidMailSender = "Senders should be at most 50 valid email addresses."
+const errMailboxNotFound = "Mailbox does not exist."
+const errMailSenderNotAllowed = "Sender is not allowed to send photos to this mailbox."
+const errUnsupportedMail = "Email could not be read."
+const errMailFromMismatch = "From address of the email does not match its sender."
+const errInvalidTimezone = "Timezone should be an IANA timezone name like Europe/Berlin."
+const errInvalidMemoriesRequest = "Date should be in YYYY-MM-DD format, window should be between 0 and 30 days and timezone should be an IANA timezone name."
+const errDeviceProfileNotFound = "Device profile with such id was not found."
+const errInvalidDeviceProfile = "Device profile is not valid. Width and height should be between 64 and 7680, orientation should be landscape or portrait, fit should be contain, cover, fill or pad, colour mode should be colour or grayscale and max file size should be positive."
+const errInvalidImageEdit = "Edits are not valid. Supported edits are rotate, crop, flip, brightness and contrast."
+const errFileTooBig = "File is too big the max size supported is 10 MB."
+const errArchiveTooBig = "Archive is too big the max size supported is 2 GB."
+const errUnsupportedArchive = "Uploaded archive is not a valid zip file."
+const errInvalidSignature = "The signature of url is not valid or it has expired."
+const errSignedURLsDisabled = "Signed urls are not enabled on this server."
+const errSlideshowNotFound = "Slideshow with such id was not found."
+const errInvalidSlideshow = "Slideshow is not valid. Interval and repeat window should be positive, source should be empty or memories, order should be sequential, shuffle or weighted, layout should be single or portraitPairs, pairing should be date or album, gutter should be between 0 and 200 and background should be a hex colour."
+const errDeviceNotFound = "Device with such id was not found."
+const errInvalidDevice = "Device is not valid. Name and model should be at most 100 characters, width and height should be between 64 and 7680, orientation should be landscape or portrait, timezone should be an IANA timezone, only one of slideshow and album can be set, slide duration should be between 0 and 86400 seconds, offline alert should be between 0 and 10080 minutes and the brightness schedule should have at most 24 periods with distinct HH:MM starts and brightness between 0 and 100."
+const errInvalidDeviceToken = "Device token is missing or not valid."
+const errInvalidHeartbeat = "Heartbeat is not valid. Uptime and free storage should be positive, firmware and current image should be at most 100 characters, there should be at most 20 error counters with names of at most 64 characters and Wi-Fi signal should be between -120 and 0 dBm."
+const errInvalidOverlay = "Overlays are not valid. There should be at most 4 overlays of type date, caption, album or watermark, a watermark should have a text of at most 200 characters, position should be topLeft, topCenter, topRight, center, bottomLeft, bottomCenter or bottomRight, font size should be between 8 and 200, colour should be a hex colour and opacity should be between 0 and 1."
+const errInvalidComposite = "Composite should be of two images that are ready, with a gutter between 0 and 200 pixels and a hex background."
+const errShareLinkNotFound = "Share link was not found, it may have been revoked or expired."
+const errInvalidShareLink = "Share link is not valid. Type should be album or slideshow and scope should be view."
+const errSharePasswordRequired = "Password of share link is missing or wrong."
+const errLibraryNotFound = "Library with such id was not found."
+const errLibraryPermission = "Your role in the library does not allow this operation."
+const errInvalidLibraryRole = "Role should be owner, contributor or viewer."
+const errInvitationNotFound = "Invitation was not found or it has expired."
+const errLastLibraryOwner = "A library should have at least one owner."
+const errInvalidImageMetadata = "Caption should be at most 2000 characters, there should be at most 50 tags of at most 64 characters and rating should be between 0 and 5."
+const errInvalidSearch = "Search is not valid. Dates should be in YYYY-MM-DD format."
+const errStorageQuotaExceeded = "Storage quota exceeded, %d of %d bytes are already used. Delete some images to upload more."
 
 const emailSubject = "Verification Code"
 const emailBody = "Your verification code is: "
+const mailSummarySubject = "Your photos were received"
+const mailSummaryNoPhotos = "No photos were found in your email. Attach the photos to the email instead of putting them in the text."
+const mailSummaryAdded = "%d of the %d photos in your email were added.\n"
+const mailSummaryFailure = "%s was not added: %s\n"
+const libraryInvitationSubject = "Invitation to a shared library"
+const libraryInvitationBody = "%s invited you to the library %q as %s. Sign in and accept the invitation with the code: %s"
+const deviceOfflineSubject = "Your frame is offline"
+const deviceOfflineBody = "Your frame %q has not sent a heartbeat since %s. Check that it is powered on and connected to Wi-Fi."
+const deviceOnlineSubject = "Your frame is back online"
+const deviceOnlineBody = "Your frame %q is sending heartbeats again since %s."
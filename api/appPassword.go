@@ -0,0 +1,227 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/matba/slyde-server/internals/db"
+	"github.com/matba/slyde-server/internals/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const appPasswordService = "APP_PASSWORD"
+const appPasswordLength = 15
+const maxAppPasswordName = 100
+const appPasswordUsageInterval = time.Hour
+
+// HandleAppPassword handles API calls for the passwords of apps that can not sign in with a session
+func HandleAppPassword(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	log.Printf("Incoming call for app passwords")
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, appPasswordService)
+	if err != nil {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		handleAppPasswordGet(w, user)
+	case "POST":
+		handleAppPasswordPost(w, r, user)
+	case "DELETE":
+		handleAppPasswordDel(w, r, user)
+	default:
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+}
+
+func handleAppPasswordGet(w http.ResponseWriter, user *db.User) {
+	passwords := []userAppPassword{}
+	for _, password := range user.AppPasswords {
+		passwords = append(passwords, toUserAppPassword(password))
+	}
+	js, _ := json.Marshal(userAppPasswords{PasswordList: passwords})
+	w.Write(js)
+}
+
+// handleAppPasswordPost creates a new app password, the password is only returned in this response
+func handleAppPasswordPost(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request appPasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, appPasswordService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if len(request.Name) == 0 || len(request.Name) > maxAppPasswordName {
+		log.Printf(errLogTemplate, errLogValidation, appPasswordService, user.Email, request.Name)
+		WriteErrorOnResponse(errInvalidAppPassword, &w, http.StatusBadRequest)
+		return
+	}
+
+	password, err := generateAppPassword()
+	if err != nil {
+		log.Printf(errLogTemplate, errLogValidation, appPasswordService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+	id, _ := uuid.NewUUID()
+	appPassword := db.AppPassword{
+		ID:           id.String(),
+		Name:         request.Name,
+		PasswordHash: utils.HashAndSalt(password),
+		CreationDate: time.Now(),
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, appPasswordService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}}
+	update := bson.D{
+		{"$push", bson.D{
+			{"apppasswords", appPassword},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, appPasswordService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	userPassword := toUserAppPassword(appPassword)
+	userPassword.Password = password
+	js, _ := json.Marshal(userPassword)
+	w.Write(js)
+}
+
+// handleAppPasswordDel revokes the app passwords, the apps using them can not access the library afterwards
+func handleAppPasswordDel(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request appPasswordDeleteRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, appPasswordService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	deleteRequestSet := make(map[string]bool)
+	for _, passwordID := range request.PasswordIds {
+		deleteRequestSet[passwordID] = true
+	}
+	deletedPasswords := []string{}
+	for _, password := range user.AppPasswords {
+		if deleteRequestSet[password.ID] {
+			deletedPasswords = append(deletedPasswords, password.ID)
+		}
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, appPasswordService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}}
+	update := bson.D{
+		{"$pull", bson.D{
+			{"apppasswords", bson.D{
+				{"id", bson.D{
+					{"$in", deletedPasswords},
+				}},
+			}},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, appPasswordService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(appPasswordDeleteResponse{
+		NumberDeleted: len(deletedPasswords),
+	})
+	w.Write(js)
+}
+
+// findAppPassword returns the app password of user that matches password or nil if none of them matches
+func findAppPassword(user *db.User, password string) *db.AppPassword {
+	if len(password) == 0 {
+		return nil
+	}
+	for i := range user.AppPasswords {
+		if utils.ComparePasswords(user.AppPasswords[i].PasswordHash, password) {
+			return &user.AppPasswords[i]
+		}
+	}
+	return nil
+}
+
+// markAppPasswordUsed updates the last time the app password was used, apps like WebDAV clients send the
+// password with every request so it is not updated more than once an hour
+func markAppPasswordUsed(user *db.User, appPassword *db.AppPassword) {
+	if time.Since(appPassword.LastUsedDate) < appPasswordUsageInterval {
+		return
+	}
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, appPasswordService, user.Email, err.Error())
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}, {"apppasswords.id", appPassword.ID}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"apppasswords.$.lastuseddate", time.Now()},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, appPasswordService, user.Email, err.Error())
+	}
+}
+
+// generateAppPassword creates a random password of letters and digits, so it can be typed in the settings
+// of apps
+func generateAppPassword() (string, error) {
+	password := make([]byte, appPasswordLength)
+	_, err := rand.Read(password)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(base32.StdEncoding.EncodeToString(password)), nil
+}
+
+func toUserAppPassword(password db.AppPassword) userAppPassword {
+	return userAppPassword{
+		ID:           password.ID,
+		Name:         password.Name,
+		CreationDate: password.CreationDate,
+		LastUsedDate: password.LastUsedDate,
+	}
+}
@@ -0,0 +1,223 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/matba/slyde-server/internals/db"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const imageBulkImportService = "IMAGE_BULK_IMPORT"
+
+// bulkImporter keeps the state of a bulk import while the files of the request are streamed
+type bulkImporter struct {
+	user       *db.User
+	collection *mongo.Collection
+	response   bulkImportResponse
+}
+
+// HandleImageBulk handles API calls for importing many images at once
+func HandleImageBulk(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		handleImageBulkPost(w, r)
+	default:
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+}
+
+func handleImageBulkPost(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	log.Printf("Incoming call for bulk importing images")
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, imageBulkImportService)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogDb, imageBulkImportService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	// the parts are read one by one so the whole request is never kept in memory
+	reader, err := r.MultipartReader()
+	if err != nil {
+		log.Printf(errLogTemplate, errLogImageUploadError, imageBulkImportService, email, err.Error())
+		WriteErrorOnResponse(errBadRequest, &w, http.StatusBadRequest)
+		return
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, imageBulkImportService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	importer := bulkImporter{
+		user:       user,
+		collection: (*client).Database(db.MainDbName).Collection(db.UsersCollection),
+		response:   bulkImportResponse{Results: []bulkImportResult{}},
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf(errLogTemplate, errLogImageUploadError, imageBulkImportService, email, err.Error())
+			WriteErrorOnResponse(errBadRequest, &w, http.StatusBadRequest)
+			return
+		}
+
+		// only the file parts are imported
+		if len(part.FileName()) == 0 {
+			part.Close()
+			continue
+		}
+
+		if isZipArchive(part) {
+			importer.importArchive(part)
+		} else {
+			importer.importFile(part.FileName(), part)
+		}
+		part.Close()
+	}
+
+	js, _ := json.Marshal(importer.response)
+	w.Write(js)
+}
+
+// importArchive spools the zip archive to a temporary file and imports its entries one at a time
+func (b *bulkImporter) importArchive(part *multipart.Part) {
+	archiveName := part.FileName()
+
+	tmpFile, err := ioutil.TempFile("", "bulk-import-*"+zipExtension)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogIoError, imageBulkImportService, b.user.Email, err.Error())
+		b.addFailure(archiveName, errInternalError)
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	size, err := io.Copy(tmpFile, io.LimitReader(part, maxBulkArchiveSize+1))
+	if err != nil {
+		log.Printf(errLogTemplate, errLogImageUploadError, imageBulkImportService, b.user.Email, err.Error())
+		b.addFailure(archiveName, errInternalError)
+		return
+	}
+	if size > maxBulkArchiveSize {
+		log.Printf(errLogTemplate, errLogImageValidationError, imageBulkImportService, b.user.Email, "Archive too big")
+		b.addFailure(archiveName, errArchiveTooBig)
+		return
+	}
+
+	archive, err := zip.NewReader(tmpFile, size)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogImageValidationError, imageBulkImportService, b.user.Email, err.Error())
+		b.addFailure(archiveName, errUnsupportedArchive)
+		return
+	}
+
+	for _, entry := range archive.File {
+		entryName := archiveName + "/" + entry.Name
+		if entry.FileInfo().IsDir() || isHiddenArchiveEntry(entry.Name) {
+			continue
+		}
+
+		entryReader, err := entry.Open()
+		if err != nil {
+			log.Printf(errLogTemplate, errLogImageValidationError, imageBulkImportService, b.user.Email, err.Error())
+			b.addFailure(entryName, errUnsupportedArchive)
+			continue
+		}
+		b.importFile(entryName, entryReader)
+		entryReader.Close()
+	}
+}
+
+// importFile validates and stores a single image of the bulk request
+func (b *bulkImporter) importFile(fileName string, reader io.Reader) {
+	content, err := readLimited(reader, maxUploadSize)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogImageUploadError, imageBulkImportService, b.user.Email, err.Error())
+		b.addFailure(fileName, errFileTooBig)
+		return
+	}
+
+	// acceptUpload keeps the usage of user up to date, so the quota is checked for every file
+	imgInfo, job, uploadErr := acceptUpload(b.collection, b.user, imageNameFromFileName(fileName), bytes.NewReader(content))
+	if uploadErr != nil {
+		log.Printf(errLogTemplate, errLogImageValidationError, imageBulkImportService, b.user.Email, uploadErr.Error())
+		b.addFailure(fileName, uploadErr.description)
+		return
+	}
+
+	userImage := toUserImage(*imgInfo)
+	userImage.JobID = job.ID
+	b.response.Results = append(b.response.Results, bulkImportResult{
+		File:    fileName,
+		Success: true,
+		Image:   &userImage,
+	})
+	b.response.Succeeded++
+}
+
+func (b *bulkImporter) addFailure(fileName string, description string) {
+	b.response.Results = append(b.response.Results, bulkImportResult{
+		File:    fileName,
+		Success: false,
+		Error:   description,
+	})
+	b.response.Failed++
+}
+
+// readLimited reads the whole reader and fails if it is bigger than limit
+func readLimited(reader io.Reader, limit int64) ([]byte, error) {
+	content, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > limit {
+		return nil, errors.New("File too big")
+	}
+	return content, nil
+}
+
+func isZipArchive(part *multipart.Part) bool {
+	contentType := part.Header.Get("Content-Type")
+	return contentType == "application/zip" || contentType == "application/x-zip-compressed" ||
+		strings.ToLower(path.Ext(part.FileName())) == zipExtension
+}
+
+// isHiddenArchiveEntry recognizes the metadata files that archivers put next to the real files
+func isHiddenArchiveEntry(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") || segment == "__MACOSX" {
+			return true
+		}
+	}
+	return false
+}
+
+// imageNameFromFileName uses the base name of file without extension as the image name
+func imageNameFromFileName(fileName string) string {
+	base := path.Base(fileName)
+	return strings.TrimSuffix(base, path.Ext(base))
+}
@@ -0,0 +1,339 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/google/uuid"
+	"github.com/matba/slyde-server/internals/db"
+	"github.com/matba/slyde-server/internals/variants"
+)
+
+const compositeService = "SLIDESHOW_COMPOSITE"
+
+// the resolution composites are rendered at when the client does not send the resolution of frame
+const defaultCompositeWidth = 1920
+const defaultCompositeHeight = 1080
+
+// the thumbnails of composites are a quarter of their size
+const compositeThumbnailDivisor = 4
+
+const defaultSlideshowGutter = 16
+const maxSlideshowGutter = 200
+const defaultSlideshowBackground = "#000000"
+
+// portrait images taken further apart are not paired by date
+const maxPairingGap = 30 * 24 * time.Hour
+
+// compositeNamespace is used to derive the stable ids of composites from the ids of their images
+var compositeNamespace = uuid.MustParse("6f1d5c3e-8a2b-4c7d-9e0f-1a2b3c4d5e6f")
+
+// HandleImageComposite serves the composite of two images of user side by side, the composite is rendered
+// on first request and kept in the variant cache like the other variants of images
+func HandleImageComposite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		SetJsonContentType(w)
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	user := getCompositeUser(w, r)
+	if user == nil {
+		return
+	}
+	email := user.Email
+
+	pair, width, height, gutter, background, err := parseCompositeRequest(r, user)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogValidation, compositeService, email, err.Error())
+		SetJsonContentType(w)
+		WriteErrorOnResponse(errInvalidComposite, &w, http.StatusBadRequest)
+		return
+	}
+	if len(r.FormValue("thumbnail")) > 0 {
+		width, height, gutter = width/compositeThumbnailDivisor, height/compositeThumbnailDivisor, gutter/compositeThumbnailDivisor
+	}
+
+	compositeID := getCompositeID(pair[0], pair[1])
+	version := getCompositeVersion(user.ID, pair[0], pair[1])
+	variantKey := fmt.Sprintf("w%d-h%d-g%d-bg%02x%02x%02x-%s", width, height, gutter,
+		background.R, background.G, background.B, version[:12])
+	fpv := getUserVariantImagePath(user.ID, compositeID, variantKey, jpegExtension)
+	if !variants.GetVariantCache().Lookup(fpv) {
+		log.Printf("Rendering composite of %q and %q as %q", pair[0].Name, pair[1].Name, variantKey)
+		err = createCompositeImage(user.ID, pair, fpv, width, height, gutter, background)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogIoError, compositeService, email, err.Error())
+			SetJsonContentType(w)
+			WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+			return
+		}
+		err = variants.GetVariantCache().Add(variants.ImageKey(user.ID, compositeID), fpv)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogIoError, compositeService, email, err.Error())
+		}
+	}
+
+	serveImageFile(w, r, fpv, getVariantETag(version, variantKey), version)
+}
+
+// parseCompositeRequest finds the two images of composite and reads the size and colours it is rendered with
+func parseCompositeRequest(r *http.Request, user *db.User) ([]db.ImageInfo, int, int, int, color.NRGBA, error) {
+	ids := strings.Split(r.FormValue("images"), ",")
+	if len(ids) != 2 {
+		return nil, 0, 0, 0, color.NRGBA{}, errors.New("Composite needs two images " + r.FormValue("images"))
+	}
+	pair := []db.ImageInfo{}
+	for _, id := range ids {
+		img := findUserImage(user, id)
+		if img == nil || img.IsTrashed() || !img.IsReady() {
+			return nil, 0, 0, 0, color.NRGBA{}, errors.New("Image is not found or not ready " + id)
+		}
+		pair = append(pair, *img)
+	}
+
+	width, height, err := parseCompositeSize(r)
+	if err != nil {
+		return nil, 0, 0, 0, color.NRGBA{}, err
+	}
+
+	gutter := defaultSlideshowGutter
+	if gutterStr := r.FormValue("gutter"); len(gutterStr) > 0 {
+		gutter, err = strconv.Atoi(gutterStr)
+		if err != nil || gutter < 0 || gutter > maxSlideshowGutter {
+			return nil, 0, 0, 0, color.NRGBA{}, errors.New("Invalid gutter " + gutterStr)
+		}
+	}
+
+	background, err := parseHexColor(defaultSlideshowBackground)
+	if bg := r.FormValue("bg"); len(bg) > 0 {
+		background, err = parseHexColor(bg)
+	}
+	return pair, width, height, gutter, background, err
+}
+
+// parseCompositeSize reads the resolution of frame from the w and h parameters, the default resolution is
+// used if they are not sent
+func parseCompositeSize(r *http.Request) (int, int, error) {
+	width, err := parseRenderSize(r.FormValue("w"))
+	if err != nil {
+		return 0, 0, err
+	}
+	height, err := parseRenderSize(r.FormValue("h"))
+	if err != nil {
+		return 0, 0, err
+	}
+	if width == 0 && height == 0 {
+		return defaultCompositeWidth, defaultCompositeHeight, nil
+	}
+	if width == 0 || height == 0 {
+		return 0, 0, errors.New("Both width and height of frame should be sent")
+	}
+	return width, height, nil
+}
+
+// createCompositeImage puts the images of pair next to each other on the background, each image is fitted
+// in its half of the frame without cropping
+func createCompositeImage(userID string, pair []db.ImageInfo, variantPath string, width int, height int,
+	gutter int, background color.NRGBA) error {
+	cellWidth := (width - gutter) / 2
+	composite := imaging.New(width, height, background)
+	for i, img := range pair {
+		source, err := imaging.Open(getUserImagePath(userID, img.ID, false))
+		if err != nil {
+			return err
+		}
+		cell := renderImage(source, renderOptions{
+			Width:      cellWidth,
+			Height:     height,
+			Fit:        fitPad,
+			Background: background,
+		})
+		composite = imaging.Paste(composite, cell, image.Pt(i*(width-cellWidth), 0))
+	}
+	return writeVariantImage(composite, variantPath, renderOptions{
+		Quality: defaultRenderQuality,
+		Format:  formatJpeg,
+	})
+}
+
+// pairSlideshowImages groups the images into slides, each portrait image is shown together with the portrait
+// image that is closest to it in time or shares an album with it. The pairs are put where their first image
+// was and the older image of a pair is on the left.
+func pairSlideshowImages(user *db.User, slideshow *db.Slideshow, images []db.ImageInfo) [][]db.ImageInfo {
+	var imageAlbums map[string]map[string]bool
+	if slideshow.Pairing == db.SlideshowPairingAlbum {
+		imageAlbums = getImageAlbums(user)
+	}
+
+	slides := [][]db.ImageInfo{}
+	used := make([]bool, len(images))
+	for i, img := range images {
+		if used[i] {
+			continue
+		}
+		used[i] = true
+		partner := -1
+		if isPortraitImage(img) {
+			partner = findPortraitPartner(slideshow, images, used, i, imageAlbums)
+		}
+		if partner < 0 {
+			slides = append(slides, []db.ImageInfo{img})
+			continue
+		}
+
+		used[partner] = true
+		left, right := img, images[partner]
+		if getImageDate(right).Before(getImageDate(left)) {
+			left, right = right, left
+		}
+		slides = append(slides, []db.ImageInfo{left, right})
+	}
+	return slides
+}
+
+// findPortraitPartner returns the index of the portrait image after the image at index that should be shown
+// with it or -1 if there is no such image
+func findPortraitPartner(slideshow *db.Slideshow, images []db.ImageInfo, used []bool, index int,
+	imageAlbums map[string]map[string]bool) int {
+	img := images[index]
+	partner := -1
+	var partnerGap time.Duration
+	for j := index + 1; j < len(images); j++ {
+		candidate := images[j]
+		if used[j] || candidate.ID == img.ID || !isPortraitImage(candidate) {
+			continue
+		}
+
+		if slideshow.Pairing == db.SlideshowPairingAlbum {
+			// all images of an album slideshow are in the same album
+			if len(slideshow.AlbumID) > 0 || shareAlbum(imageAlbums[img.ID], imageAlbums[candidate.ID]) {
+				return j
+			}
+			continue
+		}
+
+		gap := getImageDate(candidate).Sub(getImageDate(img))
+		if gap < 0 {
+			gap = -gap
+		}
+		if gap <= maxPairingGap && (partner < 0 || gap < partnerGap) {
+			partner, partnerGap = j, gap
+		}
+	}
+	return partner
+}
+
+// getImageAlbums returns the ids of the albums each image of user is in
+func getImageAlbums(user *db.User) map[string]map[string]bool {
+	imageAlbums := make(map[string]map[string]bool)
+	for _, album := range user.Albums {
+		for _, imageID := range album.ImageIDs {
+			if imageAlbums[imageID] == nil {
+				imageAlbums[imageID] = make(map[string]bool)
+			}
+			imageAlbums[imageID][album.ID] = true
+		}
+	}
+	return imageAlbums
+}
+
+func shareAlbum(first map[string]bool, second map[string]bool) bool {
+	for albumID := range first {
+		if second[albumID] {
+			return true
+		}
+	}
+	return false
+}
+
+func isPortraitImage(img db.ImageInfo) bool {
+	return img.Height > img.Width
+}
+
+// getImageDate returns the date the image was taken, the upload date is used if the capture date is not known
+func getImageDate(img db.ImageInfo) time.Time {
+	if !img.CaptureDate.IsZero() {
+		return img.CaptureDate
+	}
+	return img.UploadDate
+}
+
+// getCompositeID derives the id of composite from its images, so the same pair always gets the same id
+func getCompositeID(left db.ImageInfo, right db.ImageInfo) string {
+	return uuid.NewSHA1(compositeNamespace, []byte(left.ID+"/"+right.ID)).String()
+}
+
+// isCompositeID checks if the id is of a composite, the ids of images are time based while the ids of composites
+// are derived from their images
+func isCompositeID(id string) bool {
+	parsed, err := uuid.Parse(id)
+	return err == nil && parsed.Version() == 5
+}
+
+// getCompositeVersion derives the version of composite from the versions of its images, so the composite is
+// rendered again after any of them is edited
+func getCompositeVersion(userID string, left db.ImageInfo, right db.ImageInfo) string {
+	hash := sha256.Sum256([]byte(getImageVersion(userID, left, false) + "/" + getImageVersion(userID, right, false)))
+	return hex.EncodeToString(hash[:])
+}
+
+// toCompositeSlide creates the virtual slide that shows the pair of images on a frame of the size
+func toCompositeSlide(user *db.User, slideshow *db.Slideshow, pair []db.ImageInfo, width int, height int) UserImage {
+	query := url.Values{}
+	query.Set("images", pair[0].ID+","+pair[1].ID)
+	query.Set("w", strconv.Itoa(width))
+	query.Set("h", strconv.Itoa(height))
+	query.Set("gutter", strconv.Itoa(slideshow.Gutter))
+	if len(slideshow.Background) > 0 {
+		query.Set("bg", strings.TrimPrefix(slideshow.Background, "#"))
+	}
+	version := getCompositeVersion(user.ID, pair[0], pair[1])
+	query.Set("v", version)
+	compositeURL := "/images/composite?" + query.Encode()
+
+	return UserImage{
+		ID:           getCompositeID(pair[0], pair[1]),
+		Name:         pair[0].Name + " | " + pair[1].Name,
+		Width:        uint(width),
+		Height:       uint(height),
+		Status:       db.ImageStatusReady,
+		Version:      version,
+		URL:          compositeURL,
+		ThumbnailURL: compositeURL + "&thumbnail=1",
+		Tags:         []string{},
+		Composite:    []string{pair[0].ID, pair[1].ID},
+	}
+}
+
+// getCompositeUser returns the user whose images are composed, frames compose the images of their owner with
+// their token and other clients need a session. If there is an error appropriate response is written to output
+// and nil is returned.
+func getCompositeUser(w http.ResponseWriter, r *http.Request) *db.User {
+	if isDeviceRequest(r) {
+		user, device := getDeviceFromToken(w, r)
+		if device == nil {
+			return nil
+		}
+		return user
+	}
+	email := GetUser(w, r)
+	if email == "" {
+		return nil
+	}
+	user, err := GetUserByEmail(w, email, compositeService)
+	if err != nil {
+		return nil
+	}
+	return user
+}
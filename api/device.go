@@ -0,0 +1,613 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/matba/slyde-server/internals/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const deviceService = "DEVICE"
+const deviceTokenLength = 24
+const maxDeviceName = 100
+const maxSlideDuration = 24 * 60 * 60
+const maxBrightnessPeriods = 24
+const maxBrightness = 100
+const maxOfflineAlertMinutes = 7 * 24 * 60
+const brightnessStartLayout = "15:04"
+const bearerPrefix = "Bearer "
+
+// HandleDevice handles API calls for the frames of user
+func HandleDevice(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	log.Printf("Incoming call for devices")
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, deviceService)
+	if err != nil {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		devices := []userDevice{}
+		for _, device := range user.Devices {
+			devices = append(devices, toUserDevice(device))
+		}
+		js, _ := json.Marshal(userDevices{DeviceList: devices})
+		w.Write(js)
+	case "POST":
+		handleDevicePost(w, r, user)
+	case "PUT":
+		handleDevicePut(w, r, user)
+	case "DELETE":
+		handleDeviceDel(w, r, user)
+	default:
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+}
+
+// handleDevicePost adds the device, its token is only returned in this response
+func handleDevicePost(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request deviceRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, deviceService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if len(request.Name) == 0 {
+		log.Printf(errLogTemplate, errLogMissingField, deviceService, user.Email, "Device name not provided.")
+		WriteErrorOnResponse(errBadRequest, &w, http.StatusBadRequest)
+		return
+	}
+
+	id, _ := uuid.NewUUID()
+	device := db.Device{
+		ID:                 id.String(),
+		Name:               request.Name,
+		Orientation:        db.ProfileOrientationLandscape,
+		BrightnessSchedule: []db.BrightnessPeriod{},
+		CreationDate:       time.Now(),
+	}
+	if request.Height > request.Width {
+		device.Orientation = db.ProfileOrientationPortrait
+	}
+	if !updateDeviceFromRequest(w, user, &device, request) {
+		return
+	}
+	token, err := generateDeviceToken()
+	if err != nil {
+		log.Printf(errLogTemplate, errLogValidation, deviceService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+	device.TokenHash = hashDeviceToken(token)
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, deviceService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}}
+	update := bson.D{
+		{"$push", bson.D{
+			{"devices", device},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, deviceService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	userDevice := toUserDevice(device)
+	userDevice.Token = token
+	js, _ := json.Marshal(userDevice)
+	w.Write(js)
+}
+
+// handleDevicePut updates the settings of device, the token of device is renewed if it is asked for and the
+// new token is only returned in this response
+func handleDevicePut(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request deviceRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, deviceService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	device := findUserDevice(user, request.ID)
+	if device == nil {
+		log.Printf(errLogTemplate, errLogNotFound, deviceService, user.Email, request.ID)
+		WriteErrorOnResponse(errDeviceNotFound, &w, http.StatusNotFound)
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if len(request.Name) > 0 {
+		device.Name = request.Name
+	}
+	if !updateDeviceFromRequest(w, user, device, request) {
+		return
+	}
+	token := ""
+	if request.RenewToken {
+		token, err = generateDeviceToken()
+		if err != nil {
+			log.Printf(errLogTemplate, errLogValidation, deviceService, user.Email, err.Error())
+			WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+			return
+		}
+		device.TokenHash = hashDeviceToken(token)
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, deviceService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	// only the settings are set, so the heartbeats and alerts saved while the device was updated are kept
+	filter := bson.D{{"id", user.ID}, {"devices.id", device.ID}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"devices.$.name", device.Name},
+			{"devices.$.model", device.Model},
+			{"devices.$.width", device.Width},
+			{"devices.$.height", device.Height},
+			{"devices.$.orientation", device.Orientation},
+			{"devices.$.timezone", device.Timezone},
+			{"devices.$.slideshowid", device.SlideshowID},
+			{"devices.$.albumid", device.AlbumID},
+			{"devices.$.profileid", device.ProfileID},
+			{"devices.$.slideduration", device.SlideDuration},
+			{"devices.$.brightnessschedule", device.BrightnessSchedule},
+			{"devices.$.offlinealertminutes", device.OfflineAlertMinutes},
+			{"devices.$.tokenhash", device.TokenHash},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, deviceService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	userDevice := toUserDevice(*device)
+	userDevice.Token = token
+	js, _ := json.Marshal(userDevice)
+	w.Write(js)
+}
+
+func handleDeviceDel(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request deviceDeleteRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, deviceService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	deleteRequestSet := make(map[string]bool)
+	for _, deviceID := range request.DeviceIds {
+		deleteRequestSet[deviceID] = true
+	}
+	deletedDevices := []string{}
+	for _, device := range user.Devices {
+		if deleteRequestSet[device.ID] {
+			deletedDevices = append(deletedDevices, device.ID)
+		}
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, deviceService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}}
+	update := bson.D{
+		{"$pull", bson.D{
+			{"devices", bson.D{
+				{"id", bson.D{
+					{"$in", deletedDevices},
+				}},
+			}},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, deviceService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(deviceDeleteResponse{
+		NumberDeleted: len(deletedDevices),
+	})
+	w.Write(js)
+}
+
+// updateDeviceFromRequest validates the settings in request and sets them on device, if they are not valid
+// appropriate response is written to output
+func updateDeviceFromRequest(w http.ResponseWriter, user *db.User, device *db.Device, request deviceRequest) bool {
+	if request.SlideshowID != nil && len(*request.SlideshowID) > 0 && findUserSlideshow(user, *request.SlideshowID) == nil {
+		log.Printf(errLogTemplate, errLogNotFound, deviceService, user.Email, *request.SlideshowID)
+		WriteErrorOnResponse(errSlideshowNotFound, &w, http.StatusNotFound)
+		return false
+	}
+	if request.AlbumID != nil && len(*request.AlbumID) > 0 && findUserAlbum(user, *request.AlbumID) == nil {
+		log.Printf(errLogTemplate, errLogNotFound, deviceService, user.Email, *request.AlbumID)
+		WriteErrorOnResponse(errAlbumNotFound, &w, http.StatusNotFound)
+		return false
+	}
+	if request.ProfileID != nil && len(*request.ProfileID) > 0 && findDeviceProfile(user, *request.ProfileID) == nil {
+		log.Printf(errLogTemplate, errLogNotFound, deviceService, user.Email, *request.ProfileID)
+		WriteErrorOnResponse(errDeviceProfileNotFound, &w, http.StatusNotFound)
+		return false
+	}
+	if len(request.Name) > maxDeviceName || (request.Model != nil && len(*request.Model) > maxDeviceName) ||
+		!isProfileDimension(request.Width) || !isProfileDimension(request.Height) || !isProfileOrientation(request.Orientation) ||
+		(request.SlideDuration != nil && (*request.SlideDuration < 0 || *request.SlideDuration > maxSlideDuration)) ||
+		(request.OfflineAlertMinutes != nil && (*request.OfflineAlertMinutes < 0 || *request.OfflineAlertMinutes > maxOfflineAlertMinutes)) {
+		log.Printf(errLogTemplate, errLogValidation, deviceService, user.Email, request.Name)
+		WriteErrorOnResponse(errInvalidDevice, &w, http.StatusBadRequest)
+		return false
+	}
+	if request.SlideshowID != nil && request.AlbumID != nil && len(*request.SlideshowID) > 0 && len(*request.AlbumID) > 0 {
+		log.Printf(errLogTemplate, errLogValidation, deviceService, user.Email, "Both slideshow and album are set.")
+		WriteErrorOnResponse(errInvalidDevice, &w, http.StatusBadRequest)
+		return false
+	}
+	if request.Timezone != nil {
+		_, err := time.LoadLocation(*request.Timezone)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogValidation, deviceService, user.Email, err.Error())
+			WriteErrorOnResponse(errInvalidDevice, &w, http.StatusBadRequest)
+			return false
+		}
+	}
+	if request.BrightnessSchedule != nil {
+		schedule, err := parseBrightnessSchedule(*request.BrightnessSchedule)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogValidation, deviceService, user.Email, err.Error())
+			WriteErrorOnResponse(errInvalidDevice, &w, http.StatusBadRequest)
+			return false
+		}
+		device.BrightnessSchedule = schedule
+	}
+
+	// a frame shows either a slideshow or an album, setting one of them clears the other
+	if request.SlideshowID != nil {
+		device.SlideshowID = *request.SlideshowID
+		if len(device.SlideshowID) > 0 {
+			device.AlbumID = ""
+		}
+	}
+	if request.AlbumID != nil {
+		device.AlbumID = *request.AlbumID
+		if len(device.AlbumID) > 0 {
+			device.SlideshowID = ""
+		}
+	}
+
+	if request.Model != nil {
+		device.Model = strings.TrimSpace(*request.Model)
+	}
+	if request.Width > 0 {
+		device.Width = request.Width
+	}
+	if request.Height > 0 {
+		device.Height = request.Height
+	}
+	if len(request.Orientation) > 0 {
+		device.Orientation = request.Orientation
+	}
+	if request.Timezone != nil {
+		device.Timezone = *request.Timezone
+	}
+	if request.ProfileID != nil {
+		device.ProfileID = *request.ProfileID
+	}
+	if request.SlideDuration != nil {
+		device.SlideDuration = *request.SlideDuration
+	}
+	if request.OfflineAlertMinutes != nil {
+		device.OfflineAlertMinutes = *request.OfflineAlertMinutes
+	}
+	return true
+}
+
+// parseBrightnessSchedule validates the periods of schedule and sorts them by their start
+func parseBrightnessSchedule(requested []userBrightnessPeriod) ([]db.BrightnessPeriod, error) {
+	if len(requested) > maxBrightnessPeriods {
+		return nil, errors.New("Too many brightness periods")
+	}
+	schedule := []db.BrightnessPeriod{}
+	starts := make(map[string]bool)
+	for _, period := range requested {
+		start, err := time.Parse(brightnessStartLayout, period.Start)
+		if err != nil {
+			return nil, err
+		}
+		if period.Brightness < 0 || period.Brightness > maxBrightness {
+			return nil, errors.New("Invalid brightness")
+		}
+		// the start is formatted again so 7:30 and 07:30 are the same period
+		formatted := start.Format(brightnessStartLayout)
+		if starts[formatted] {
+			return nil, errors.New("Duplicate brightness period " + formatted)
+		}
+		starts[formatted] = true
+		schedule = append(schedule, db.BrightnessPeriod{Start: formatted, Brightness: period.Brightness})
+	}
+	sort.Slice(schedule, func(i, j int) bool {
+		return schedule[i].Start < schedule[j].Start
+	})
+	return schedule, nil
+}
+
+// HandleDeviceConfig returns the configuration of the device whose token is in the Authorization header,
+// the settings the device does not set are taken from its slideshow and user
+func HandleDeviceConfig(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	if r.Method != "GET" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	user, device := getDeviceFromToken(w, r)
+	if device == nil {
+		return
+	}
+	markDeviceSeen(user, device, r)
+
+	js, _ := json.Marshal(getDeviceConfig(user, device, time.Now()))
+	w.Write(js)
+}
+
+// getDeviceConfig resolves the settings of device, a slideshow, album or profile that has been deleted after it
+// was assigned is ignored so the frame shows all images of user. The images to show are listed in the config, so
+// the frame only needs its token to fetch them, the images of memories slideshows are picked by the day in the
+// timezone of frame.
+func getDeviceConfig(user *db.User, device *db.Device, now time.Time) deviceConfig {
+	location, err := getUserLocation(user, device.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	localNow := now.In(location)
+	_, offset := localNow.Zone()
+
+	effective := deviceConfig{
+		ID:                 device.ID,
+		Name:               device.Name,
+		Width:              device.Width,
+		Height:             device.Height,
+		Orientation:        device.Orientation,
+		Timezone:           location.String(),
+		UTCOffset:          offset,
+		SlideDuration:      device.SlideDuration,
+		BrightnessSchedule: toUserBrightnessSchedule(device.BrightnessSchedule),
+		Brightness:         getScheduledBrightness(device.BrightnessSchedule, localNow),
+		ServerTime:         now,
+	}
+	if slideshow := findUserSlideshow(user, device.SlideshowID); slideshow != nil {
+		slideshowJSON := toUserSlideshow(*slideshow)
+		slideshowJSON.Images = []UserImage{}
+		for _, img := range getSlideshowImages(user, slideshow, location.String()) {
+			slideshowJSON.Images = append(slideshowJSON.Images, toSlideshowImage(user, slideshow, img))
+		}
+		effective.Slideshow = &slideshowJSON
+		if effective.SlideDuration == 0 {
+			effective.SlideDuration = slideshow.Interval
+		}
+	} else if album := findUserAlbum(user, device.AlbumID); album != nil {
+		effective.AlbumID = device.AlbumID
+		effective.Images = toDeviceImages(getAlbumImages(user, album))
+	} else {
+		effective.Images = toDeviceImages(getActiveImages(user))
+	}
+	if effective.SlideDuration == 0 {
+		effective.SlideDuration = defaultSlideshowInterval
+	}
+	if findDeviceProfile(user, device.ProfileID) != nil {
+		effective.ProfileID = device.ProfileID
+	}
+	return effective
+}
+
+// toDeviceImages returns the images a frame can show, the images that are not processed or never shown are left out
+func toDeviceImages(images []db.ImageInfo) []UserImage {
+	deviceImages := []UserImage{}
+	for _, img := range images {
+		if img.IsReady() && !img.NeverShow {
+			deviceImages = append(deviceImages, toUserImage(img))
+		}
+	}
+	return deviceImages
+}
+
+// getScheduledBrightness returns the brightness of the period the local time is in, the last period of the
+// day lasts until the first period of the next day
+func getScheduledBrightness(schedule []db.BrightnessPeriod, localNow time.Time) int {
+	if len(schedule) == 0 {
+		return maxBrightness
+	}
+	current := localNow.Format(brightnessStartLayout)
+	brightness := schedule[len(schedule)-1].Brightness
+	for _, period := range schedule {
+		if period.Start > current {
+			break
+		}
+		brightness = period.Brightness
+	}
+	return brightness
+}
+
+// getDeviceFromToken finds the device of the token in Authorization header and its owner, if the token is not
+// valid appropriate response is written to output and nil is returned
+func getDeviceFromToken(w http.ResponseWriter, r *http.Request) (*db.User, *db.Device) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, bearerPrefix) || len(header) == len(bearerPrefix) {
+		WriteErrorOnResponse(errInvalidDeviceToken, &w, http.StatusUnauthorized)
+		return nil, nil
+	}
+	tokenHash := hashDeviceToken(strings.TrimPrefix(header, bearerPrefix))
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, deviceService, "", err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return nil, nil
+	}
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	var user db.User
+	err = collection.FindOne(context.TODO(), bson.D{{"devices.tokenhash", tokenHash}}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		log.Printf(errLogTemplate, errLogWrongCredentials, deviceService, "", r.RemoteAddr)
+		WriteErrorOnResponse(errInvalidDeviceToken, &w, http.StatusUnauthorized)
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, deviceService, "", err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return nil, nil
+	}
+
+	for i := range user.Devices {
+		if user.Devices[i].TokenHash == tokenHash {
+			return &user, &user.Devices[i]
+		}
+	}
+	WriteErrorOnResponse(errInvalidDeviceToken, &w, http.StatusUnauthorized)
+	return nil, nil
+}
+
+// isDeviceRequest checks whether the request carries the token of a device instead of a session
+func isDeviceRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), bearerPrefix)
+}
+
+// markDeviceSeen keeps the time and address of the latest request of device
+func markDeviceSeen(user *db.User, device *db.Device, r *http.Request) {
+	device.LastSeenDate = time.Now()
+	device.LastSeenAddress = getRequestAddress(r)
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, deviceService, user.Email, err.Error())
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}, {"devices.id", device.ID}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"devices.$.lastseendate", device.LastSeenDate},
+			{"devices.$.lastseenaddress", device.LastSeenAddress},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, deviceService, user.Email, err.Error())
+	}
+}
+
+// findUserDevice returns the device of user with the id or nil if the user does not have such device
+func findUserDevice(user *db.User, deviceID string) *db.Device {
+	for i := range user.Devices {
+		if user.Devices[i].ID == deviceID {
+			return &user.Devices[i]
+		}
+	}
+	return nil
+}
+
+// getRequestAddress returns the IP address the request came from
+func getRequestAddress(r *http.Request) string {
+	address, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return address
+}
+
+func generateDeviceToken() (string, error) {
+	token := make([]byte, deviceTokenLength)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+func hashDeviceToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func toUserBrightnessSchedule(schedule []db.BrightnessPeriod) []userBrightnessPeriod {
+	periods := []userBrightnessPeriod{}
+	for _, period := range schedule {
+		periods = append(periods, userBrightnessPeriod{Start: period.Start, Brightness: period.Brightness})
+	}
+	return periods
+}
+
+func toUserDevice(device db.Device) userDevice {
+	userDevice := userDevice{
+		ID:                  device.ID,
+		Name:                device.Name,
+		Model:               device.Model,
+		Width:               device.Width,
+		Height:              device.Height,
+		Orientation:         device.Orientation,
+		Timezone:            device.Timezone,
+		SlideshowID:         device.SlideshowID,
+		AlbumID:             device.AlbumID,
+		ProfileID:           device.ProfileID,
+		SlideDuration:       device.SlideDuration,
+		BrightnessSchedule:  toUserBrightnessSchedule(device.BrightnessSchedule),
+		LastSeenDate:        device.LastSeenDate,
+		LastSeenAddress:     device.LastSeenAddress,
+		OfflineAlertMinutes: device.OfflineAlertMinutes,
+		Online:              isDeviceOnline(device, time.Now()),
+		CreationDate:        device.CreationDate,
+	}
+	if len(device.Heartbeats) > 0 {
+		lastHeartbeat := toUserHeartbeat(device.Heartbeats[len(device.Heartbeats)-1])
+		userDevice.LastHeartbeat = &lastHeartbeat
+	}
+	return userDevice
+}
@@ -0,0 +1,485 @@
+package api
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/matba/slyde-server/internals/cacher"
+	"github.com/matba/slyde-server/internals/db"
+	"github.com/matba/slyde-server/internals/jobs"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const exportService = "EXPORT"
+const exportJobType = "EXPORT_LIBRARY"
+const exportPayloadKey = "export"
+const albumPayloadKey = "album"
+const exportJobCacheKey = "EXPORT_JOB_"
+const exportDownloadCacheKey = "EXPORT_DOWNLOAD_"
+
+const exportStatusPending = "pending"
+const exportStatusReady = "ready"
+const exportStatusFailed = "failed"
+
+var unsafeFileNameCharacters = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// exportJob keeps the state of a background export in cache
+type exportJob struct {
+	ID           string    `json:"id"`
+	Email        string    `json:"email"`
+	AlbumID      string    `json:"album,omitempty"`
+	Status       string    `json:"status"`
+	Token        string    `json:"token,omitempty"`
+	CreationDate time.Time `json:"creationDate"`
+}
+
+// HandleExport handles API calls for exporting the library of user
+func HandleExport(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		handleExportGet(w, r)
+	case "POST":
+		handleExportPost(w, r)
+	default:
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+}
+
+// HandleExportJob handles API calls for getting the status of background exports
+func HandleExportJob(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	if r.Method != "GET" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+
+	job, err := getExportJob(r.FormValue("id"))
+	if err != nil && err != cacher.NotFound {
+		log.Printf(errLogTemplate, errLogCacheFailure, exportService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+	if err == cacher.NotFound || job.Email != email {
+		log.Printf(errLogTemplate, errLogNotFound, exportService, email, r.FormValue("id"))
+		WriteErrorOnResponse(errExportNotFound, &w, http.StatusNotFound)
+		return
+	}
+
+	js, _ := json.Marshal(toExportJobStatus(job))
+	w.Write(js)
+}
+
+// HandleExportDownload serves the archive of a finished background export, the token of link is the authorization
+func HandleExportDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	token := r.FormValue("token")
+	jobID, err := cacher.GetCache().GetKeyValue(exportDownloadCacheKey + token)
+	if err != nil && err != cacher.NotFound {
+		log.Printf(errLogTemplate, errLogCacheFailure, exportService, token, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+	if err == cacher.NotFound || len(token) == 0 {
+		log.Printf(errLogTemplate, errLogNotFound, exportService, token, "Download link expired.")
+		WriteErrorOnResponse(errExportNotFound, &w, http.StatusNotFound)
+		return
+	}
+
+	fp := getExportPath(jobID)
+	if _, err := os.Stat(fp); os.IsNotExist(err) {
+		log.Printf(errLogTemplate, errLogNotFound, exportService, token, err.Error())
+		WriteErrorOnResponse(errExportNotFound, &w, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="`+exportArchiveName+`"`)
+	http.ServeFile(w, r, fp)
+}
+
+// handleExportGet streams the export archive in the response, it is only allowed for small libraries
+func handleExportGet(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Incoming call for exporting images")
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, exportService)
+	if err != nil {
+		return
+	}
+
+	images, album, found := getExportImages(user, r.FormValue("album"))
+	if !found {
+		log.Printf(errLogTemplate, errLogNotFound, exportService, email, r.FormValue("album"))
+		WriteErrorOnResponse(errAlbumNotFound, &w, http.StatusNotFound)
+		return
+	}
+
+	if len(images) > maxSyncExportImages {
+		log.Printf(errLogTemplate, errLogValidation, exportService, email, "Too many images for a direct export.")
+		WriteErrorOnResponse(errExportTooBig, &w, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+exportArchiveName+`"`)
+	err = writeExportArchive(w, user, images, album)
+	if err != nil {
+		// the headers are already sent so the broken archive is the only signal the client gets
+		log.Printf(errLogTemplate, errLogIoError, exportService, email, err.Error())
+	}
+}
+
+// handleExportPost starts a background export and returns the job that can be polled
+func handleExportPost(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	log.Printf("Incoming call for starting an export")
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, exportService)
+	if err != nil {
+		return
+	}
+
+	if len(r.FormValue("album")) > 0 && findUserAlbum(user, r.FormValue("album")) == nil {
+		log.Printf(errLogTemplate, errLogNotFound, exportService, email, r.FormValue("album"))
+		WriteErrorOnResponse(errAlbumNotFound, &w, http.StatusNotFound)
+		return
+	}
+
+	id, _ := uuid.NewUUID()
+	job := exportJob{
+		ID:           id.String(),
+		Email:        email,
+		AlbumID:      r.FormValue("album"),
+		Status:       exportStatusPending,
+		CreationDate: time.Now(),
+	}
+	// the export is saved before it is queued, otherwise a worker could take it for expired
+	err = saveExportJob(job)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCacheFailure, exportService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+	queueJob, err := jobs.GetQueue().Enqueue(exportJobType, user.ID, map[string]string{
+		exportPayloadKey: job.ID,
+		albumPayloadKey:  job.AlbumID,
+	})
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotInsertToDb, exportService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	status := toExportJobStatus(job)
+	status.JobID = queueJob.ID
+	w.WriteHeader(http.StatusAccepted)
+	js, _ := json.Marshal(status)
+	w.Write(js)
+}
+
+// registerExportJobs registers the handlers of export jobs in the job queue
+func registerExportJobs() {
+	jobs.GetQueue().RegisterHandler(exportJobType, exportLibraryJob)
+}
+
+// exportLibraryJob writes the archive of a background export and publishes an expiring download link for it,
+// the export is marked failed when the job runs out of attempts
+func exportLibraryJob(queueJob *db.Job) error {
+	job, err := getExportJob(queueJob.Payload[exportPayloadKey])
+	// the export expired before it was written, nobody can download it anymore
+	if err == cacher.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = runExportJob(job, queueJob)
+	if err != nil && queueJob.Attempts >= queueJob.MaxAttempts {
+		job.Status = exportStatusFailed
+		saveExportJob(job)
+	}
+	return err
+}
+
+// runExportJob writes the archive of the images of user the queued job belongs to
+func runExportJob(job exportJob, queueJob *db.Job) error {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		return err
+	}
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+
+	var user db.User
+	err = collection.FindOne(context.TODO(), bson.D{{"id", queueJob.UserID}}).Decode(&user)
+	if err != nil {
+		return err
+	}
+	images, album, found := getExportImages(&user, queueJob.Payload[albumPayloadKey])
+	// the album is deleted after the export was requested
+	if !found {
+		return errors.New("The album of export not found.")
+	}
+
+	err = createExportArchive(job.ID, &user, images, album)
+	if err != nil {
+		return err
+	}
+
+	token, _ := uuid.NewRandom()
+	err = cacher.GetCache().AddKeyValue(exportDownloadCacheKey+token.String(), job.ID, exportRetention)
+	if err != nil {
+		return err
+	}
+
+	job.Status = exportStatusReady
+	job.Token = token.String()
+	err = saveExportJob(job)
+	if err != nil {
+		return err
+	}
+	log.Printf("Export %q for user %q is ready", job.ID, job.Email)
+	return nil
+}
+
+// createExportArchive writes the archive to a temporary file first so a half written archive is never served
+func createExportArchive(jobID string, user *db.User, images []db.ImageInfo, album *db.Album) error {
+	tmpFile, err := ioutil.TempFile(filesDirectory+exportsDirectory, jobID+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	err = writeExportArchive(tmpFile, user, images, album)
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), getExportPath(jobID))
+}
+
+// writeExportArchive streams the images and the manifest describing them as a zip archive into out
+func writeExportArchive(out io.Writer, user *db.User, images []db.ImageInfo, album *db.Album) error {
+	archive := zip.NewWriter(out)
+	manifest := exportManifest{
+		ExportDate: time.Now(),
+		Albums:     []exportManifestAlbum{},
+		Images:     []exportManifestImage{},
+	}
+	if album != nil {
+		manifest.Album = album.Name
+	}
+	for _, userAlbum := range user.Albums {
+		manifest.Albums = append(manifest.Albums, exportManifestAlbum{ID: userAlbum.ID, Name: userAlbum.Name})
+	}
+	imageAlbums := getImageAlbums(user)
+
+	for _, img := range images {
+		sourcePath := getExportSourcePath(user.ID, img)
+		fileName := getExportFileName(img, path.Ext(sourcePath))
+		err := addFileToArchive(archive, fileName, sourcePath, img.UploadDate)
+		if err != nil {
+			return err
+		}
+		manifest.Images = append(manifest.Images, toExportManifestImage(img, fileName, imageAlbums[img.ID]))
+	}
+
+	manifestWriter, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     manifestFileName,
+		Method:   zip.Deflate,
+		Modified: manifest.ExportDate,
+	})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(manifestWriter)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(manifest)
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+func addFileToArchive(archive *zip.Writer, name string, filePath string, modified time.Time) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// the images are already compressed so they are only stored
+	writer, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, file)
+	return err
+}
+
+// getExportImages returns the images that should be exported, all images of user or the images of the album
+func getExportImages(user *db.User, albumID string) ([]db.ImageInfo, *db.Album, bool) {
+	if len(albumID) == 0 {
+		return getActiveImages(user), nil, true
+	}
+	album := findUserAlbum(user, albumID)
+	if album == nil {
+		return nil, nil, false
+	}
+	return getAlbumImages(user, album), album, true
+}
+
+// getExportSourcePath returns the path of the best version of image that is kept on disk, the original
+// as it was uploaded if it is kept
+func getExportSourcePath(userID string, img db.ImageInfo) string {
+	if len(img.OriginalFile) > 0 {
+		originalPath := getUserOriginalImagePath(userID, img.OriginalFile)
+		if _, err := os.Stat(originalPath); err == nil {
+			return originalPath
+		}
+	}
+	return getUserImagePath(userID, img.ID, false)
+}
+
+// getExportFileName creates a unique and file system friendly name for the image inside the archive
+func getExportFileName(img db.ImageInfo, extension string) string {
+	name := unsafeFileNameCharacters.ReplaceAllString(img.Name, "_")
+	if len(name) == 0 {
+		name = "image"
+	}
+	return name + "-" + img.ID + extension
+}
+
+func getExportPath(jobID string) string {
+	return path.Join(filesDirectory+exportsDirectory, jobID+zipExtension)
+}
+
+func getExportJob(jobID string) (exportJob, error) {
+	var job exportJob
+	if len(jobID) == 0 {
+		return job, cacher.NotFound
+	}
+	value, err := cacher.GetCache().GetKeyValue(exportJobCacheKey + jobID)
+	if err != nil {
+		return job, err
+	}
+	err = json.Unmarshal([]byte(value), &job)
+	if err != nil {
+		return job, errors.New("Corrupted export job: " + err.Error())
+	}
+	return job, nil
+}
+
+func saveExportJob(job exportJob) error {
+	js, _ := json.Marshal(job)
+	return cacher.GetCache().AddKeyValue(exportJobCacheKey+job.ID, string(js), exportRetention)
+}
+
+func toExportJobStatus(job exportJob) exportJobStatus {
+	status := exportJobStatus{
+		ID:           job.ID,
+		Status:       job.Status,
+		CreationDate: job.CreationDate,
+	}
+	if job.Status == exportStatusReady {
+		status.DownloadURL = exportDownloadPath + "?token=" + job.Token
+	}
+	return status
+}
+
+// toExportManifestImage describes the image and the albums it is in in the manifest
+func toExportManifestImage(img db.ImageInfo, fileName string, albums map[string]bool) exportManifestImage {
+	manifestImage := exportManifestImage{
+		File:               fileName,
+		ID:                 img.ID,
+		Name:               img.Name,
+		OriginalFile:       img.OriginalFile,
+		Width:              img.Width,
+		Height:             img.Height,
+		Size:               img.Size,
+		Status:             img.Status,
+		Hash:               img.Hash,
+		ThumbnailHash:      img.ThumbnailHash,
+		Edits:              toImageEditOperations(img.Edits),
+		EditVersion:        img.EditVersion,
+		AppliedEditVersion: img.AppliedEditVersion,
+		UploadDate:         img.UploadDate,
+		Caption:            img.Caption,
+		Tags:               img.Tags,
+		Favorite:           img.Favorite,
+		Rating:             img.Rating,
+		NeverShow:          img.NeverShow,
+		BlurHash:           img.BlurHash,
+		AverageColor:       img.AverageColor,
+		Palette:            img.Palette,
+		Albums:             []string{},
+	}
+	if manifestImage.Tags == nil {
+		manifestImage.Tags = []string{}
+	}
+	if manifestImage.Palette == nil {
+		manifestImage.Palette = []string{}
+	}
+	// zero dates are left out instead of exported as year one
+	if !img.CaptureDate.IsZero() {
+		manifestImage.CaptureDate = &img.CaptureDate
+	}
+	if !img.DeletionDate.IsZero() {
+		manifestImage.DeletionDate = &img.DeletionDate
+	}
+	for albumID := range albums {
+		manifestImage.Albums = append(manifestImage.Albums, albumID)
+	}
+	sort.Strings(manifestImage.Albums)
+	return manifestImage
+}
+
+// cleanupExpiredExports periodically removes the archives whose download links have expired
+func cleanupExpiredExports() {
+	for {
+		files, err := ioutil.ReadDir(filesDirectory + exportsDirectory)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogIoError, exportService, "", err.Error())
+		}
+		for _, file := range files {
+			if time.Since(file.ModTime()) > time.Duration(exportRetention)*time.Second {
+				os.Remove(path.Join(filesDirectory+exportsDirectory, file.Name()))
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
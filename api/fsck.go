@@ -0,0 +1,345 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/matba/slyde-server/internals/db"
+	"github.com/matba/slyde-server/internals/jobs"
+	"github.com/matba/slyde-server/internals/variants"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const fsckService = "FSCK"
+
+// the files changed recently may belong to uploads or renderings in progress, so they are not checked
+const fsckGracePeriod = time.Hour
+
+// the types of inconsistencies between the records of images and the files on disk
+const fsckOrphanedFile = "orphanedFile"
+const fsckOrphanedUser = "orphanedUser"
+const fsckMissingFiles = "missingFiles"
+const fsckMissingOriginal = "missingOriginal"
+const fsckMissingImage = "missingImage"
+const fsckMissingThumbnail = "missingThumbnail"
+const fsckStaleVariant = "staleVariant"
+
+// the actions that repair the inconsistencies
+const fsckActionRemove = "remove"
+const fsckActionRegenerate = "regenerate"
+const fsckActionPurge = "purge"
+const fsckActionNone = "none"
+
+// fsckChecker collects the inconsistencies found and repairs them if it is asked to
+type fsckChecker struct {
+	collection *mongo.Collection
+	repair     bool
+	report     fsckReport
+	// the users whose files were changed by the repairs and whose usage should be recomputed
+	changedUsers map[string]bool
+}
+
+// HandleAdminFsck checks the records of images of the user with the id or of all users against the files on
+// disk, GET only reports the inconsistencies and POST repairs them as well
+func HandleAdminFsck(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	if r.Method != "GET" && r.Method != "POST" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	email := GetAdmin(w, r)
+	if email == "" {
+		return
+	}
+
+	report, err := checkConsistency(r.FormValue("id"), r.Method == "POST")
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, fsckService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(report)
+	w.Write(js)
+}
+
+// RunConsistencyCheck checks the records of images of the user with the id or of all users against the files
+// on disk and writes the report to out, the inconsistencies are repaired if repair is set
+func RunConsistencyCheck(userID string, repair bool, out io.Writer) error {
+	report, err := checkConsistency(userID, repair)
+	if err != nil {
+		return err
+	}
+	js, _ := json.MarshalIndent(report, "", "  ")
+	_, err = out.Write(append(js, '\n'))
+	return err
+}
+
+func checkConsistency(userID string, repair bool) (*fsckReport, error) {
+	// the users directory is read first, so a files directory that is not mounted is not taken for files
+	// that are missing and the records are not purged
+	userDirs, err := ioutil.ReadDir(filesDirectory + userDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		return nil, err
+	}
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+
+	checker := &fsckChecker{
+		collection:   collection,
+		repair:       repair,
+		report:       fsckReport{Repair: repair, Issues: []fsckIssue{}},
+		changedUsers: make(map[string]bool),
+	}
+
+	filter := bson.D{}
+	if len(userID) > 0 {
+		filter = bson.D{{"id", userID}}
+	}
+	cursor, err := collection.Find(context.TODO(), filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	checkedUsers := make(map[string]bool)
+	for cursor.Next(context.TODO()) {
+		var user db.User
+		err = cursor.Decode(&user)
+		if err != nil {
+			return nil, err
+		}
+		checkedUsers[user.ID] = true
+		checker.checkUser(&user)
+	}
+	if cursor.Err() != nil {
+		return nil, cursor.Err()
+	}
+
+	// the directories of users that do not exist anymore
+	for _, userDir := range userDirs {
+		if !userDir.IsDir() || checkedUsers[userDir.Name()] || (len(userID) > 0 && userDir.Name() != userID) {
+			continue
+		}
+		dirPath := getCurUserDirectory(userDir.Name())
+		checker.add(fsckIssue{Type: fsckOrphanedUser, UserID: userDir.Name(), Path: dirPath, Action: fsckActionRemove},
+			func() error {
+				return os.RemoveAll(dirPath)
+			})
+	}
+
+	// the repairs change the stored files, so the usage of users is recomputed from the disk
+	for changedUserID := range checker.changedUsers {
+		_, err = jobs.GetQueue().Enqueue(recomputeUsageJobType, changedUserID, map[string]string{})
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotInsertToDb, fsckService, changedUserID, err.Error())
+		}
+	}
+
+	log.Printf("Consistency check found %d issues in %d images of %d users",
+		len(checker.report.Issues), checker.report.CheckedImages, checker.report.CheckedUsers)
+	return &checker.report, nil
+}
+
+// checkUser checks that the files of the images of user exist and that every file in the directory of user
+// belongs to an image
+func (c *fsckChecker) checkUser(user *db.User) {
+	c.report.CheckedUsers++
+	expectedFiles := make(map[string]bool)
+	images := make(map[string]db.ImageInfo)
+	for _, img := range user.Images {
+		c.report.CheckedImages++
+		images[img.ID] = img
+		imagePath := getUserImagePath(user.ID, img.ID, false)
+		thumbnailPath := getUserImagePath(user.ID, img.ID, true)
+		originalPath := ""
+		expectedFiles[imagePath] = true
+		expectedFiles[thumbnailPath] = true
+		if len(img.OriginalFile) > 0 {
+			originalPath = getUserOriginalImagePath(user.ID, img.OriginalFile)
+			expectedFiles[originalPath] = true
+		}
+		// the derivatives of the images being processed are not generated yet
+		if img.Status == db.ImageStatusProcessing {
+			continue
+		}
+
+		hasImage := fileExists(imagePath)
+		hasThumbnail := fileExists(thumbnailPath)
+		hasOriginal := len(originalPath) > 0 && fileExists(originalPath)
+		if !hasImage && !hasThumbnail && !hasOriginal {
+			c.add(fsckIssue{Type: fsckMissingFiles, UserID: user.ID, ImageID: img.ID, Action: fsckActionPurge},
+				func() error {
+					_, err := purgeImages(c.collection, user, []db.ImageInfo{img}, time.Time{})
+					return err
+				})
+			continue
+		}
+		if len(originalPath) > 0 && !hasOriginal {
+			c.add(fsckIssue{Type: fsckMissingOriginal, UserID: user.ID, ImageID: img.ID, Path: originalPath,
+				Action: fsckActionNone}, nil)
+		}
+		// the derivatives of the images that failed processing were never generated
+		if img.Status == db.ImageStatusFailed {
+			continue
+		}
+
+		// both derivatives are generated again from the original by a single processing of image
+		queued := false
+		var queueErr error
+		regenerate := func() error {
+			if !queued {
+				queued = true
+				_, queueErr = jobs.GetQueue().Enqueue(processImageJobType, user.ID, map[string]string{
+					imagePayloadKey:    img.ID,
+					originalPayloadKey: img.OriginalFile,
+				})
+			}
+			return queueErr
+		}
+
+		if !hasImage {
+			if hasOriginal {
+				c.add(fsckIssue{Type: fsckMissingImage, UserID: user.ID, ImageID: img.ID, Path: imagePath,
+					Action: fsckActionRegenerate}, regenerate)
+			} else {
+				c.add(fsckIssue{Type: fsckMissingImage, UserID: user.ID, ImageID: img.ID, Path: imagePath,
+					Action: fsckActionNone}, nil)
+			}
+		}
+		if !hasThumbnail {
+			issue := fsckIssue{Type: fsckMissingThumbnail, UserID: user.ID, ImageID: img.ID, Path: thumbnailPath,
+				Action: fsckActionRegenerate}
+			if hasOriginal {
+				c.add(issue, regenerate)
+			} else if hasImage {
+				// the images uploaded before the originals were kept get their thumbnail from the image
+				c.add(issue, func() error {
+					return regenerateThumbnail(c.collection, user.ID, img.ID)
+				})
+			} else {
+				issue.Action = fsckActionNone
+				c.add(issue, nil)
+			}
+		}
+	}
+
+	userDir := getCurUserDirectory(user.ID)
+	c.checkFiles(user.ID, userDir+thumbnailsDirectory, expectedFiles, nil)
+	c.checkFiles(user.ID, userDir+originalsDirectory, expectedFiles, nil)
+	c.checkFiles(user.ID, userDir+imagesDiretory, expectedFiles, images)
+}
+
+// checkFiles finds the files in the directory that no image refers to, the variants are checked against
+// the images if they are given
+func (c *fsckChecker) checkFiles(userID string, dir string, expectedFiles map[string]bool, images map[string]db.ImageInfo) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		// the directories of user are created on the first upload
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		c.report.CheckedFiles++
+		filePath := path.Join(dir, file.Name())
+		if expectedFiles[filePath] || time.Since(file.ModTime()) < fsckGracePeriod {
+			continue
+		}
+		if images != nil {
+			if match := variantFileRegex.FindStringSubmatch(file.Name()); match != nil {
+				c.checkVariant(userID, filePath, file, match[1], images)
+				continue
+			}
+		}
+		c.add(fsckIssue{Type: fsckOrphanedFile, UserID: userID, Path: filePath, Action: fsckActionRemove},
+			func() error {
+				return os.Remove(filePath)
+			})
+	}
+}
+
+// checkVariant finds the variants of images that do not exist anymore and the variants rendered before the
+// image was generated again
+func (c *fsckChecker) checkVariant(userID string, filePath string, file os.FileInfo, imageID string, images map[string]db.ImageInfo) {
+	img, ok := images[imageID]
+	if !ok {
+		// the composites are named after both of their images and are left to the variant cache
+		if isCompositeID(imageID) {
+			return
+		}
+	} else {
+		info, err := os.Stat(getUserImagePath(userID, img.ID, false))
+		if err != nil || !info.ModTime().After(file.ModTime()) {
+			return
+		}
+	}
+	c.add(fsckIssue{Type: fsckStaleVariant, UserID: userID, ImageID: imageID, Path: filePath, Action: fsckActionRemove},
+		func() error {
+			// the variant cache deletes the variant only if it tracks it
+			variants.GetVariantCache().Remove(filePath)
+			err := os.Remove(filePath)
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		})
+}
+
+// add records the issue and repairs it right away if the check is asked to repair
+func (c *fsckChecker) add(issue fsckIssue, repair func() error) {
+	if c.repair && repair != nil && issue.Action != fsckActionNone {
+		err := repair()
+		if err != nil {
+			log.Printf(errLogTemplate, errLogIoError, fsckService, issue.UserID, err.Error())
+			issue.Error = err.Error()
+		} else {
+			issue.Repaired = true
+			if issue.Type != fsckOrphanedUser {
+				c.changedUsers[issue.UserID] = true
+			}
+		}
+	}
+	c.report.Issues = append(c.report.Issues, issue)
+}
+
+// regenerateThumbnail generates the thumbnail of image from the resized image, for the images without original
+func regenerateThumbnail(collection *mongo.Collection, userID string, imageID string) error {
+	source, err := imaging.Open(getUserImagePath(userID, imageID, false))
+	if err != nil {
+		return err
+	}
+	_, _, thumbnailHash, err := saveImage(source, userID, imageID, true)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.D{{"id", userID}, {"images.id", imageID}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"images.$.thumbnailhash", thumbnailHash},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	return err
+}
+
+func fileExists(filePath string) bool {
+	_, err := os.Stat(filePath)
+	return err == nil
+}
@@ -0,0 +1,342 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/matba/slyde-server/internals/config"
+	"github.com/matba/slyde-server/internals/db"
+	"github.com/matba/slyde-server/internals/email"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const heartbeatService = "HEARTBEAT"
+
+// a day of heartbeats sent every five minutes is kept for each frame
+const maxDeviceHeartbeats = 288
+const maxErrorCounters = 20
+const maxErrorCounterName = 64
+const minWifiSignal = -120
+const deviceOfflineCheckInterval = 5 * time.Minute
+const alertDateLayout = "2 January 2006 15:04 MST"
+
+// matches the devices that are not alerted, including the ones registered before heartbeats were kept
+var notAlerted = bson.D{{"$in", bson.A{time.Time{}, nil}}}
+
+// HandleDeviceHeartbeat keeps the health reported by the device whose token is in the Authorization header
+// and responds with the configuration of device, so frames get the changes of their settings with heartbeats
+func HandleDeviceHeartbeat(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	if r.Method != "POST" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	user, device := getDeviceFromToken(w, r)
+	if device == nil {
+		return
+	}
+
+	var request heartbeatRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, heartbeatService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+	err = validateHeartbeat(request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogValidation, heartbeatService, user.Email, err.Error())
+		WriteErrorOnResponse(errInvalidHeartbeat, &w, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	heartbeat := db.Heartbeat{
+		Date:           now,
+		Uptime:         request.Uptime,
+		Firmware:       request.Firmware,
+		FreeStorage:    request.FreeStorage,
+		CurrentImageID: request.CurrentImageID,
+		ErrorCounters:  request.ErrorCounters,
+		WifiSignal:     request.WifiSignal,
+	}
+	if heartbeat.ErrorCounters == nil {
+		heartbeat.ErrorCounters = map[string]int{}
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, heartbeatService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+
+	if !device.OfflineAlertDate.IsZero() {
+		notifyDeviceOnline(collection, user, device, now)
+	}
+
+	filter := bson.D{{"id", user.ID}, {"devices.id", device.ID}}
+	update := bson.D{
+		{"$push", bson.D{
+			{"devices.$.heartbeats", bson.D{
+				{"$each", []db.Heartbeat{heartbeat}},
+				{"$slice", -maxDeviceHeartbeats},
+			}},
+		}},
+		{"$set", bson.D{
+			{"devices.$.lastheartbeatdate", now},
+			{"devices.$.lastseendate", now},
+			{"devices.$.lastseenaddress", getRequestAddress(r)},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, heartbeatService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(getDeviceConfig(user, device, now))
+	w.Write(js)
+}
+
+func validateHeartbeat(request heartbeatRequest) error {
+	if request.Uptime < 0 || request.FreeStorage < 0 {
+		return errors.New("Negative uptime or free storage")
+	}
+	if len(request.Firmware) > maxDeviceName || len(request.CurrentImageID) > maxDeviceName {
+		return errors.New("Too long firmware or current image")
+	}
+	if request.WifiSignal < minWifiSignal || request.WifiSignal > 0 {
+		return fmt.Errorf("Invalid Wi-Fi signal %d", request.WifiSignal)
+	}
+	if len(request.ErrorCounters) > maxErrorCounters {
+		return errors.New("Too many error counters")
+	}
+	for name, count := range request.ErrorCounters {
+		if len(name) == 0 || len(name) > maxErrorCounterName || count < 0 {
+			return errors.New("Invalid error counter " + name)
+		}
+	}
+	return nil
+}
+
+// HandleDeviceStatus returns whether the device with the id is online and the heartbeats it has sent recently
+func HandleDeviceStatus(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	if r.Method != "GET" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, heartbeatService)
+	if err != nil {
+		return
+	}
+
+	device := findUserDevice(user, r.FormValue("id"))
+	if device == nil {
+		log.Printf(errLogTemplate, errLogNotFound, heartbeatService, email, r.FormValue("id"))
+		WriteErrorOnResponse(errDeviceNotFound, &w, http.StatusNotFound)
+		return
+	}
+
+	status := deviceStatus{
+		ID:         device.ID,
+		Online:     isDeviceOnline(*device, time.Now()),
+		Heartbeats: []userHeartbeat{},
+	}
+	if !device.OfflineAlertDate.IsZero() {
+		status.OfflineAlertDate = &device.OfflineAlertDate
+	}
+	// the most recent heartbeat is sent first
+	for i := len(device.Heartbeats) - 1; i >= 0; i-- {
+		status.Heartbeats = append(status.Heartbeats, toUserHeartbeat(device.Heartbeats[i]))
+	}
+	js, _ := json.Marshal(status)
+	w.Write(js)
+}
+
+// watchOfflineDevices periodically alerts the owners of the frames that stopped sending heartbeats
+func watchOfflineDevices() {
+	for {
+		time.Sleep(deviceOfflineCheckInterval)
+		err := alertOfflineDevices(time.Now())
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, heartbeatService, "", err.Error())
+		}
+	}
+}
+
+// alertOfflineDevices emails the owners of the frames that have not sent a heartbeat for their offline period,
+// the owner is alerted once until the frame sends a heartbeat again. The frames that never sent a heartbeat
+// are not watched.
+func alertOfflineDevices(now time.Time) error {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		return err
+	}
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+
+	filter := bson.D{
+		{"devices", bson.D{
+			{"$elemMatch", bson.D{
+				{"lastheartbeatdate", bson.D{{"$gt", time.Time{}}}},
+				{"offlinealertdate", notAlerted},
+			}},
+		}},
+	}
+	projection := bson.D{{"id", 1}, {"email", 1}, {"timezone", 1}, {"devices", 1}}
+	cursor, err := collection.Find(context.TODO(), filter, options.Find().SetProjection(projection))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.TODO())
+
+	for cursor.Next(context.TODO()) {
+		var user db.User
+		err = cursor.Decode(&user)
+		if err != nil {
+			return err
+		}
+		for i := range user.Devices {
+			device := &user.Devices[i]
+			if device.LastHeartbeatDate.IsZero() || !device.OfflineAlertDate.IsZero() || isDeviceOnline(*device, now) {
+				continue
+			}
+			alertOfflineDevice(collection, &user, device, now)
+		}
+	}
+	return cursor.Err()
+}
+
+// alertOfflineDevice marks the device as alerted and emails its owner, the device is only marked if it has not
+// sent a heartbeat meanwhile and no other server has alerted for it, so the owner gets a single email
+func alertOfflineDevice(collection *mongo.Collection, user *db.User, device *db.Device, now time.Time) {
+	filter := bson.D{
+		{"id", user.ID},
+		{"devices", bson.D{
+			{"$elemMatch", bson.D{
+				{"id", device.ID},
+				{"lastheartbeatdate", device.LastHeartbeatDate},
+				{"offlinealertdate", notAlerted},
+			}},
+		}},
+	}
+	update := bson.D{
+		{"$set", bson.D{
+			{"devices.$.offlinealertdate", now},
+		}},
+	}
+	result, err := collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, heartbeatService, user.Email, err.Error())
+		return
+	}
+	if result.ModifiedCount == 0 {
+		return
+	}
+
+	err = email.GetEmailSender().SendEmail(user.Email, deviceOfflineSubject,
+		fmt.Sprintf(deviceOfflineBody, device.Name, formatAlertDate(user, device, device.LastHeartbeatDate)))
+	if err == nil {
+		return
+	}
+	log.Printf(errLogTemplate, errLogEmailFailure, heartbeatService, user.Email, err.Error())
+	// the alert is sent again on the next check
+	filter = bson.D{{"id", user.ID}, {"devices.id", device.ID}}
+	update = bson.D{
+		{"$set", bson.D{
+			{"devices.$.offlinealertdate", time.Time{}},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, heartbeatService, user.Email, err.Error())
+	}
+}
+
+// notifyDeviceOnline clears the offline alert of device and emails its owner that it is back, only the
+// heartbeat that clears the alert sends the email
+func notifyDeviceOnline(collection *mongo.Collection, user *db.User, device *db.Device, now time.Time) {
+	filter := bson.D{
+		{"id", user.ID},
+		{"devices", bson.D{
+			{"$elemMatch", bson.D{
+				{"id", device.ID},
+				{"offlinealertdate", bson.D{{"$gt", time.Time{}}}},
+			}},
+		}},
+	}
+	update := bson.D{
+		{"$set", bson.D{
+			{"devices.$.offlinealertdate", time.Time{}},
+		}},
+	}
+	result, err := collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, heartbeatService, user.Email, err.Error())
+		return
+	}
+	if result.ModifiedCount == 0 {
+		return
+	}
+	device.OfflineAlertDate = time.Time{}
+
+	err = email.GetEmailSender().SendEmail(user.Email, deviceOnlineSubject,
+		fmt.Sprintf(deviceOnlineBody, device.Name, formatAlertDate(user, device, now)))
+	if err != nil {
+		log.Printf(errLogTemplate, errLogEmailFailure, heartbeatService, user.Email, err.Error())
+	}
+}
+
+// isDeviceOnline checks whether the latest heartbeat of device is more recent than its offline period
+func isDeviceOnline(device db.Device, now time.Time) bool {
+	return !device.LastHeartbeatDate.IsZero() && now.Sub(device.LastHeartbeatDate) < getDeviceOfflinePeriod(device)
+}
+
+func getDeviceOfflinePeriod(device db.Device) time.Duration {
+	minutes := device.OfflineAlertMinutes
+	if minutes == 0 {
+		minutes = config.GetServerConfig().DeviceOfflineMinutes
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// formatAlertDate formats the date in the timezone of device for the emails of its owner
+func formatAlertDate(user *db.User, device *db.Device, date time.Time) string {
+	location, err := getUserLocation(user, device.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	return date.In(location).Format(alertDateLayout)
+}
+
+func toUserHeartbeat(heartbeat db.Heartbeat) userHeartbeat {
+	errorCounters := heartbeat.ErrorCounters
+	if errorCounters == nil {
+		errorCounters = map[string]int{}
+	}
+	return userHeartbeat{
+		Date:           heartbeat.Date,
+		Uptime:         heartbeat.Uptime,
+		Firmware:       heartbeat.Firmware,
+		FreeStorage:    heartbeat.FreeStorage,
+		CurrentImageID: heartbeat.CurrentImageID,
+		ErrorCounters:  errorCounters,
+		WifiSignal:     heartbeat.WifiSignal,
+	}
+}
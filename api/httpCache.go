@@ -0,0 +1,121 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/matba/slyde-server/internals/db"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const immutableCacheControl = "private, max-age=31536000, immutable"
+const revalidateCacheControl = "private, no-cache"
+
+// getImageVersion returns the content hash of the stored image or its thumbnail. The hash is computed at
+// save time, images saved before hashes were introduced get it computed from the file once and saved.
+func getImageVersion(userID string, img db.ImageInfo, isThumbnail bool) string {
+	version := img.Hash
+	if isThumbnail {
+		version = img.ThumbnailHash
+	}
+	if len(version) > 0 {
+		return version
+	}
+
+	version, err := computeFileHash(getUserImagePath(userID, img.ID, isThumbnail))
+	if err != nil {
+		log.Printf(errLogTemplate, errLogIoError, imageGetService, userID, err.Error())
+		return ""
+	}
+	saveImageVersion(userID, img.ID, version, isThumbnail)
+	return version
+}
+
+// saveImageVersion stores the hash computed for an image saved before hashes were introduced. It is only set
+// while the image still has no hash, so a hash saved by generating the derivatives again is not overwritten.
+func saveImageVersion(userID string, imageID string, version string, isThumbnail bool) {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, imageGetService, userID, err.Error())
+		return
+	}
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+
+	field := "hash"
+	if isThumbnail {
+		field = "thumbnailhash"
+	}
+	filter := bson.D{{"id", userID}, {"images", bson.D{{"$elemMatch", bson.D{
+		{"id", imageID},
+		{field, bson.D{{"$in", bson.A{"", nil}}}},
+	}}}}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"images.$." + field, version},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, imageGetService, userID, err.Error())
+	}
+}
+
+// getVariantETag derives the tag of a rendered variant from the version of its source and the variant key,
+// the rendering is deterministic so the same source and key always produce the same content
+func getVariantETag(sourceVersion string, variantKey string) string {
+	if len(sourceVersion) == 0 {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(sourceVersion + "/" + variantKey))
+	return hex.EncodeToString(hash[:])
+}
+
+// serveImageFile serves the file with validators, so conditional requests get 304. Versioned urls whose
+// version matches the current content can be cached forever by the client.
+func serveImageFile(w http.ResponseWriter, r *http.Request, filePath string, etag string, sourceVersion string) {
+	if len(etag) > 0 {
+		w.Header().Set("ETag", `"`+etag+`"`)
+	}
+	if len(sourceVersion) > 0 && r.FormValue("v") == sourceVersion {
+		w.Header().Set("Cache-Control", immutableCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", revalidateCacheControl)
+	}
+	// ServeFile checks If-None-Match against the ETag header and If-Modified-Since against the file
+	http.ServeFile(w, r, filePath)
+}
+
+// getImageURL returns the immutable url of the image or its thumbnail
+func getImageURL(imageID string, version string, isThumbnail bool) string {
+	query := url.Values{}
+	query.Set("id", imageID)
+	if isThumbnail {
+		query.Set("thumbnail", "1")
+	}
+	if len(version) > 0 {
+		query.Set("v", version)
+	}
+	return "/images?" + query.Encode()
+}
+
+func computeFileHash(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
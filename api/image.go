@@ -2,23 +2,25 @@ package api
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"image"
 	"image/jpeg"
+	"io"
 	"log"
 	"math"
 	"net/http"
 	"os"
 	"path"
 	"strconv"
-	"time"
 
-	"github.com/edwvee/exiffix"
-	"github.com/google/uuid"
 	"github.com/matba/slyde-server/internals/db"
+	"github.com/matba/slyde-server/internals/variants"
 	"github.com/nfnt/resize"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 const imageUploadService = "IMAGE_UPLOAD"
@@ -42,14 +44,39 @@ func HandleImage(w http.ResponseWriter, r *http.Request) {
 
 func handleImageGet(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Incoming call for getting images")
-	email := GetUser(w, r)
-	if email == "" {
-		return
+	var user *db.User
+	var email string
+	if isSignedRequest(r) {
+		// signed urls are fetched without a session by clients that can only show images
+		signedUser, err := getSignedRequestUser(w, r)
+		if err != nil {
+			return
+		}
+		user = signedUser
+		email = user.Email
+	} else if isDeviceRequest(r) {
+		// frames read the images of their owner with their token
+		deviceUser, device := getDeviceFromToken(w, r)
+		if device == nil {
+			return
+		}
+		user = deviceUser
+		email = user.Email
+	} else {
+		email = GetUser(w, r)
+		if email == "" {
+			return
+		}
+		sessionUser, err := GetUserByEmail(w, email, imageGetService)
+		if err != nil {
+			return
+		}
+		user = sessionUser
 	}
-	user, err := GetUserByEmail(w, email, imageGetService)
-	if err != nil {
-		log.Printf(errLogTemplate, errLogDb, imageGetService, email, err.Error())
-		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+
+	// the images of shared libraries are only reachable by the members of library
+	if len(r.FormValue("library")) > 0 && !isSignedRequest(r) && !isDeviceRequest(r) {
+		handleLibraryImageGet(w, r, user)
 		return
 	}
 
@@ -57,97 +84,129 @@ func handleImageGet(w http.ResponseWriter, r *http.Request) {
 		// this is a request for getting all user images
 		returnUserImages(user, &w, r)
 	} else {
-		isThumbnail := len(r.FormValue("thumbnail")) > 0
 		id := r.FormValue("id")
 
 		// go through the user images to see if such image exist
-		for _, img := range user.Images {
+		for _, img := range getActiveImages(user) {
 			if img.ID == id {
-				fp := getUserImagePath(user.ID, id, isThumbnail)
+				serveUserImage(w, r, user, img, email)
+				return
+			}
+		}
 
-				imgLength := img.Width
-				if img.Width < img.Height {
-					imgLength = img.Height
-				}
-				lengthStr := r.FormValue("width")
+		log.Printf(errLogTemplate, errNotFound, imageUploadService, email, "Image not found")
+		WriteErrorOnResponse(errNotFound, &w, http.StatusNotFound)
+	}
+}
+
+// serveUserImage serves the image, its thumbnail or a resized variant of it as requested
+func serveUserImage(w http.ResponseWriter, r *http.Request, user *db.User, img db.ImageInfo, email string) {
+	isThumbnail := len(r.FormValue("thumbnail")) > 0
+	if !img.IsReady() {
+		log.Printf(errLogTemplate, errLogNotFound, imageGetService, email, "Image is not processed.")
+		WriteErrorOnResponse(errImageNotReady, &w, http.StatusConflict)
+		return
+	}
+
+	if !isThumbnail && len(r.FormValue("profile")) > 0 {
+		serveProfileImage(w, r, user, img)
+		return
+	}
+	if !isThumbnail && isRenderRequest(r) {
+		serveRenderedImage(w, r, user, img)
+		return
+	}
 
-				if len(lengthStr) > 0 {
-					log.Printf("Width of %q is provided.", lengthStr)
+	fp := getUserImagePath(user.ID, img.ID, isThumbnail)
+	version := getImageVersion(user.ID, img, isThumbnail)
+
+	imgLength := img.Width
+	if img.Width < img.Height {
+		imgLength = img.Height
+	}
+	lengthStr := r.FormValue("width")
+
+	if len(lengthStr) > 0 {
+		log.Printf("Width of %q is provided.", lengthStr)
+	}
+
+	length, err := strconv.Atoi(lengthStr)
+
+	if err == nil && !isThumbnail {
+		lengthu := uint(length)
+		log.Printf("Checking if resize is required for image %q and requested width %q.", img.Name, lengthStr)
+		if float32(lengthu) < float32(imgLength)*0.9 {
+			log.Printf("The image %q needs to resized to match requested width %q.", img.Name, lengthStr)
+			resizeRatio := float32(lengthu) * 10 / float32(imgLength)
+
+			resizeRatioTenth := uint(math.Round(float64(resizeRatio)))
+
+			if resizeRatioTenth < 1 {
+				resizeRatioTenth = 1
+			}
+
+			fpr := getUserResizedImagePath(user.ID, img.ID, resizeRatioTenth)
+
+			if !variants.GetVariantCache().Lookup(fpr) {
+				newWidth := uint(float32(img.Width) * (float32(resizeRatioTenth) / 10.0))
+				newHeight := uint(float32(img.Height) * (float32(resizeRatioTenth) / 10.0))
+
+				log.Printf("Resizing image %q for serving", img.Name)
+
+				imgfile, _ := os.Open(fp)
+				defer imgfile.Close()
+
+				imgObj, _, err := image.Decode(imgfile)
+				if err != nil {
+					log.Printf(errLogTemplate, errLogImageValidationError, imageGetService, email, err.Error())
+					WriteErrorOnResponse(errUnsupportedImage, &w, http.StatusInternalServerError)
+					return
 				}
+				resizedImage := resize.Resize(newWidth, newHeight, imgObj, resize.Lanczos3)
 
-				length, err := strconv.Atoi(lengthStr)
-
-				if err == nil && !isThumbnail {
-					lengthu := uint(length)
-					log.Printf("Checking if resize is required for image %q and requested width %q.", img.Name, lengthStr)
-					if float32(lengthu) < float32(imgLength)*0.9 {
-						log.Printf("The image %q needs to resized to match requested width %q.", img.Name, lengthStr)
-						resizeRatio := float32(lengthu) * 10 / float32(imgLength)
-
-						resizeRatioTenth := uint(math.Round(float64(resizeRatio)))
-
-						if resizeRatioTenth < 1 {
-							resizeRatioTenth = 1
-						}
-
-						fpr := getUserResizedImagePath(user.ID, id, resizeRatioTenth)
-
-						if _, err := os.Stat(fpr); os.IsNotExist(err) {
-							newWidth := uint(float32(img.Width) * (float32(resizeRatioTenth) / 10.0))
-							newHeight := uint(float32(img.Height) * (float32(resizeRatioTenth) / 10.0))
-
-							log.Printf("Resizing image %q for serving", img.Name)
-
-							imgfile, _ := os.Open(fp)
-							defer imgfile.Close()
-
-							imgObj, _, err := image.Decode(imgfile)
-							if err != nil {
-								log.Printf(errLogTemplate, errLogImageValidationError, imageGetService, email, err.Error())
-								WriteErrorOnResponse(errUnsupportedImage, &w, http.StatusInternalServerError)
-								return
-							}
-							resizedImage := resize.Resize(newWidth, newHeight, imgObj, resize.Lanczos3)
-
-							file, err := os.Create(fpr)
-							if err != nil {
-								log.Printf(errLogTemplate, errLogIoError, imageGetService, email, err.Error())
-								WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
-								return
-							}
-							err = jpeg.Encode(file, resizedImage, &jpeg.Options{Quality: 75})
-							if err != nil {
-								log.Printf(errLogTemplate, errLogIoError, imageGetService, email, err.Error())
-								WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
-								return
-							}
-						}
-						http.ServeFile(w, r, fpr)
-
-					} else {
-						http.ServeFile(w, r, fp)
-					}
-				} else {
-					http.ServeFile(w, r, fp)
+				file, err := os.Create(fpr)
+				if err != nil {
+					log.Printf(errLogTemplate, errLogIoError, imageGetService, email, err.Error())
+					WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+					return
+				}
+				err = jpeg.Encode(file, resizedImage, &jpeg.Options{Quality: 75})
+				file.Close()
+				if err != nil {
+					log.Printf(errLogTemplate, errLogIoError, imageGetService, email, err.Error())
+					WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+					return
+				}
+				err = variants.GetVariantCache().Add(variants.ImageKey(user.ID, img.ID), fpr)
+				if err != nil {
+					log.Printf(errLogTemplate, errLogIoError, imageGetService, email, err.Error())
 				}
-				return
 			}
-		}
+			serveImageFile(w, r, fpr, getVariantETag(version, strconv.Itoa(int(resizeRatioTenth))), version)
 
-		log.Printf(errLogTemplate, errNotFound, imageUploadService, email, "Image not found")
-		WriteErrorOnResponse(errNotFound, &w, http.StatusNotFound)
+		} else {
+			serveImageFile(w, r, fp, version, version)
+		}
+	} else {
+		serveImageFile(w, r, fp, version, version)
 	}
 }
 
 func returnUserImages(user *db.User, w *http.ResponseWriter, r *http.Request) {
+	signed := len(r.FormValue("signed")) > 0
+	expiry := getSignedURLExpiry(r)
 	imList := []UserImage{}
-	for _, img := range user.Images {
-		imList = append(imList, UserImage{
-			ID:     img.ID,
-			Name:   img.Name,
-			Width:  img.Width,
-			Height: img.Height,
-		})
+	for _, img := range getActiveImages(user) {
+		userImage := toUserImage(img)
+		if signed {
+			err := addSignedURLs(&userImage, user.ID, img, r, expiry)
+			if err != nil {
+				log.Printf(errLogTemplate, errLogInvalidSignature, imageGetService, user.Email, err.Error())
+				WriteErrorOnResponse(errSignedURLsDisabled, w, http.StatusBadRequest)
+				return
+			}
+		}
+		imList = append(imList, userImage)
 	}
 
 	returnImages := UserImages{ImageList: imList}
@@ -170,6 +229,16 @@ func handleImagePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the image is uploaded to the library of user and is added to the shared library, so its size
+	// is counted in the quota of user
+	var library *db.Library
+	if libraryID := r.FormValue("library"); len(libraryID) > 0 {
+		library = getUserLibrary(w, user, libraryID, db.LibraryRoleContributor)
+		if library == nil {
+			return
+		}
+	}
+
 	fileName := r.FormValue("name")
 	if len(fileName) == 0 {
 		log.Printf(errLogTemplate, errLogMissingField, imageUploadService, email, "File name not provided.")
@@ -177,17 +246,11 @@ func handleImagePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.ImageQuota <= len(user.Images) {
-		log.Printf(errLogTemplate, errLogNotFound, imageUploadService, email, "")
-		WriteErrorOnResponse(errBadRequest, &w, http.StatusBadRequest)
-		return
-	}
-
 	err = createUserDirectories(user.ID)
 
-	// Parse our multipart form, 10 << 20 specifies a maximum
+	// Parse our multipart form, maxUploadSize specifies a maximum
 	// upload of 10 MB files.
-	r.ParseMultipartForm(10 << 20)
+	r.ParseMultipartForm(maxUploadSize)
 	// FormFile returns the first file for the given key `uploadedImg`
 	// it also returns the FileHeader so we can get the Filename,
 	// the Header and the size of the file
@@ -202,48 +265,6 @@ func handleImagePost(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("File Size: %+v\n", handler.Size)
 	fmt.Printf("MIME Header: %+v\n", handler.Header)
 
-	var uploadedImage image.Image
-	uploadedImage, _, err = exiffix.Decode(file)
-	if err != nil {
-		log.Printf(errLogTemplate, errLogImageValidationError, imageUploadService, email, err.Error())
-		WriteErrorOnResponse(errUnsupportedImage, &w, http.StatusInternalServerError)
-		return
-	}
-	width := uploadedImage.Bounds().Dx()
-	height := uploadedImage.Bounds().Dy()
-
-	if width > maxImageDimension || height > maxImageDimension {
-		log.Printf(errLogTemplate, errLogImageValidationError, imageUploadService, email, "Image too big")
-		WriteErrorOnResponse(errImageTooBig, &w, http.StatusInternalServerError)
-		return
-	}
-	if width < minImageDimension || height < minImageDimension {
-		log.Printf(errLogTemplate, errLogImageValidationError, imageUploadService, email, "Image too small")
-		WriteErrorOnResponse(errImageTooSmall, &w, http.StatusInternalServerError)
-		return
-	}
-
-	// Generate a UUID for the user
-	id, _ := uuid.NewUUID()
-	imageUUID := id.String()
-
-	// save the image
-	imgW, imgH, err := saveImage(uploadedImage, user.ID, imageUUID, false)
-	if err != nil {
-		log.Printf(errLogTemplate, errLogImageSavingError, imageUploadService, email, err.Error())
-		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
-		return
-	}
-
-	// save the thumbnail
-	_, _, err = saveImage(uploadedImage, user.ID, imageUUID, true)
-	if err != nil {
-		log.Printf(errLogTemplate, errLogImageSavingError, imageUploadService, email, err.Error())
-		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
-		return
-	}
-
-	// user the user in DB
 	client, err := db.CreateMongoClient()
 	defer db.CloseClient(client)
 	if err != nil {
@@ -252,34 +273,29 @@ func handleImagePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the upload is only validated and kept here, the derivatives are generated by the image workers
 	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
-	filter := bson.D{{"id", user.ID}}
-	update := bson.D{
-		{"$push", bson.D{
-			{"images", db.ImageInfo{
-				ID:         imageUUID,
-				Width:      imgW,
-				Height:     imgH,
-				UploadDate: time.Now(),
-				Name:       fileName,
-			}},
-		}},
-	}
-	_, err = collection.UpdateOne(context.TODO(), filter, update)
-	if err != nil {
-		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, imageUploadService, email, err.Error())
-		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+	imgInfo, job, uploadErr := acceptUpload(collection, user, fileName, file)
+	if uploadErr != nil {
+		log.Printf(errLogTemplate, errLogImageValidationError, imageUploadService, email, uploadErr.Error())
+		WriteErrorOnResponse(uploadErr.description, &w, uploadErr.status)
 		return
 	}
 
-	newImageJSON := UserImage{
-		ID:     imageUUID,
-		Name:   fileName,
-		Width:  imgW,
-		Height: imgH,
+	newImageJSON := toUserImage(*imgInfo)
+	newImageJSON.JobID = job.ID
+	if library != nil {
+		err = addLibraryImage(library.ID, user.ID, imgInfo.ID)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotUpdateTheDb, imageUploadService, email, err.Error())
+			WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+			return
+		}
+		newImageJSON.URL = getLibraryImageURL(library.ID, imgInfo.ID, imgInfo.Hash, false)
+		newImageJSON.ThumbnailURL = getLibraryImageURL(library.ID, imgInfo.ID, imgInfo.ThumbnailHash, true)
 	}
-
 	js, _ := json.Marshal(newImageJSON)
+	w.WriteHeader(http.StatusAccepted)
 	w.Write(js)
 }
 
@@ -306,51 +322,41 @@ func handleImageDel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// deleting from a shared library only removes the images from it
+	if libraryID := r.FormValue("library"); len(libraryID) > 0 {
+		handleLibraryImageDel(w, user, libraryID, request.ImageIds)
+		return
+	}
+
 	deleteRequestSet := make(map[string]bool)
 	for _, imgID := range request.ImageIds {
 		deleteRequestSet[imgID] = true
 	}
 
-	deletedImages := []db.ImageInfo{}
-	// go through the user images to see if such image exist
-	deleteCntr := 0
+	// the images are moved to trash, they are purged when the retention of trash passes
+	trashedIds := []string{}
 	for _, img := range user.Images {
-		if deleteRequestSet[img.ID] {
-			// delete image from db
-			deletedImages = append(deletedImages, img)
-			deleteCntr++
+		if deleteRequestSet[img.ID] && !img.IsTrashed() {
+			trashedIds = append(trashedIds, img.ID)
 		}
 	}
+	deleteCntr := len(trashedIds)
 
-	client, err := db.CreateMongoClient()
-	defer db.CloseClient(client)
-	if err != nil {
-		log.Printf(errLogTemplate, errLogCannotConnectToDb, imageUploadService, email, err.Error())
-		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
-		return
-	}
-	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
-	filter := bson.D{{"id", user.ID}}
-	update := bson.D{
-		{"$pull", bson.D{
-			{"images", bson.D{
-				{
-					"$in", deletedImages,
-				}},
-			}},
-		}}
-	_, err = collection.UpdateOne(context.TODO(), filter, update)
-	if err != nil {
-		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, imageUploadService, email, err.Error())
-		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
-		return
-	}
-
-	for _, img := range deletedImages {
-		fpt := getUserImagePath(user.ID, img.ID, true)
-		os.Remove(fpt)
-		fp := getUserImagePath(user.ID, img.ID, false)
-		os.Remove(fp)
+	if deleteCntr > 0 {
+		client, err := db.CreateMongoClient()
+		defer db.CloseClient(client)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotConnectToDb, imageDeleteService, email, err.Error())
+			WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+			return
+		}
+		collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+		err = trashImages(collection, user.ID, trashedIds)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotUpdateTheDb, imageDeleteService, email, err.Error())
+			WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+			return
+		}
 	}
 
 	js, _ := json.Marshal(ImageDeleteResponse{
@@ -359,7 +365,50 @@ func handleImageDel(w http.ResponseWriter, r *http.Request) {
 	w.Write(js)
 }
 
-func saveImage(image image.Image, userID string, imageUUID string, isThumbnail bool) (uint, uint, error) {
+// addUserImage pushes the image information to the images of user and adds its size to the usage of user
+func addUserImage(collection *mongo.Collection, userID string, img db.ImageInfo) error {
+	filter := bson.D{{"id", userID}}
+	update := bson.D{
+		{"$push", bson.D{
+			{"images", img},
+		}},
+		{"$inc", bson.D{
+			{"storageused", img.Size},
+			{"usageversion", 1},
+		}},
+	}
+	_, err := collection.UpdateOne(context.TODO(), filter, update)
+	return err
+}
+
+func toUserImage(img db.ImageInfo) UserImage {
+	status := img.Status
+	if len(status) == 0 {
+		status = db.ImageStatusReady
+	}
+	return UserImage{
+		ID:           img.ID,
+		Name:         img.Name,
+		Width:        img.Width,
+		Height:       img.Height,
+		Status:       status,
+		Version:      img.Hash,
+		URL:          getImageURL(img.ID, img.Hash, false),
+		ThumbnailURL: getImageURL(img.ID, img.ThumbnailHash, true),
+		Caption:      img.Caption,
+		Tags:         getImageTags(img),
+		Favorite:     img.Favorite,
+		Rating:       img.Rating,
+		NeverShow:    img.NeverShow,
+		BlurHash:     img.BlurHash,
+		AverageColor: img.AverageColor,
+		Palette:      img.Palette,
+		EditPending:  img.HasPendingEdits(),
+	}
+}
+
+// saveImage resizes and saves the image, the returned hash is the content hash of the saved file
+func saveImage(image image.Image, userID string, imageUUID string, isThumbnail bool) (uint, uint, string, error) {
 	width := uint(image.Bounds().Dx())
 	height := uint(image.Bounds().Dy())
 
@@ -372,13 +421,15 @@ func saveImage(image image.Image, userID string, imageUUID string, isThumbnail b
 
 	file, err := os.Create(getUserImagePath(userID, imageUUID, isThumbnail))
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, "", err
 	}
-	err = jpeg.Encode(file, resizedImage, nil)
+	defer file.Close()
+	hasher := sha256.New()
+	err = jpeg.Encode(io.MultiWriter(file, hasher), resizedImage, nil)
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, "", err
 	}
-	return tWidth, tHeigth, nil
+	return tWidth, tHeigth, hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
 func getUserImagePath(userID string, imageUUID string, isThumbnail bool) string {
@@ -389,6 +440,10 @@ func getUserImagePath(userID string, imageUUID string, isThumbnail bool) string
 	return path.Join(getCurUserDirectory(userID)+directory, imageUUID+jpegExtension)
 }
 
+func getUserOriginalImagePath(userID string, originalFile string) string {
+	return path.Join(getCurUserDirectory(userID)+originalsDirectory, originalFile)
+}
+
 func getUserResizedImagePath(userID string, imageUUID string, resizeTenth uint) string {
 	return path.Join(getCurUserDirectory(userID)+imagesDiretory, imageUUID+"-"+strconv.Itoa(int(resizeTenth))+jpegExtension)
 }
@@ -439,5 +494,12 @@ func createUserDirectories(userID string) error {
 			return err
 		}
 	}
+
+	if _, err := os.Stat(curUserDirectory + originalsDirectory); os.IsNotExist(err) {
+		err := os.Mkdir(curUserDirectory+originalsDirectory, 0777)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -0,0 +1,277 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/disintegration/imaging"
+	"github.com/matba/slyde-server/internals/db"
+	"github.com/matba/slyde-server/internals/jobs"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const imageEditService = "IMAGE_EDIT"
+const maxImageEdits = 20
+
+// HandleImageEdit handles API calls for the non-destructive edits of images
+func HandleImageEdit(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	log.Printf("Incoming call for image edits")
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, imageEditService)
+	if err != nil {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		handleImageEditGet(w, r, user)
+	case "PUT":
+		handleImageEditPut(w, r, user)
+	case "DELETE":
+		handleImageEditDel(w, r, user)
+	default:
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+}
+
+func handleImageEditGet(w http.ResponseWriter, r *http.Request, user *db.User) {
+	img := findUserImage(user, r.FormValue("id"))
+	if img == nil || img.IsTrashed() {
+		log.Printf(errLogTemplate, errLogNotFound, imageEditService, user.Email, r.FormValue("id"))
+		WriteErrorOnResponse(errNotFound, &w, http.StatusNotFound)
+		return
+	}
+
+	js, _ := json.Marshal(imageEdits{ImageID: img.ID, Edits: toImageEditOperations(img.Edits)})
+	w.Write(js)
+}
+
+// handleImageEditPut replaces the edits of image, the derivatives are generated again in background
+func handleImageEditPut(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request imageEdits
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, imageEditService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	edits, err := toImageEdits(request.Edits)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogValidation, imageEditService, user.Email, err.Error())
+		WriteErrorOnResponse(errInvalidImageEdit, &w, http.StatusBadRequest)
+		return
+	}
+
+	updateImageEdits(w, user, request.ImageID, edits)
+}
+
+// handleImageEditDel reverts the image to its original by removing all of its edits
+func handleImageEditDel(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request imageEdits
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, imageEditService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	updateImageEdits(w, user, request.ImageID, []db.ImageEdit{})
+}
+
+func updateImageEdits(w http.ResponseWriter, user *db.User, imageID string, edits []db.ImageEdit) {
+	img := findUserImage(user, imageID)
+	if img == nil || img.IsTrashed() {
+		log.Printf(errLogTemplate, errLogNotFound, imageEditService, user.Email, imageID)
+		WriteErrorOnResponse(errNotFound, &w, http.StatusNotFound)
+		return
+	}
+
+	// the images uploaded before originals were kept use their stored image as the original
+	if len(img.OriginalFile) == 0 {
+		originalFile := img.ID + jpegExtension
+		err := createUserDirectories(user.ID)
+		if err == nil {
+			err = copyFile(getUserImagePath(user.ID, img.ID, false), getUserOriginalImagePath(user.ID, originalFile))
+		}
+		if err != nil {
+			log.Printf(errLogTemplate, errLogIoError, imageEditService, user.Email, err.Error())
+			WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+			return
+		}
+		img.OriginalFile = originalFile
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, imageEditService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	// the image keeps being served with its previous derivatives until the new ones are generated, only an
+	// image whose processing has failed is processed again as a new upload
+	status := img.Status
+	if status == db.ImageStatusFailed {
+		status = db.ImageStatusProcessing
+	}
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}, {"images.id", img.ID}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"images.$.edits", edits},
+			{"images.$.originalfile", img.OriginalFile},
+			{"images.$.status", status},
+		}},
+		{"$inc", bson.D{
+			{"images.$.editversion", 1},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, imageEditService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	job, err := jobs.GetQueue().Enqueue(processImageJobType, user.ID, map[string]string{
+		imagePayloadKey:    img.ID,
+		originalPayloadKey: img.OriginalFile,
+	})
+	if err != nil {
+		// the edits stay pending, the image is still served with its previous derivatives
+		log.Printf(errLogTemplate, errLogCannotInsertToDb, imageEditService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	img.Edits = edits
+	img.Status = status
+	img.EditVersion++
+	imageJSON := toUserImage(*img)
+	imageJSON.JobID = job.ID
+	js, _ := json.Marshal(imageJSON)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(js)
+}
+
+// applyImageEdits applies the edits in order on the image
+func applyImageEdits(img image.Image, edits []db.ImageEdit) image.Image {
+	for _, edit := range edits {
+		switch edit.Type {
+		case db.ImageEditRotate:
+			// imaging rotates counter-clockwise
+			switch ((edit.Angle % 360) + 360) % 360 {
+			case 90:
+				img = imaging.Rotate270(img)
+			case 180:
+				img = imaging.Rotate180(img)
+			case 270:
+				img = imaging.Rotate90(img)
+			}
+		case db.ImageEditCrop:
+			width := img.Bounds().Dx()
+			height := img.Bounds().Dy()
+			x0 := int(edit.X * float64(width))
+			y0 := int(edit.Y * float64(height))
+			x1 := clamp(int((edit.X+edit.Width)*float64(width)), x0+1, width)
+			y1 := clamp(int((edit.Y+edit.Height)*float64(height)), y0+1, height)
+			img = imaging.Crop(img, image.Rect(x0, y0, x1, y1))
+		case db.ImageEditFlip:
+			if edit.Direction == "vertical" {
+				img = imaging.FlipV(img)
+			} else {
+				img = imaging.FlipH(img)
+			}
+		case db.ImageEditBrightness:
+			img = imaging.AdjustBrightness(img, edit.Amount)
+		case db.ImageEditContrast:
+			img = imaging.AdjustContrast(img, edit.Amount)
+		}
+	}
+	return img
+}
+
+// toImageEdits validates the requested edit operations and converts them to the DB form
+func toImageEdits(operations []imageEditOperation) ([]db.ImageEdit, error) {
+	if len(operations) > maxImageEdits {
+		return nil, errors.New("Too many edits")
+	}
+	edits := []db.ImageEdit{}
+	for _, op := range operations {
+		edit := db.ImageEdit{Type: op.Type}
+		switch op.Type {
+		case db.ImageEditRotate:
+			if op.Angle%90 != 0 {
+				return nil, errors.New("Rotation should be a multiple of 90 degrees")
+			}
+			edit.Angle = op.Angle
+		case db.ImageEditCrop:
+			if op.X < 0 || op.Y < 0 || op.Width <= 0 || op.Height <= 0 || op.X+op.Width > 1 || op.Y+op.Height > 1 {
+				return nil, errors.New("Crop rectangle should be inside the image")
+			}
+			edit.X, edit.Y, edit.Width, edit.Height = op.X, op.Y, op.Width, op.Height
+		case db.ImageEditFlip:
+			if op.Direction != "horizontal" && op.Direction != "vertical" {
+				return nil, errors.New("Flip direction should be horizontal or vertical")
+			}
+			edit.Direction = op.Direction
+		case db.ImageEditBrightness, db.ImageEditContrast:
+			if op.Amount < -100 || op.Amount > 100 {
+				return nil, errors.New("Amount should be between -100 and 100")
+			}
+			edit.Amount = op.Amount
+		default:
+			return nil, errors.New("Unknown edit " + op.Type)
+		}
+		edits = append(edits, edit)
+	}
+	return edits, nil
+}
+
+func toImageEditOperations(edits []db.ImageEdit) []imageEditOperation {
+	operations := []imageEditOperation{}
+	for _, edit := range edits {
+		operations = append(operations, imageEditOperation{
+			Type:      edit.Type,
+			Angle:     edit.Angle,
+			X:         edit.X,
+			Y:         edit.Y,
+			Width:     edit.Width,
+			Height:    edit.Height,
+			Direction: edit.Direction,
+			Amount:    edit.Amount,
+		})
+	}
+	return operations
+}
+
+// findUserImage returns the image of user with the id or nil if the user does not have such image
+func findUserImage(user *db.User, imageID string) *db.ImageInfo {
+	for i := range user.Images {
+		if user.Images[i].ID == imageID {
+			return &user.Images[i]
+		}
+	}
+	return nil
+}
+
+func copyFile(source string, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return saveOriginal(in, destination)
+}
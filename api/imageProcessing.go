@@ -0,0 +1,320 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/edwvee/exiffix"
+	"github.com/google/uuid"
+	"github.com/matba/slyde-server/internals/db"
+	"github.com/matba/slyde-server/internals/jobs"
+	"github.com/matba/slyde-server/internals/variants"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const imageProcessingService = "IMAGE_PROCESSING"
+const processImageJobType = "PROCESS_IMAGE"
+const imagePayloadKey = "image"
+const originalPayloadKey = "original"
+
+var originalExtensions = map[string]string{
+	"jpeg": jpegExtension,
+	"png":  ".png",
+	"gif":  ".gif",
+	"bmp":  ".bmp",
+	"tiff": ".tiff",
+}
+
+// uploadError describes why an upload is rejected, the description and status are sent to client
+type uploadError struct {
+	description string
+	status      int
+	err         error
+}
+
+func (e *uploadError) Error() string {
+	return e.err.Error()
+}
+
+// acceptUpload validates the uploaded file, keeps it in the originals of user, adds the image to user in
+// processing state and queues the job that generates its derivatives.
+func acceptUpload(collection *mongo.Collection, user *db.User, fileName string, file io.ReadSeeker) (*db.ImageInfo, *db.Job, *uploadError) {
+	format, description, err := validateUploadedImage(file)
+	if err != nil {
+		return nil, nil, &uploadError{description, http.StatusBadRequest, err}
+	}
+
+	size, err := getFileSize(file)
+	if err != nil {
+		return nil, nil, &uploadError{errInternalError, http.StatusInternalServerError, err}
+	}
+	// the derivatives are counted when they are generated, so the last upload may go slightly over the quota
+	if user.StorageUsed+size > getStorageQuota(user) {
+		return nil, nil, &uploadError{getStorageQuotaDescription(user), http.StatusInsufficientStorage,
+			errors.New("Storage quota exceeded")}
+	}
+
+	err = createUserDirectories(user.ID)
+	if err != nil {
+		return nil, nil, &uploadError{errInternalError, http.StatusInternalServerError, err}
+	}
+
+	// Generate a UUID for the image
+	id, _ := uuid.NewUUID()
+	imgInfo := db.ImageInfo{
+		ID:           id.String(),
+		Name:         fileName,
+		UploadDate:   time.Now(),
+		Status:       db.ImageStatusProcessing,
+		OriginalFile: id.String() + originalExtensions[format],
+		Size:         size,
+	}
+
+	originalPath := getUserOriginalImagePath(user.ID, imgInfo.OriginalFile)
+	err = saveOriginal(file, originalPath)
+	if err != nil {
+		return nil, nil, &uploadError{errInternalError, http.StatusInternalServerError, err}
+	}
+
+	err = addUserImage(collection, user.ID, imgInfo)
+	if err != nil {
+		os.Remove(originalPath)
+		return nil, nil, &uploadError{errInternalError, http.StatusInternalServerError, err}
+	}
+	user.StorageUsed += imgInfo.Size
+	addSearchEntry(user.ID, imgInfo)
+
+	job, err := jobs.GetQueue().Enqueue(processImageJobType, user.ID, map[string]string{
+		imagePayloadKey:    imgInfo.ID,
+		originalPayloadKey: imgInfo.OriginalFile,
+	})
+	if err != nil {
+		setImageStatus(collection, user.ID, imgInfo.ID, db.ImageStatusFailed)
+		return nil, nil, &uploadError{errInternalError, http.StatusInternalServerError, err}
+	}
+
+	return &imgInfo, job, nil
+}
+
+// validateUploadedImage makes sure the uploaded file is a supported image and its dimensions are supported,
+// only the header of image is decoded. If the image is rejected the returned string is the description
+// that should be sent to client.
+func validateUploadedImage(file io.ReadSeeker) (string, string, error) {
+	config, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return "", errUnsupportedImage, err
+	}
+	if _, ok := originalExtensions[format]; !ok {
+		return "", errUnsupportedImage, errors.New("Unsupported format " + format)
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", errInternalError, err
+	}
+
+	// the orientation of image may swap width and height but the limits are the same for both
+	if config.Width > maxImageDimension || config.Height > maxImageDimension {
+		return "", errImageTooBig, errors.New("Image too big")
+	}
+	if config.Width < minImageDimension || config.Height < minImageDimension {
+		return "", errImageTooSmall, errors.New("Image too small")
+	}
+	return format, "", nil
+}
+
+func getFileSize(file io.Seeker) (int64, error) {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	return size, err
+}
+
+func saveOriginal(file io.Reader, originalPath string) error {
+	out, err := os.Create(originalPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, file)
+	if err != nil {
+		out.Close()
+		os.Remove(originalPath)
+		return err
+	}
+	return out.Close()
+}
+
+// registerImageJobs registers the handlers of image jobs in the job queue
+func registerImageJobs() {
+	jobs.GetQueue().RegisterHandler(processImageJobType, processImageJob)
+}
+
+// processImageJob generates the resized image and the thumbnail from the original of an uploaded image
+func processImageJob(job *db.Job) error {
+	imageID := job.Payload[imagePayloadKey]
+	err := generateImageDerivatives(job.UserID, imageID)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogImageSavingError, imageProcessingService, job.UserID, err.Error())
+		if job.Attempts >= job.MaxAttempts {
+			markImageFailed(job.UserID, imageID)
+		}
+	}
+	return err
+}
+
+// generateImageDerivatives generates the derivatives from the original with the current edits of image
+func generateImageDerivatives(userID string, imageID string) error {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		return err
+	}
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+
+	var user db.User
+	err = collection.FindOne(context.TODO(), bson.D{{"id", userID}}).Decode(&user)
+	if err != nil {
+		return err
+	}
+	img := findUserImage(&user, imageID)
+	// the image is deleted before it was processed
+	if img == nil {
+		return nil
+	}
+
+	file, err := os.Open(getUserOriginalImagePath(userID, img.OriginalFile))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	uploadedImage, _, err := exiffix.Decode(file)
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	captureDate := readCaptureDate(file)
+
+	editedImage := applyImageEdits(uploadedImage, img.Edits)
+	err = storeImageDerivatives(userID, editedImage, img)
+	if err != nil {
+		return err
+	}
+	placeholders := computeImagePlaceholders(editedImage)
+
+	// the usage of user changes by the difference of the stored files of image
+	previousSize := img.Size
+	img.Size = getStoredImageSize(userID, *img)
+
+	filter := bson.D{{"id", userID}, {"images.id", imageID}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"images.$.width", img.Width},
+			{"images.$.height", img.Height},
+			{"images.$.hash", img.Hash},
+			{"images.$.thumbnailhash", img.ThumbnailHash},
+			{"images.$.status", db.ImageStatusReady},
+			{"images.$.size", img.Size},
+			{"images.$.blurhash", placeholders.blurHash},
+			{"images.$.averagecolor", placeholders.averageColor},
+			{"images.$.palette", placeholders.palette},
+			{"images.$.capturedate", captureDate},
+			{"images.$.appliededitversion", img.EditVersion},
+		}},
+		{"$inc", bson.D{
+			{"storageused", img.Size - previousSize},
+			{"usageversion", 1},
+		}},
+	}
+	result, err := collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		return err
+	}
+
+	// the variants rendered from the previous derivatives are stale
+	variants.GetVariantCache().RemoveImage(variants.ImageKey(userID, imageID))
+	removeImageProfileRenderings(userID, imageID)
+
+	// the image is deleted while it was processed
+	if result.MatchedCount == 0 {
+		os.Remove(getUserImagePath(userID, imageID, false))
+		os.Remove(getUserImagePath(userID, imageID, true))
+		return nil
+	}
+	// the capture date is only known once the original is processed
+	img.CaptureDate = captureDate
+	updateSearchEntries(userID, []string{imageID}, bson.D{{"$set", bson.D{
+		{"capturedate", img.CaptureDate},
+		{"date", getImageDate(*img)},
+	}}})
+	queueProfileRenderings(&user, imageID)
+	return nil
+}
+
+// storeImageDerivatives saves the resized image and its thumbnail on disk and sets their dimensions and hashes on img
+func storeImageDerivatives(userID string, uploadedImage image.Image, img *db.ImageInfo) error {
+	// save the image
+	imgW, imgH, hash, err := saveImage(uploadedImage, userID, img.ID, false)
+	if err != nil {
+		return err
+	}
+
+	// save the thumbnail
+	_, _, thumbnailHash, err := saveImage(uploadedImage, userID, img.ID, true)
+	if err != nil {
+		return err
+	}
+
+	img.Width = imgW
+	img.Height = imgH
+	img.Hash = hash
+	img.ThumbnailHash = thumbnailHash
+	return nil
+}
+
+// markImageFailed marks the image failed if it is still being processed, an image whose derivatives were
+// generated before is still served with them when generating them again with new edits fails
+func markImageFailed(userID string, imageID string) {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, imageProcessingService, userID, err.Error())
+		return
+	}
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", userID}, {"images", bson.D{{"$elemMatch", bson.D{
+		{"id", imageID},
+		{"status", db.ImageStatusProcessing},
+	}}}}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"images.$.status", db.ImageStatusFailed},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, imageProcessingService, userID, err.Error())
+	}
+}
+
+func setImageStatus(collection *mongo.Collection, userID string, imageID string, status string) error {
+	filter := bson.D{{"id", userID}, {"images.id", imageID}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"images.$.status", status},
+		}},
+	}
+	_, err := collection.UpdateOne(context.TODO(), filter, update)
+	return err
+}
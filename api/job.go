@@ -0,0 +1,117 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/matba/slyde-server/internals/db"
+	"github.com/matba/slyde-server/internals/jobs"
+)
+
+const jobService = "JOB"
+const jobEventsPollInterval = time.Second
+const jobEventsKeepAlive = 30 * time.Second
+
+// HandleJob handles API calls for getting the status of a background job
+func HandleJob(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	if r.Method != "GET" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, jobService)
+	if err != nil {
+		return
+	}
+
+	job, err := jobs.GetQueue().GetJob(r.FormValue("id"))
+	if err != nil && err != jobs.NotFound {
+		log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, jobService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+	if err == jobs.NotFound || job.UserID != user.ID {
+		log.Printf(errLogTemplate, errLogNotFound, jobService, email, r.FormValue("id"))
+		WriteErrorOnResponse(errJobNotFound, &w, http.StatusNotFound)
+		return
+	}
+
+	js, _ := json.Marshal(toJobStatus(*job))
+	w.Write(js)
+}
+
+// HandleJobEvents streams the changes of the jobs of user as server sent events
+func HandleJobEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, jobService)
+	if err != nil {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	since := time.Now()
+	lastWrite := time.Now()
+	ticker := time.NewTicker(jobEventsPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
+		updatedJobs, err := jobs.GetQueue().GetUserJobsUpdatedSince(user.ID, since)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, jobService, email, err.Error())
+			continue
+		}
+		for _, job := range updatedJobs {
+			js, _ := json.Marshal(toJobStatus(job))
+			fmt.Fprintf(w, "event: job\ndata: %s\n\n", js)
+			since = job.UpdateDate
+			lastWrite = time.Now()
+		}
+		// the comment keeps proxies from closing an idle connection
+		if time.Since(lastWrite) > jobEventsKeepAlive {
+			fmt.Fprint(w, ": keep-alive\n\n")
+			lastWrite = time.Now()
+		}
+		flusher.Flush()
+	}
+}
+
+func toJobStatus(job db.Job) jobStatus {
+	return jobStatus{
+		ID:           job.ID,
+		Type:         job.Type,
+		Status:       job.Status,
+		Attempts:     job.Attempts,
+		Error:        job.Error,
+		ImageID:      job.Payload[imagePayloadKey],
+		CreationDate: job.CreationDate,
+		UpdateDate:   job.UpdateDate,
+	}
+}
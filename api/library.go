@@ -0,0 +1,811 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/matba/slyde-server/internals/db"
+	"github.com/matba/slyde-server/internals/email"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const libraryService = "LIBRARY"
+const libraryInvitationRetention = 7 * 24 * time.Hour
+
+// the roles of library members, a member with a higher rank can do everything a lower rank can
+var libraryRoleRanks = map[string]int{
+	db.LibraryRoleViewer:      1,
+	db.LibraryRoleContributor: 2,
+	db.LibraryRoleOwner:       3,
+}
+
+// libraryImageInfo is an image of a shared library together with its uploader
+type libraryImageInfo struct {
+	uploader *db.User
+	image    db.ImageInfo
+}
+
+// HandleLibrary handles API calls for shared libraries
+func HandleLibrary(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	log.Printf("Incoming call for libraries")
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, libraryService)
+	if err != nil {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		handleLibraryGet(w, user)
+	case "POST":
+		handleLibraryPost(w, r, user)
+	case "PUT":
+		handleLibraryPut(w, r, user)
+	case "DELETE":
+		handleLibraryDel(w, r, user)
+	default:
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+}
+
+// handleLibraryGet lists the libraries user is a member of
+func handleLibraryGet(w http.ResponseWriter, user *db.User) {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.LibrariesCollection)
+	cursor, err := collection.Find(context.TODO(), bson.D{{"members.userid", user.ID}})
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.TODO())
+
+	libraries := []userLibrary{}
+	for cursor.Next(context.TODO()) {
+		var library db.Library
+		err = cursor.Decode(&library)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, libraryService, user.Email, err.Error())
+			WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+			return
+		}
+		libraries = append(libraries, toUserLibrary(library, user.ID))
+	}
+
+	js, _ := json.Marshal(userLibraries{LibraryList: libraries})
+	w.Write(js)
+}
+
+// handleLibraryPost creates a library with user as its owner
+func handleLibraryPost(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request libraryRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+	if len(request.Name) == 0 {
+		log.Printf(errLogTemplate, errLogMissingField, libraryService, user.Email, "Library name not provided.")
+		WriteErrorOnResponse(errBadRequest, &w, http.StatusBadRequest)
+		return
+	}
+
+	id, _ := uuid.NewUUID()
+	library := db.Library{
+		ID:   id.String(),
+		Name: request.Name,
+		Members: []db.LibraryMember{{
+			UserID:   user.ID,
+			Email:    user.Email,
+			Role:     db.LibraryRoleOwner,
+			JoinDate: time.Now(),
+		}},
+		Invitations:  []db.LibraryInvitation{},
+		Images:       []db.LibraryImage{},
+		CreationDate: time.Now(),
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.LibrariesCollection)
+	_, err = collection.InsertOne(context.TODO(), library)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotInsertToDb, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(toUserLibrary(library, user.ID))
+	w.Write(js)
+}
+
+// handleLibraryPut renames the library, only owners can rename it
+func handleLibraryPut(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request libraryRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	library := getUserLibrary(w, user, request.ID, db.LibraryRoleOwner)
+	if library == nil {
+		return
+	}
+	if len(request.Name) > 0 {
+		library.Name = request.Name
+	}
+
+	err = updateLibrary(library.ID, bson.D{{"$set", bson.D{{"name", library.Name}}}})
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(toUserLibrary(*library, user.ID))
+	w.Write(js)
+}
+
+// handleLibraryDel deletes the libraries user owns, the images stay in the libraries of their uploaders
+func handleLibraryDel(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request libraryDeleteRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.LibrariesCollection)
+	filter := bson.D{
+		{"id", bson.D{{"$in", request.LibraryIds}}},
+		{"members", bson.D{{"$elemMatch", bson.D{
+			{"userid", user.ID},
+			{"role", db.LibraryRoleOwner},
+		}}}},
+	}
+	result, err := collection.DeleteMany(context.TODO(), filter)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(libraryDeleteResponse{
+		NumberDeleted: int(result.DeletedCount),
+	})
+	w.Write(js)
+}
+
+// HandleLibraryMember handles API calls for inviting members to a library, changing their roles and removing them
+func HandleLibraryMember(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	log.Printf("Incoming call for library members")
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, libraryService)
+	if err != nil {
+		return
+	}
+
+	var request libraryMemberRequest
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		handleLibraryMemberInvite(w, user, request)
+	case "PUT":
+		handleLibraryMemberPut(w, user, request)
+	case "DELETE":
+		handleLibraryMemberDel(w, user, request)
+	default:
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+}
+
+// handleLibraryMemberInvite invites the email to the library, an invitation to the same email replaces the previous one
+func handleLibraryMemberInvite(w http.ResponseWriter, user *db.User, request libraryMemberRequest) {
+	library := getUserLibrary(w, user, request.Library, db.LibraryRoleOwner)
+	if library == nil {
+		return
+	}
+	invitedEmail := strings.ToLower(request.Email)
+	if emailMatched, _ := regexp.MatchString(emailRegex, invitedEmail); !emailMatched {
+		log.Printf(errLogTemplate, errLogValidation, libraryService, user.Email, request.Email)
+		WriteErrorOnResponse(errInvalidEmailFormat, &w, http.StatusBadRequest)
+		return
+	}
+	if _, ok := libraryRoleRanks[request.Role]; !ok {
+		log.Printf(errLogTemplate, errLogValidation, libraryService, user.Email, request.Role)
+		WriteErrorOnResponse(errInvalidLibraryRole, &w, http.StatusBadRequest)
+		return
+	}
+	for _, member := range library.Members {
+		if strings.EqualFold(member.Email, invitedEmail) {
+			log.Printf(errLogTemplate, errLogAlreadyExists, libraryService, user.Email, invitedEmail)
+			WriteErrorOnResponse(errBadRequest, &w, http.StatusConflict)
+			return
+		}
+	}
+
+	token, err := generateShareToken()
+	if err != nil {
+		log.Printf(errLogTemplate, errLogIoError, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+	invitation := db.LibraryInvitation{
+		Token:        token,
+		Email:        invitedEmail,
+		Role:         request.Role,
+		InvitedBy:    user.Email,
+		CreationDate: time.Now(),
+	}
+	// the invitations are changed in place, so the invitations accepted or sent meanwhile are kept
+	err = updateLibrary(library.ID, bson.D{{"$pull", bson.D{{"invitations", bson.D{{"email", invitedEmail}}}}}})
+	if err == nil {
+		err = updateLibrary(library.ID, bson.D{{"$push", bson.D{{"invitations", invitation}}}})
+	}
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	err = email.GetEmailSender().SendEmail(invitedEmail, libraryInvitationSubject,
+		fmt.Sprintf(libraryInvitationBody, user.Name, library.Name, request.Role, token))
+	if err != nil {
+		log.Printf(errLogTemplate, errLogEmailFailure, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(toLibraryInvitation(*library, invitation, false))
+	w.Write(js)
+}
+
+// handleLibraryMemberPut changes the role of a member, only owners can change roles
+func handleLibraryMemberPut(w http.ResponseWriter, user *db.User, request libraryMemberRequest) {
+	library := getUserLibrary(w, user, request.Library, db.LibraryRoleOwner)
+	if library == nil {
+		return
+	}
+	if _, ok := libraryRoleRanks[request.Role]; !ok {
+		log.Printf(errLogTemplate, errLogValidation, libraryService, user.Email, request.Role)
+		WriteErrorOnResponse(errInvalidLibraryRole, &w, http.StatusBadRequest)
+		return
+	}
+	member := findLibraryMember(library, request.UserID)
+	if member == nil {
+		log.Printf(errLogTemplate, errLogNotFound, libraryService, user.Email, request.UserID)
+		WriteErrorOnResponse(errNotFound, &w, http.StatusNotFound)
+		return
+	}
+	if member.Role == db.LibraryRoleOwner && request.Role != db.LibraryRoleOwner && countLibraryOwners(library) == 1 {
+		log.Printf(errLogTemplate, errLogValidation, libraryService, user.Email, "Last owner of library.")
+		WriteErrorOnResponse(errLastLibraryOwner, &w, http.StatusConflict)
+		return
+	}
+	member.Role = request.Role
+
+	// only the role of member is set, so the members who joined meanwhile are kept
+	update := bson.D{{"$set", bson.D{{"members.$[member].role", request.Role}}}}
+	arrayFilters := options.ArrayFilters{Filters: []interface{}{
+		bson.D{{"member.userid", request.UserID}},
+	}}
+	err := updateLibrary(library.ID, update, options.Update().SetArrayFilters(arrayFilters))
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(toUserLibrary(*library, user.ID))
+	w.Write(js)
+}
+
+// handleLibraryMemberDel removes a member from the library, owners can remove anyone and members can leave
+func handleLibraryMemberDel(w http.ResponseWriter, user *db.User, request libraryMemberRequest) {
+	minRole := db.LibraryRoleOwner
+	if request.UserID == user.ID {
+		minRole = db.LibraryRoleViewer
+	}
+	library := getUserLibrary(w, user, request.Library, minRole)
+	if library == nil {
+		return
+	}
+	member := findLibraryMember(library, request.UserID)
+	if member == nil {
+		log.Printf(errLogTemplate, errLogNotFound, libraryService, user.Email, request.UserID)
+		WriteErrorOnResponse(errNotFound, &w, http.StatusNotFound)
+		return
+	}
+	if member.Role == db.LibraryRoleOwner && countLibraryOwners(library) == 1 {
+		log.Printf(errLogTemplate, errLogValidation, libraryService, user.Email, "Last owner of library.")
+		WriteErrorOnResponse(errLastLibraryOwner, &w, http.StatusConflict)
+		return
+	}
+
+	// the images the member added stay in the library
+	err := updateLibrary(library.ID, bson.D{{"$pull", bson.D{{"members", bson.D{{"userid", request.UserID}}}}}})
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(libraryDeleteResponse{NumberDeleted: 1})
+	w.Write(js)
+}
+
+// HandleLibraryInvitation handles API calls for the pending invitations of user
+func HandleLibraryInvitation(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	log.Printf("Incoming call for library invitations")
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, libraryService)
+	if err != nil {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		handleLibraryInvitationGet(w, user)
+	case "POST":
+		handleLibraryInvitationAccept(w, r, user)
+	default:
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+}
+
+func handleLibraryInvitationGet(w http.ResponseWriter, user *db.User) {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.LibrariesCollection)
+	cursor, err := collection.Find(context.TODO(), bson.D{{"invitations.email", strings.ToLower(user.Email)}})
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.TODO())
+
+	invitations := []libraryInvitation{}
+	for cursor.Next(context.TODO()) {
+		var library db.Library
+		err = cursor.Decode(&library)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, libraryService, user.Email, err.Error())
+			WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+			return
+		}
+		for _, invitation := range library.Invitations {
+			if strings.EqualFold(invitation.Email, user.Email) && !isInvitationExpired(invitation) {
+				invitations = append(invitations, toLibraryInvitation(library, invitation, true))
+			}
+		}
+	}
+
+	js, _ := json.Marshal(libraryInvitations{InvitationList: invitations})
+	w.Write(js)
+}
+
+// handleLibraryInvitationAccept makes user a member of the library, the invitation should be for the email of user
+func handleLibraryInvitationAccept(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request invitationAcceptRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.LibrariesCollection)
+	var library db.Library
+	err = collection.FindOne(context.TODO(), bson.D{{"invitations.token", request.Token}}).Decode(&library)
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	var invitation *db.LibraryInvitation
+	for i := range library.Invitations {
+		if library.Invitations[i].Token == request.Token && len(request.Token) > 0 {
+			invitation = &library.Invitations[i]
+		}
+	}
+	if invitation == nil || !strings.EqualFold(invitation.Email, user.Email) || isInvitationExpired(*invitation) {
+		log.Printf(errLogTemplate, errLogNotFound, libraryService, user.Email, "Invitation not found.")
+		WriteErrorOnResponse(errInvitationNotFound, &w, http.StatusNotFound)
+		return
+	}
+
+	update := bson.D{
+		{"$pull", bson.D{
+			{"invitations", bson.D{{"token", invitation.Token}}},
+		}},
+	}
+	if findLibraryMember(&library, user.ID) == nil {
+		member := db.LibraryMember{
+			UserID:   user.ID,
+			Email:    user.Email,
+			Role:     invitation.Role,
+			JoinDate: time.Now(),
+		}
+		library.Members = append(library.Members, member)
+		update = append(update, bson.E{"$push", bson.D{{"members", member}}})
+	}
+	_, err = collection.UpdateOne(context.TODO(), bson.D{{"id", library.ID}}, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(toUserLibrary(library, user.ID))
+	w.Write(js)
+}
+
+// handleLibraryImageGet lists the images of library or serves one of them, every member can view them
+func handleLibraryImageGet(w http.ResponseWriter, r *http.Request, user *db.User) {
+	library := getUserLibrary(w, user, r.FormValue("library"), db.LibraryRoleViewer)
+	if library == nil {
+		return
+	}
+
+	images, err := getLibraryImages(library)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, imageGetService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	if len(r.FormValue("id")) == 0 {
+		SetJsonContentType(w)
+		imList := []libraryImage{}
+		for _, img := range images {
+			userImage := toUserImage(img.image)
+			userImage.URL = getLibraryImageURL(library.ID, img.image.ID, img.image.Hash, false)
+			userImage.ThumbnailURL = getLibraryImageURL(library.ID, img.image.ID, img.image.ThumbnailHash, true)
+			imList = append(imList, libraryImage{UserImage: userImage, Uploader: img.uploader.ID})
+		}
+		js, _ := json.Marshal(libraryImages{ImageList: imList})
+		w.Write(js)
+		return
+	}
+
+	for _, img := range images {
+		if img.image.ID == r.FormValue("id") {
+			// the files of image are kept in the directories of its uploader and it is rendered with the
+			// settings of its uploader
+			serveUserImage(w, r, img.uploader, img.image, user.Email)
+			return
+		}
+	}
+	log.Printf(errLogTemplate, errLogNotFound, imageGetService, user.Email, r.FormValue("id"))
+	WriteErrorOnResponse(errNotFound, &w, http.StatusNotFound)
+}
+
+// handleLibraryImageDel removes images from the library, contributors can only remove the images they added
+func handleLibraryImageDel(w http.ResponseWriter, user *db.User, libraryID string, imageIds []string) {
+	library := getUserLibrary(w, user, libraryID, db.LibraryRoleContributor)
+	if library == nil {
+		return
+	}
+	isOwner := getLibraryRole(library, user.ID) == db.LibraryRoleOwner
+
+	deleteRequestSet := make(map[string]bool)
+	for _, imgID := range imageIds {
+		deleteRequestSet[imgID] = true
+	}
+	removedIds := []string{}
+	for _, img := range library.Images {
+		if !deleteRequestSet[img.ImageID] {
+			continue
+		}
+		if !isOwner && img.UploaderID != user.ID {
+			log.Printf(errLogTemplate, errLogValidation, imageDeleteService, user.Email, "Image of another member.")
+			WriteErrorOnResponse(errLibraryPermission, &w, http.StatusForbidden)
+			return
+		}
+		removedIds = append(removedIds, img.ImageID)
+	}
+
+	// the images stay in the libraries of their uploaders
+	err := updateLibrary(library.ID, bson.D{{"$pull", bson.D{{"images", bson.D{{"imageid", bson.D{{"$in", removedIds}}}}}}}})
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, imageDeleteService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(ImageDeleteResponse{
+		NumberDeleted: len(removedIds),
+	})
+	w.Write(js)
+}
+
+// getUserLibrary loads the library and makes sure user has at least the role in it, otherwise appropriate
+// response is written to output and nil is returned
+func getUserLibrary(w http.ResponseWriter, user *db.User, libraryID string, minRole string) *db.Library {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return nil
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.LibrariesCollection)
+	var library db.Library
+	err = collection.FindOne(context.TODO(), bson.D{{"id", libraryID}}).Decode(&library)
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, libraryService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return nil
+	}
+
+	// the libraries user is not a member of are not revealed
+	role := getLibraryRole(&library, user.ID)
+	if err == mongo.ErrNoDocuments || len(role) == 0 {
+		log.Printf(errLogTemplate, errLogNotFound, libraryService, user.Email, libraryID)
+		WriteErrorOnResponse(errLibraryNotFound, &w, http.StatusNotFound)
+		return nil
+	}
+	if libraryRoleRanks[role] < libraryRoleRanks[minRole] {
+		log.Printf(errLogTemplate, errLogValidation, libraryService, user.Email, "Role "+role+" is not enough.")
+		WriteErrorOnResponse(errLibraryPermission, &w, http.StatusForbidden)
+		return nil
+	}
+	return &library
+}
+
+// getLibraryImages returns the images of library that are still in the libraries of their uploaders
+func getLibraryImages(library *db.Library) ([]libraryImageInfo, error) {
+	uploaderIds := []string{}
+	for _, img := range library.Images {
+		uploaderIds = append(uploaderIds, img.UploaderID)
+	}
+	if len(uploaderIds) == 0 {
+		return []libraryImageInfo{}, nil
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		return nil, err
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	cursor, err := collection.Find(context.TODO(), bson.D{{"id", bson.D{{"$in", uploaderIds}}}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	uploaders := make(map[string]*db.User)
+	uploaderImages := make(map[string]db.ImageInfo)
+	for cursor.Next(context.TODO()) {
+		var uploader db.User
+		err = cursor.Decode(&uploader)
+		if err != nil {
+			return nil, err
+		}
+		uploaders[uploader.ID] = &uploader
+		for _, img := range getActiveImages(&uploader) {
+			uploaderImages[uploader.ID+"/"+img.ID] = img
+		}
+	}
+
+	images := []libraryImageInfo{}
+	for _, ref := range library.Images {
+		if img, ok := uploaderImages[ref.UploaderID+"/"+ref.ImageID]; ok {
+			images = append(images, libraryImageInfo{uploader: uploaders[ref.UploaderID], image: img})
+		}
+	}
+	return images, cursor.Err()
+}
+
+// addLibraryImage adds an image of the uploader to the library
+func addLibraryImage(libraryID string, uploaderID string, imageID string) error {
+	return updateLibrary(libraryID, bson.D{
+		{"$push", bson.D{
+			{"images", db.LibraryImage{
+				ImageID:    imageID,
+				UploaderID: uploaderID,
+				AddDate:    time.Now(),
+			}},
+		}},
+	})
+}
+
+// removeImagesFromLibraries removes the images of user from all libraries they are added to
+func removeImagesFromLibraries(userID string, imageIds []string) error {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		return err
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.LibrariesCollection)
+	filter := bson.D{{"images.uploaderid", userID}}
+	update := bson.D{
+		{"$pull", bson.D{
+			{"images", bson.D{
+				{"uploaderid", userID},
+				{"imageid", bson.D{{"$in", imageIds}}},
+			}},
+		}},
+	}
+	_, err = collection.UpdateMany(context.TODO(), filter, update)
+	return err
+}
+
+func updateLibrary(libraryID string, update bson.D, opts ...*options.UpdateOptions) error {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		return err
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.LibrariesCollection)
+	_, err = collection.UpdateOne(context.TODO(), bson.D{{"id", libraryID}}, update, opts...)
+	return err
+}
+
+// getLibraryRole returns the role of user in the library or an empty string if user is not a member
+func getLibraryRole(library *db.Library, userID string) string {
+	member := findLibraryMember(library, userID)
+	if member == nil {
+		return ""
+	}
+	return member.Role
+}
+
+func findLibraryMember(library *db.Library, userID string) *db.LibraryMember {
+	for i := range library.Members {
+		if library.Members[i].UserID == userID {
+			return &library.Members[i]
+		}
+	}
+	return nil
+}
+
+func countLibraryOwners(library *db.Library) int {
+	owners := 0
+	for _, member := range library.Members {
+		if member.Role == db.LibraryRoleOwner {
+			owners++
+		}
+	}
+	return owners
+}
+
+func isInvitationExpired(invitation db.LibraryInvitation) bool {
+	return time.Since(invitation.CreationDate) > libraryInvitationRetention
+}
+
+func getLibraryImageURL(libraryID string, imageID string, version string, isThumbnail bool) string {
+	query := url.Values{}
+	query.Set("library", libraryID)
+	query.Set("id", imageID)
+	if isThumbnail {
+		query.Set("thumbnail", "1")
+	}
+	if len(version) > 0 {
+		query.Set("v", version)
+	}
+	return "/images?" + query.Encode()
+}
+
+// toUserLibrary converts the library for the member with the id, only owners see the pending invitations
+func toUserLibrary(library db.Library, userID string) userLibrary {
+	role := getLibraryRole(&library, userID)
+	userLib := userLibrary{
+		ID:           library.ID,
+		Name:         library.Name,
+		Role:         role,
+		Members:      []libraryMember{},
+		ImageCount:   len(library.Images),
+		CreationDate: library.CreationDate,
+	}
+	for _, member := range library.Members {
+		userLib.Members = append(userLib.Members, libraryMember{
+			UserID:   member.UserID,
+			Email:    member.Email,
+			Role:     member.Role,
+			JoinDate: member.JoinDate,
+		})
+	}
+	if role == db.LibraryRoleOwner {
+		userLib.Invitations = []libraryInvitation{}
+		for _, invitation := range library.Invitations {
+			if !isInvitationExpired(invitation) {
+				userLib.Invitations = append(userLib.Invitations, toLibraryInvitation(library, invitation, false))
+			}
+		}
+	}
+	return userLib
+}
+
+// toLibraryInvitation converts the invitation, the token is only given to the invited user
+func toLibraryInvitation(library db.Library, invitation db.LibraryInvitation, withToken bool) libraryInvitation {
+	result := libraryInvitation{
+		Library:      library.ID,
+		LibraryName:  library.Name,
+		Email:        invitation.Email,
+		Role:         invitation.Role,
+		InvitedBy:    invitation.InvitedBy,
+		CreationDate: invitation.CreationDate,
+	}
+	if withToken {
+		result.Token = invitation.Token
+	}
+	return result
+}
@@ -0,0 +1,265 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/matba/slyde-server/internals/config"
+	"github.com/matba/slyde-server/internals/db"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const mailInboxService = "MAIL_INBOX"
+const inboxTokenLength = 12
+const maxAllowedSenders = 50
+
+// HandleMailInbox handles API calls for the email addresses photos can be sent to
+func HandleMailInbox(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	log.Printf("Incoming call for mail inboxes")
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, mailInboxService)
+	if err != nil {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeMailInboxes(w, user)
+	case "POST":
+		handleMailInboxPost(w, r, user)
+	case "DELETE":
+		handleMailInboxDel(w, r, user)
+	default:
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+}
+
+// HandleMailSenders replaces the email addresses that can send photos to the inboxes of user
+func HandleMailSenders(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	if r.Method != "PUT" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, mailInboxService)
+	if err != nil {
+		return
+	}
+
+	var request mailSendersRequest
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, mailInboxService, email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+	if len(request.Senders) > maxAllowedSenders {
+		log.Printf(errLogTemplate, errLogValidation, mailInboxService, email, "Too many senders.")
+		WriteErrorOnResponse(errInvalidMailSender, &w, http.StatusBadRequest)
+		return
+	}
+	senders := []string{}
+	added := make(map[string]bool)
+	for _, sender := range request.Senders {
+		sender = strings.ToLower(strings.TrimSpace(sender))
+		if matched, _ := regexp.MatchString(emailRegex, sender); !matched {
+			log.Printf(errLogTemplate, errLogValidation, mailInboxService, email, sender)
+			WriteErrorOnResponse(errInvalidMailSender, &w, http.StatusBadRequest)
+			return
+		}
+		if !added[sender] {
+			senders = append(senders, sender)
+			added[sender] = true
+		}
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, mailInboxService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"allowedsenders", senders},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, mailInboxService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	user.AllowedSenders = senders
+	writeMailInboxes(w, user)
+}
+
+func writeMailInboxes(w http.ResponseWriter, user *db.User) {
+	inboxes := []userMailInbox{}
+	for _, inbox := range user.Inboxes {
+		inboxes = append(inboxes, toUserMailInbox(inbox))
+	}
+	senders := user.AllowedSenders
+	if senders == nil {
+		senders = []string{}
+	}
+	js, _ := json.Marshal(userMailInboxes{
+		InboxList: inboxes,
+		Senders:   senders,
+	})
+	w.Write(js)
+}
+
+// handleMailInboxPost creates a new secret address for the images of user or for an album
+func handleMailInboxPost(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request mailInboxRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, mailInboxService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+	if len(request.AlbumID) > 0 && findUserAlbum(user, request.AlbumID) == nil {
+		log.Printf(errLogTemplate, errLogNotFound, mailInboxService, user.Email, request.AlbumID)
+		WriteErrorOnResponse(errAlbumNotFound, &w, http.StatusNotFound)
+		return
+	}
+
+	token, err := generateInboxToken()
+	if err != nil {
+		log.Printf(errLogTemplate, errLogValidation, mailInboxService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+	id, _ := uuid.NewUUID()
+	inbox := db.MailInbox{
+		ID:           id.String(),
+		Token:        token,
+		AlbumID:      request.AlbumID,
+		CreationDate: time.Now(),
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, mailInboxService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}}
+	update := bson.D{
+		{"$push", bson.D{
+			{"inboxes", inbox},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, mailInboxService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(toUserMailInbox(inbox))
+	w.Write(js)
+}
+
+// handleMailInboxDel revokes the addresses, the emails sent to them are rejected afterwards
+func handleMailInboxDel(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request mailInboxDeleteRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, mailInboxService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	deleteRequestSet := make(map[string]bool)
+	for _, inboxID := range request.InboxIds {
+		deleteRequestSet[inboxID] = true
+	}
+	deletedInboxes := []string{}
+	for _, inbox := range user.Inboxes {
+		if deleteRequestSet[inbox.ID] {
+			deletedInboxes = append(deletedInboxes, inbox.ID)
+		}
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, mailInboxService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}}
+	update := bson.D{
+		{"$pull", bson.D{
+			{"inboxes", bson.D{
+				{"id", bson.D{
+					{"$in", deletedInboxes},
+				}},
+			}},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, mailInboxService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(mailInboxDeleteResponse{
+		NumberDeleted: len(deletedInboxes),
+	})
+	w.Write(js)
+}
+
+// generateInboxToken creates the local part of an inbox address, it is lower case since some mail servers
+// do not keep the case of addresses
+func generateInboxToken() (string, error) {
+	token := make([]byte, inboxTokenLength)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+func getInboxAddress(inbox db.MailInbox) string {
+	return inbox.Token + "@" + config.GetServerConfig().SMTP.Domain
+}
+
+func toUserMailInbox(inbox db.MailInbox) userMailInbox {
+	return userMailInbox{
+		ID:           inbox.ID,
+		Address:      getInboxAddress(inbox),
+		AlbumID:      inbox.AlbumID,
+		CreationDate: inbox.CreationDate,
+	}
+}
@@ -0,0 +1,330 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/matba/slyde-server/internals/config"
+	"github.com/matba/slyde-server/internals/db"
+	"github.com/matba/slyde-server/internals/email"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const mailReceiverService = "MAIL_RECEIVER"
+const maxMailRecipients = 10
+const maxMailPartDepth = 5
+const mailTimeout = time.Minute
+const defaultMailImageName = "email-photo"
+
+// startMailReceiver runs the SMTP receiver that adds the photos attached to emails to the inboxes of users,
+// it does nothing if the receiver is not enabled
+func startMailReceiver() {
+	smtpConfig := config.GetServerConfig().SMTP
+	if !smtpConfig.Enabled {
+		return
+	}
+	if len(smtpConfig.Domain) == 0 {
+		log.Printf(errLogTemplate, errLogValidation, mailReceiverService, "", "The domain of inboxes is not set.")
+		return
+	}
+
+	server := smtp.NewServer(&mailBackend{})
+	server.Addr = smtpConfig.Address
+	server.Domain = smtpConfig.Domain
+	server.MaxMessageBytes = smtpConfig.MaxMessageBytes
+	server.MaxRecipients = maxMailRecipients
+	server.ReadTimeout = mailTimeout
+	server.WriteTimeout = mailTimeout
+	// the receiver only accepts mail for its own inboxes, so it never relays and does not need authentication.
+	// SPF and DKIM are not verified, so the allowed senders and the From header can be forged and the random
+	// token of inbox is the only secret that keeps others from adding photos.
+	server.AuthDisabled = true
+
+	log.Printf("Receiving emails for %s on %s", smtpConfig.Domain, smtpConfig.Address)
+	err := server.ListenAndServe()
+	if err != nil {
+		log.Printf(errLogTemplate, errLogIoError, mailReceiverService, "", err.Error())
+	}
+}
+
+// mailBackend creates the sessions of SMTP connections
+type mailBackend struct{}
+
+func (b *mailBackend) Login(state *smtp.ConnectionState, username string, password string) (smtp.Session, error) {
+	return nil, smtp.ErrAuthUnsupported
+}
+
+func (b *mailBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	return &mailSession{}, nil
+}
+
+// mailRecipient is an inbox the email is delivered to
+type mailRecipient struct {
+	userID string
+	inbox  db.MailInbox
+}
+
+// mailSession keeps the envelope of the email that is being received
+type mailSession struct {
+	from       string
+	recipients []mailRecipient
+}
+
+func (s *mailSession) Reset() {
+	s.from = ""
+	s.recipients = nil
+}
+
+func (s *mailSession) Logout() error {
+	return nil
+}
+
+func (s *mailSession) Mail(from string, opts smtp.MailOptions) error {
+	s.from = strings.ToLower(from)
+	return nil
+}
+
+// Rcpt accepts the recipient if it is an inbox and the sender is allowed by its user, the emails of other
+// senders are rejected so no reply is sent to addresses that may be forged
+func (s *mailSession) Rcpt(to string) error {
+	separator := strings.LastIndex(to, "@")
+	if separator < 0 || !strings.EqualFold(to[separator+1:], config.GetServerConfig().SMTP.Domain) {
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: errMailboxNotFound}
+	}
+
+	user, inbox, err := findMailInbox(strings.ToLower(to[:separator]))
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, mailReceiverService, s.from, err.Error())
+		return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: errInternalError}
+	}
+	if inbox == nil {
+		log.Printf(errLogTemplate, errLogNotFound, mailReceiverService, s.from, to)
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: errMailboxNotFound}
+	}
+	if !isAllowedSender(user, s.from) {
+		log.Printf(errLogTemplate, errLogValidation, mailReceiverService, s.from, "Sender is not allowed.")
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: errMailSenderNotAllowed}
+	}
+
+	s.recipients = append(s.recipients, mailRecipient{userID: user.ID, inbox: *inbox})
+	return nil
+}
+
+// Data adds the photos attached to the email to each recipient inbox and sends the sender one summary of all
+// inboxes. The email is accepted even if it could not be added to some inboxes, so the others do not get it
+// twice when the sender retries.
+func (s *mailSession) Data(r io.Reader) error {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	// the allowed sender is checked on the envelope, the From header clients show must be the same address
+	message, err := mail.ReadMessage(bytes.NewReader(content))
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, mailReceiverService, s.from, err.Error())
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 6, 0}, Message: errUnsupportedMail}
+	}
+	fromAddress, err := mail.ParseAddress(message.Header.Get("From"))
+	if err != nil || !strings.EqualFold(fromAddress.Address, s.from) {
+		log.Printf(errLogTemplate, errLogValidation, mailReceiverService, s.from, "From header does not match the sender.")
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: errMailFromMismatch}
+	}
+
+	var summary *bulkImportResponse
+	for _, recipient := range s.recipients {
+		result, err := ingestMailAttachments(recipient, content)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogImageUploadError, mailReceiverService, s.from, err.Error())
+			continue
+		}
+		summary = mergeMailResults(summary, result)
+	}
+	if summary == nil {
+		return nil
+	}
+
+	err = email.GetEmailSender().SendEmail(s.from, mailSummarySubject, getMailSummary(summary))
+	if err != nil {
+		log.Printf(errLogTemplate, errLogEmailFailure, mailReceiverService, s.from, err.Error())
+	}
+	return nil
+}
+
+// ingestMailAttachments adds the images attached to the message to the images of recipient like a bulk
+// import and adds the added images to the album of inbox
+func ingestMailAttachments(recipient mailRecipient, content []byte) (*bulkImportResponse, error) {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		return nil, err
+	}
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+
+	var user db.User
+	err = collection.FindOne(context.TODO(), bson.D{{"id", recipient.userID}}).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+
+	importer := bulkImporter{
+		user:       &user,
+		collection: collection,
+		response:   bulkImportResponse{Results: []bulkImportResult{}},
+	}
+	message, err := mail.ReadMessage(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	err = importMailPart(&importer, message.Header.Get("Content-Type"), message.Header.Get("Content-Disposition"),
+		message.Header.Get("Content-Transfer-Encoding"), message.Body, 0)
+	if err != nil {
+		importer.addFailure("", errUnsupportedMail)
+	}
+
+	imageIDs := []string{}
+	for _, result := range importer.response.Results {
+		if result.Success {
+			imageIDs = append(imageIDs, result.Image.ID)
+		}
+	}
+	if len(recipient.inbox.AlbumID) > 0 && len(imageIDs) > 0 {
+		err = addImagesToAlbum(collection, &user, recipient.inbox.AlbumID, imageIDs)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotUpdateTheDb, mailReceiverService, user.Email, err.Error())
+		}
+	}
+	return &importer.response, nil
+}
+
+// importMailPart imports the part if it is an image, or the parts in it if it is a multipart
+func importMailPart(importer *bulkImporter, contentType string, disposition string, encoding string, body io.Reader, depth int) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// parts without a valid type are text
+		return nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxMailPartDepth {
+			return errors.New("Too deeply nested message")
+		}
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = importMailPart(importer, part.Header.Get("Content-Type"), part.Header.Get("Content-Disposition"),
+				part.Header.Get("Content-Transfer-Encoding"), part, depth+1)
+			part.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if !strings.HasPrefix(mediaType, "image/") {
+		return nil
+	}
+
+	fileName := params["name"]
+	if _, dispositionParams, err := mime.ParseMediaType(disposition); err == nil && len(dispositionParams["filename"]) > 0 {
+		fileName = dispositionParams["filename"]
+	}
+	// the names of attachments may be encoded like the other headers
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(fileName); err == nil {
+		fileName = decoded
+	}
+	if len(fileName) == 0 {
+		fileName = defaultMailImageName
+	}
+
+	// quoted printable parts are decoded by the multipart reader
+	if strings.EqualFold(strings.TrimSpace(encoding), "base64") {
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	importer.importFile(fileName, body)
+	return nil
+}
+
+// mergeMailResults combines the results of the same email in several inboxes, the attachments are in the same order
+// in all of them and an attachment is only reported as added if it was added to every inbox
+func mergeMailResults(summary *bulkImportResponse, result *bulkImportResponse) *bulkImportResponse {
+	if summary == nil {
+		return result
+	}
+	for i, fileResult := range result.Results {
+		if i < len(summary.Results) && summary.Results[i].Success && !fileResult.Success {
+			summary.Results[i] = fileResult
+			summary.Succeeded--
+			summary.Failed++
+		}
+	}
+	return summary
+}
+
+// findMailInbox returns the user that has the inbox with the token and the inbox, the inbox is nil if there
+// is no such inbox
+func findMailInbox(token string) (*db.User, *db.MailInbox, error) {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		return nil, nil, err
+	}
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+
+	var user db.User
+	err = collection.FindOne(context.TODO(), bson.D{{"inboxes.token", token}}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range user.Inboxes {
+		if user.Inboxes[i].Token == token {
+			return &user, &user.Inboxes[i], nil
+		}
+	}
+	return nil, nil, nil
+}
+
+func isAllowedSender(user *db.User, sender string) bool {
+	for _, allowed := range user.AllowedSenders {
+		if strings.EqualFold(allowed, sender) {
+			return true
+		}
+	}
+	return false
+}
+
+// getMailSummary describes which attachments were added and why the others were not
+func getMailSummary(result *bulkImportResponse) string {
+	if len(result.Results) == 0 {
+		return mailSummaryNoPhotos
+	}
+	var summary strings.Builder
+	fmt.Fprintf(&summary, mailSummaryAdded, result.Succeeded, len(result.Results))
+	for _, fileResult := range result.Results {
+		if !fileResult.Success {
+			fmt.Fprintf(&summary, mailSummaryFailure, fileResult.File, fileResult.Error)
+		}
+	}
+	return summary.String()
+}
@@ -0,0 +1,211 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/matba/slyde-server/internals/config"
+	"github.com/matba/slyde-server/internals/db"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+const memoriesService = "MEMORIES"
+const memoriesDateLayout = "2006-01-02"
+const maxMemoriesWindowDays = 30
+
+// HandleMemories returns the images taken around the same calendar day in previous years grouped by year,
+// the most recent year first. The day is today in the timezone of user unless a date is requested. The
+// response only changes with the day, so it can be cached until the next midnight of user.
+func HandleMemories(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	if r.Method != "GET" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, memoriesService)
+	if err != nil {
+		return
+	}
+
+	location, day, window, err := parseMemoriesRequest(r, user)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogValidation, memoriesService, email, err.Error())
+		WriteErrorOnResponse(errInvalidMemoriesRequest, &w, http.StatusBadRequest)
+		return
+	}
+
+	response := memoriesResponse{
+		Date:     day.Format(memoriesDateLayout),
+		Timezone: location.String(),
+		Window:   window,
+		Years:    []memoryYear{},
+	}
+	hasher := sha256.New()
+	fmt.Fprintf(hasher, "%s/%s/%d", response.Date, response.Timezone, window)
+	for _, year := range getMemories(user, day, window, location) {
+		yearJSON := memoryYear{
+			Year:     year.year,
+			YearsAgo: day.Year() - year.year,
+			Images:   []UserImage{},
+		}
+		for _, img := range year.images {
+			yearJSON.Images = append(yearJSON.Images, toUserImage(img))
+			fmt.Fprintf(hasher, "/%s:%s", img.ID, img.Hash)
+		}
+		response.Years = append(response.Years, yearJSON)
+	}
+
+	etag := hex.EncodeToString(hasher.Sum(nil))
+	w.Header().Set("ETag", `"`+etag+`"`)
+	nextDay := time.Date(day.Year(), day.Month(), day.Day()+1, 0, 0, 0, 0, location)
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", getSecondsUntil(nextDay)))
+	if r.Header.Get("If-None-Match") == `"`+etag+`"` {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	js, _ := json.Marshal(response)
+	w.Write(js)
+}
+
+// parseMemoriesRequest reads the timezone, the day and the window of memories from request
+func parseMemoriesRequest(r *http.Request, user *db.User) (*time.Location, time.Time, int, error) {
+	location, err := getUserLocation(user, r.FormValue("tz"))
+	if err != nil {
+		return nil, time.Time{}, 0, err
+	}
+
+	day := getUserToday(location)
+	if dateStr := r.FormValue("date"); len(dateStr) > 0 {
+		day, err = time.ParseInLocation(memoriesDateLayout, dateStr, location)
+		if err != nil {
+			return nil, time.Time{}, 0, err
+		}
+	}
+
+	window := config.GetServerConfig().MemoriesWindowDays
+	if windowStr := r.FormValue("window"); len(windowStr) > 0 {
+		window, err = strconv.Atoi(windowStr)
+		if err != nil || window < 0 || window > maxMemoriesWindowDays {
+			return nil, time.Time{}, 0, errors.New("Invalid window " + windowStr)
+		}
+	}
+	return location, day, window, nil
+}
+
+// getUserLocation returns the requested timezone, or the timezone of user if it is not requested. UTC is
+// used if the user has not set a timezone.
+func getUserLocation(user *db.User, timezone string) (*time.Location, error) {
+	if len(timezone) == 0 {
+		timezone = user.Timezone
+	}
+	return time.LoadLocation(timezone)
+}
+
+// getUserToday returns the start of today in the location
+func getUserToday(location *time.Location) time.Time {
+	now := time.Now().In(location)
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+}
+
+type memoryImages struct {
+	year   int
+	images []db.ImageInfo
+}
+
+// getMemories returns the active images of user whose date is at most window days away from the calendar day
+// in a previous year, grouped by that year with the most recent year first and the images in the order of
+// their dates
+func getMemories(user *db.User, day time.Time, window int, location *time.Location) []memoryImages {
+	years := make(map[int][]db.ImageInfo)
+	for _, img := range getActiveImages(user) {
+		if !img.IsReady() || img.NeverShow {
+			continue
+		}
+		imageDay := getMemoryDate(img, location)
+		// the window may cross the new year, so the anniversaries in the years around the image are checked
+		for year := imageDay.Year() - 1; year <= imageDay.Year()+1; year++ {
+			if year >= day.Year() {
+				continue
+			}
+			anniversary := time.Date(year, day.Month(), day.Day(), 0, 0, 0, 0, location)
+			if math.Abs(math.Round(imageDay.Sub(anniversary).Hours()/24)) <= float64(window) {
+				years[year] = append(years[year], img)
+				break
+			}
+		}
+	}
+
+	memories := []memoryImages{}
+	for year, images := range years {
+		sort.SliceStable(images, func(i, j int) bool {
+			return getImageDate(images[i]).Before(getImageDate(images[j]))
+		})
+		memories = append(memories, memoryImages{year: year, images: images})
+	}
+	sort.Slice(memories, func(i, j int) bool {
+		return memories[i].year > memories[j].year
+	})
+	return memories
+}
+
+// getMemoryDate returns the calendar day the image was taken in the location. The capture date is already
+// the local time of the photo, the upload date is converted to the location.
+func getMemoryDate(img db.ImageInfo, location *time.Location) time.Time {
+	date := img.UploadDate.In(location)
+	if !img.CaptureDate.IsZero() {
+		date = img.CaptureDate.UTC()
+	}
+	return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, location)
+}
+
+// getMemoryImages returns the images of memories of today in the timezone, or in the timezone of user if it is
+// empty, as a flat list with the most recent year first
+func getMemoryImages(user *db.User, timezone string) []db.ImageInfo {
+	location, err := getUserLocation(user, timezone)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogValidation, memoriesService, user.Email, err.Error())
+		location = time.UTC
+	}
+	images := []db.ImageInfo{}
+	for _, year := range getMemories(user, getUserToday(location), config.GetServerConfig().MemoriesWindowDays, location) {
+		images = append(images, year.images...)
+	}
+	return images
+}
+
+// readCaptureDate reads the date the photo was taken from its EXIF data, zero is returned if it does not have
+// one. The local time of photo is returned as UTC since EXIF does not have the timezone.
+func readCaptureDate(file io.Reader) time.Time {
+	metadata, err := exif.Decode(file)
+	if err != nil {
+		return time.Time{}
+	}
+	taken, err := metadata.DateTime()
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Date(taken.Year(), taken.Month(), taken.Day(), taken.Hour(), taken.Minute(), taken.Second(), 0, time.UTC)
+}
+
+func getSecondsUntil(t time.Time) int64 {
+	seconds := int64(time.Until(t).Seconds())
+	if seconds < 0 {
+		return 0
+	}
+	return seconds
+}
@@ -0,0 +1,297 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/matba/slyde-server/internals/db"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const maxOverlays = 4
+const maxOverlayText = 200
+const defaultOverlayFontSize = 32
+const minOverlayFontSize = 8
+const maxOverlayFontSize = 200
+const defaultOverlayColor = "#ffffff"
+const overlayDateLayout = "2 January 2006"
+const overlayShadowOpacity = 0.6
+const overlayEllipsis = "…"
+
+// the overlays are drawn with the Go font that is compiled into the server, so rendering does not depend on
+// the fonts installed on the machine
+var overlayFont *opentype.Font
+var overlayFontErr error
+var overlayFontOnce sync.Once
+
+// renderedOverlay is an overlay with the text it shows on a specific image
+type renderedOverlay struct {
+	settings db.Overlay
+	text     string
+}
+
+// parseOverlays validates the requested overlays and fills in the defaults of the settings that are not sent
+func parseOverlays(requested []userOverlay) ([]db.Overlay, error) {
+	if len(requested) > maxOverlays {
+		return nil, errors.New("Too many overlays")
+	}
+	overlays := []db.Overlay{}
+	for _, request := range requested {
+		overlay := db.Overlay{
+			Type:     request.Type,
+			Text:     strings.TrimSpace(request.Text),
+			Position: request.Position,
+			FontSize: request.FontSize,
+			Color:    request.Color,
+			Shadow:   request.Shadow,
+			Opacity:  1,
+		}
+		if !isOverlayType(overlay.Type) {
+			return nil, errors.New("Unknown overlay type " + overlay.Type)
+		}
+		if len(overlay.Text) > maxOverlayText || (overlay.Type == db.OverlayTypeWatermark && len(overlay.Text) == 0) {
+			return nil, errors.New("Invalid overlay text")
+		}
+		if overlay.Type != db.OverlayTypeWatermark {
+			overlay.Text = ""
+		}
+		if len(overlay.Position) == 0 {
+			overlay.Position = db.OverlayPositionBottomRight
+		}
+		if !isOverlayPosition(overlay.Position) {
+			return nil, errors.New("Unknown overlay position " + overlay.Position)
+		}
+		if overlay.FontSize == 0 {
+			overlay.FontSize = defaultOverlayFontSize
+		}
+		if overlay.FontSize < minOverlayFontSize || overlay.FontSize > maxOverlayFontSize {
+			return nil, fmt.Errorf("Invalid overlay font size %d", overlay.FontSize)
+		}
+		if len(overlay.Color) == 0 {
+			overlay.Color = defaultOverlayColor
+		}
+		textColor, err := parseHexColor(overlay.Color)
+		if err != nil {
+			return nil, err
+		}
+		overlay.Color = toHexColor(int(textColor.R), int(textColor.G), int(textColor.B))
+		if request.Opacity != nil {
+			if *request.Opacity < 0 || *request.Opacity > 1 {
+				return nil, fmt.Errorf("Invalid overlay opacity %f", *request.Opacity)
+			}
+			overlay.Opacity = *request.Opacity
+		}
+		overlays = append(overlays, overlay)
+	}
+	return overlays, nil
+}
+
+func isOverlayType(overlayType string) bool {
+	return overlayType == db.OverlayTypeDate || overlayType == db.OverlayTypeCaption ||
+		overlayType == db.OverlayTypeAlbum || overlayType == db.OverlayTypeWatermark
+}
+
+func isOverlayPosition(position string) bool {
+	switch position {
+	case db.OverlayPositionTopLeft, db.OverlayPositionTopCenter, db.OverlayPositionTopRight, db.OverlayPositionCenter,
+		db.OverlayPositionBottomLeft, db.OverlayPositionBottomCenter, db.OverlayPositionBottomRight:
+		return true
+	}
+	return false
+}
+
+// getImageOverlays returns the texts the overlays show on the image, the overlays without a text for the
+// image like the caption of an image without caption are left out. The album overlay shows the album of
+// slideshow if the image is in it, otherwise the first album of image.
+func getImageOverlays(user *db.User, img db.ImageInfo, overlays []db.Overlay, albumID string) []renderedOverlay {
+	rendered := []renderedOverlay{}
+	for _, overlay := range overlays {
+		text := ""
+		switch overlay.Type {
+		case db.OverlayTypeDate:
+			location, err := getUserLocation(user, "")
+			if err != nil {
+				location = time.UTC
+			}
+			text = getMemoryDate(img, location).Format(overlayDateLayout)
+		case db.OverlayTypeCaption:
+			text = strings.Join(strings.Fields(img.Caption), " ")
+		case db.OverlayTypeAlbum:
+			text = getOverlayAlbumName(user, img.ID, albumID)
+		case db.OverlayTypeWatermark:
+			text = overlay.Text
+		}
+		if len(text) > 0 {
+			rendered = append(rendered, renderedOverlay{settings: overlay, text: text})
+		}
+	}
+	return rendered
+}
+
+func getOverlayAlbumName(user *db.User, imageID string, albumID string) string {
+	name := ""
+	for _, album := range user.Albums {
+		for _, id := range album.ImageIDs {
+			if id != imageID {
+				continue
+			}
+			if album.ID == albumID {
+				return album.Name
+			}
+			if len(name) == 0 {
+				name = album.Name
+			}
+		}
+	}
+	return name
+}
+
+// getOverlaysKey identifies the settings and texts of overlays in the keys of variants, so a variant is
+// rendered again when the overlays or the caption of image change
+func getOverlaysKey(overlays []renderedOverlay) string {
+	if len(overlays) == 0 {
+		return ""
+	}
+	hasher := sha256.New()
+	for _, overlay := range overlays {
+		fmt.Fprintf(hasher, "%+v/%s\n", overlay.settings, overlay.text)
+	}
+	return "-o" + hex.EncodeToString(hasher.Sum(nil))[:12]
+}
+
+// getOverlaysVersion returns the version of the image with the overlays drawn on it, it is empty if the
+// version of image is not known
+func getOverlaysVersion(version string, overlays []renderedOverlay) string {
+	if len(version) == 0 {
+		return ""
+	}
+	return version + getOverlaysKey(overlays)
+}
+
+// drawOverlays draws the texts of overlays on a copy of the rendered image
+func drawOverlays(rendered image.Image, overlays []renderedOverlay) (image.Image, error) {
+	if len(overlays) == 0 {
+		return rendered, nil
+	}
+	overlayFontOnce.Do(func() {
+		overlayFont, overlayFontErr = opentype.Parse(goregular.TTF)
+	})
+	if overlayFontErr != nil {
+		return nil, overlayFontErr
+	}
+
+	canvas := imaging.Clone(rendered)
+	for _, overlay := range overlays {
+		face, err := opentype.NewFace(overlayFont, &opentype.FaceOptions{
+			Size:    float64(overlay.settings.FontSize),
+			DPI:     72,
+			Hinting: font.HintingFull,
+		})
+		if err != nil {
+			return nil, err
+		}
+		drawOverlayText(canvas, face, overlay)
+		face.Close()
+	}
+	return canvas, nil
+}
+
+// drawOverlayText draws the text at the position of overlay with a margin of half the font size, the text
+// is shortened if it does not fit in the width of image
+func drawOverlayText(canvas *image.NRGBA, face font.Face, overlay renderedOverlay) {
+	settings := overlay.settings
+	bounds := canvas.Bounds()
+	margin := settings.FontSize / 2
+	text := fitOverlayText(face, overlay.text, bounds.Dx()-2*margin)
+	if len(text) == 0 {
+		return
+	}
+
+	width := font.MeasureString(face, text).Ceil()
+	ascent := face.Metrics().Ascent.Ceil()
+	descent := face.Metrics().Descent.Ceil()
+	x := bounds.Min.X + margin
+	switch settings.Position {
+	case db.OverlayPositionTopCenter, db.OverlayPositionCenter, db.OverlayPositionBottomCenter:
+		x = bounds.Min.X + (bounds.Dx()-width)/2
+	case db.OverlayPositionTopRight, db.OverlayPositionBottomRight:
+		x = bounds.Max.X - margin - width
+	}
+	y := bounds.Min.Y + (bounds.Dy()+ascent-descent)/2
+	switch settings.Position {
+	case db.OverlayPositionTopLeft, db.OverlayPositionTopCenter, db.OverlayPositionTopRight:
+		y = bounds.Min.Y + margin + ascent
+	case db.OverlayPositionBottomLeft, db.OverlayPositionBottomCenter, db.OverlayPositionBottomRight:
+		y = bounds.Max.Y - margin - descent
+	}
+
+	alpha := uint8(math.Round(settings.Opacity * 255))
+	if settings.Shadow {
+		offset := settings.FontSize / 16
+		if offset < 1 {
+			offset = 1
+		}
+		shadow := font.Drawer{
+			Dst:  canvas,
+			Src:  image.NewUniform(color.NRGBA{0, 0, 0, uint8(math.Round(float64(alpha) * overlayShadowOpacity))}),
+			Face: face,
+			Dot:  fixed.P(x+offset, y+offset),
+		}
+		shadow.DrawString(text)
+	}
+	textColor, _ := parseHexColor(settings.Color)
+	textColor.A = alpha
+	drawer := font.Drawer{
+		Dst:  canvas,
+		Src:  image.NewUniform(textColor),
+		Face: face,
+		Dot:  fixed.P(x, y),
+	}
+	drawer.DrawString(text)
+}
+
+// fitOverlayText shortens the text with an ellipsis until it fits in the width, empty is returned if not
+// even the ellipsis fits
+func fitOverlayText(face font.Face, text string, width int) string {
+	if font.MeasureString(face, text).Ceil() <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+		shortened := strings.TrimSpace(string(runes)) + overlayEllipsis
+		if font.MeasureString(face, shortened).Ceil() <= width {
+			return shortened
+		}
+	}
+	return ""
+}
+
+func toUserOverlays(overlays []db.Overlay) []userOverlay {
+	userOverlays := []userOverlay{}
+	for _, overlay := range overlays {
+		opacity := overlay.Opacity
+		userOverlays = append(userOverlays, userOverlay{
+			Type:     overlay.Type,
+			Text:     overlay.Text,
+			Position: overlay.Position,
+			FontSize: overlay.FontSize,
+			Color:    overlay.Color,
+			Shadow:   overlay.Shadow,
+			Opacity:  &opacity,
+		})
+	}
+	return userOverlays
+}
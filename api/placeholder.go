@@ -0,0 +1,266 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/matba/slyde-server/internals/db"
+	"github.com/matba/slyde-server/internals/jobs"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const placeholderService = "PLACEHOLDER"
+const computePlaceholdersJobType = "COMPUTE_PLACEHOLDERS"
+
+// the image is made small before the placeholders are computed, they only keep the coarse structure of image
+const placeholderSampleSize = 32
+const paletteSampleSize = 64
+const paletteSize = 5
+
+// the longer side of image gets more BlurHash components
+const blurHashMajorComponents = 4
+const blurHashMinorComponents = 3
+
+const base83Characters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// imagePlaceholders keeps what clients show while the thumbnail of image is loading
+type imagePlaceholders struct {
+	blurHash     string
+	averageColor string
+	palette      []string
+}
+
+// computeImagePlaceholders computes the BlurHash, the average colour and the dominant colours of image
+func computeImagePlaceholders(img image.Image) imagePlaceholders {
+	xComponents, yComponents := blurHashMajorComponents, blurHashMinorComponents
+	if img.Bounds().Dx() < img.Bounds().Dy() {
+		xComponents, yComponents = blurHashMinorComponents, blurHashMajorComponents
+	}
+	sample := imaging.Resize(img, placeholderSampleSize, placeholderSampleSize, imaging.Box)
+	averageColor, palette := getImageColors(imaging.Resize(img, paletteSampleSize, paletteSampleSize, imaging.Box))
+	return imagePlaceholders{
+		blurHash:     encodeBlurHash(sample, xComponents, yComponents),
+		averageColor: averageColor,
+		palette:      palette,
+	}
+}
+
+// encodeBlurHash encodes the image as described in https://github.com/woltapp/blurhash
+func encodeBlurHash(img *image.NRGBA, xComponents int, yComponents int) string {
+	width := img.Bounds().Dx()
+	height := img.Bounds().Dy()
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1.0
+			}
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(width)) * math.Cos(math.Pi*float64(j*y)/float64(height))
+					offset := img.PixOffset(x, y)
+					for c := 0; c < 3; c++ {
+						factor[c] += basis * sRGBToLinear(img.Pix[offset+c])
+					}
+				}
+			}
+			scale := normalisation / float64(width*height)
+			for c := 0; c < 3; c++ {
+				factor[c] *= scale
+			}
+			factors = append(factors, factor)
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((xComponents-1)+(yComponents-1)*9, 1))
+
+	maximumValue := 1.0
+	if len(factors) > 1 {
+		actualMaximum := 0.0
+		for _, factor := range factors[1:] {
+			for c := 0; c < 3; c++ {
+				actualMaximum = math.Max(actualMaximum, math.Abs(factor[c]))
+			}
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		hash.WriteString(encodeBase83(quantisedMaximum, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	dc := factors[0]
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	for _, factor := range factors[1:] {
+		value := 0
+		for c := 0; c < 3; c++ {
+			quantised := int(math.Max(0, math.Min(18, math.Floor(signPow(factor[c]/maximumValue, 0.5)*9+9.5))))
+			value = value*19 + quantised
+		}
+		hash.WriteString(encodeBase83(value, 2))
+	}
+	return hash.String()
+}
+
+// getImageColors returns the average colour of image and its dominant colours, the most common first. The
+// colours are grouped by their 4 most significant bits and each group is represented by its average.
+func getImageColors(img *image.NRGBA) (string, []string) {
+	type colorBucket struct {
+		count   int
+		r, g, b int
+	}
+	buckets := make(map[int]*colorBucket)
+	var totalR, totalG, totalB, total int
+	for offset := 0; offset+3 < len(img.Pix); offset += 4 {
+		r, g, b := int(img.Pix[offset]), int(img.Pix[offset+1]), int(img.Pix[offset+2])
+		totalR, totalG, totalB = totalR+r, totalG+g, totalB+b
+		total++
+
+		key := (r>>4)<<8 | (g>>4)<<4 | b>>4
+		bucket, ok := buckets[key]
+		if !ok {
+			bucket = &colorBucket{}
+			buckets[key] = bucket
+		}
+		bucket.count++
+		bucket.r, bucket.g, bucket.b = bucket.r+r, bucket.g+g, bucket.b+b
+	}
+	if total == 0 {
+		return "", []string{}
+	}
+
+	sorted := []*colorBucket{}
+	for _, bucket := range buckets {
+		sorted = append(sorted, bucket)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].count != sorted[j].count {
+			return sorted[i].count > sorted[j].count
+		}
+		return toHexColor(sorted[i].r/sorted[i].count, sorted[i].g/sorted[i].count, sorted[i].b/sorted[i].count) <
+			toHexColor(sorted[j].r/sorted[j].count, sorted[j].g/sorted[j].count, sorted[j].b/sorted[j].count)
+	})
+
+	palette := []string{}
+	for i := 0; i < len(sorted) && i < paletteSize; i++ {
+		palette = append(palette, toHexColor(sorted[i].r/sorted[i].count, sorted[i].g/sorted[i].count, sorted[i].b/sorted[i].count))
+	}
+	return toHexColor(totalR/total, totalG/total, totalB/total), palette
+}
+
+// HandleAdminPlaceholders queues computing the missing placeholders of the images of the user with the id
+// or of all users
+func HandleAdminPlaceholders(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	if r.Method != "POST" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	email := GetAdmin(w, r)
+	if email == "" {
+		return
+	}
+	enqueueUserJobs(w, r, email, computePlaceholdersJobType, placeholderService)
+}
+
+// registerPlaceholderJobs registers the handlers of placeholder jobs in the job queue
+func registerPlaceholderJobs() {
+	jobs.GetQueue().RegisterHandler(computePlaceholdersJobType, computePlaceholdersJob)
+}
+
+// computePlaceholdersJob computes the placeholders of the ready images of user that do not have them,
+// the images uploaded before placeholders were introduced get them this way
+func computePlaceholdersJob(job *db.Job) error {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		return err
+	}
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+
+	var user db.User
+	err = collection.FindOne(context.TODO(), bson.D{{"id", job.UserID}}).Decode(&user)
+	if err != nil {
+		return err
+	}
+
+	for _, img := range user.Images {
+		if len(img.BlurHash) > 0 || !img.IsReady() {
+			continue
+		}
+		// an image whose file is missing or broken does not stop the others from getting their placeholders,
+		// the consistency checker reports and repairs such images
+		file, err := os.Open(getUserImagePath(user.ID, img.ID, false))
+		if err != nil {
+			log.Printf(errLogTemplate, errLogIoError, placeholderService, user.ID, err.Error())
+			continue
+		}
+		decoded, _, err := image.Decode(file)
+		file.Close()
+		if err != nil {
+			log.Printf(errLogTemplate, errLogIoError, placeholderService, user.ID,
+				fmt.Sprintf("Cannot decode image %s: %s", img.ID, err.Error()))
+			continue
+		}
+
+		placeholders := computeImagePlaceholders(decoded)
+		filter := bson.D{{"id", user.ID}, {"images.id", img.ID}}
+		update := bson.D{
+			{"$set", bson.D{
+				{"images.$.blurhash", placeholders.blurHash},
+				{"images.$.averagecolor", placeholders.averageColor},
+				{"images.$.palette", placeholders.palette},
+			}},
+		}
+		_, err = collection.UpdateOne(context.TODO(), filter, update)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeBase83(value int, length int) string {
+	encoded := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		encoded[i] = base83Characters[value%83]
+		value /= 83
+	}
+	return string(encoded)
+}
+
+func sRGBToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value float64, exponent float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exponent), value)
+}
+
+func toHexColor(r int, g int, b int) string {
+	return fmt.Sprintf("#%02x%02x%02x", r, g, b)
+}
@@ -0,0 +1,539 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image/color"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/google/uuid"
+	"github.com/matba/slyde-server/internals/db"
+	"github.com/matba/slyde-server/internals/jobs"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const profileService = "DEVICE_PROFILE"
+const renderProfilesJobType = "RENDER_PROFILES"
+const profilePayloadKey = "profile"
+
+const minProfileDimension = 64
+const maxProfileDimension = 7680
+
+// the quality renderings start from, it is lowered step by step until the rendering fits the size limit of profile
+const profileRenderQuality = 90
+const minProfileRenderQuality = 20
+const profileRenderQualityStep = 10
+
+// HandleDeviceProfile handles API calls for the device profiles of user
+func HandleDeviceProfile(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	log.Printf("Incoming call for device profiles")
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, profileService)
+	if err != nil {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		profiles := []userDeviceProfile{}
+		for _, profile := range user.Profiles {
+			profiles = append(profiles, toUserDeviceProfile(profile))
+		}
+		js, _ := json.Marshal(userDeviceProfiles{ProfileList: profiles})
+		w.Write(js)
+	case "POST":
+		handleDeviceProfilePost(w, r, user)
+	case "PUT":
+		handleDeviceProfilePut(w, r, user)
+	case "DELETE":
+		handleDeviceProfileDel(w, r, user)
+	default:
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+}
+
+// handleDeviceProfilePost adds the profile and queues pre-rendering the images of user for it
+func handleDeviceProfilePost(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request deviceProfileRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, profileService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+	if len(request.Name) == 0 || request.Width == 0 || request.Height == 0 {
+		log.Printf(errLogTemplate, errLogMissingField, profileService, user.Email, "Profile name or resolution not provided.")
+		WriteErrorOnResponse(errBadRequest, &w, http.StatusBadRequest)
+		return
+	}
+
+	id, _ := uuid.NewUUID()
+	profile := db.DeviceProfile{
+		ID:           id.String(),
+		Name:         request.Name,
+		Orientation:  db.ProfileOrientationLandscape,
+		Fit:          fitCover,
+		ColorMode:    db.ProfileColorModeColor,
+		CreationDate: time.Now(),
+	}
+	if request.Height > request.Width {
+		profile.Orientation = db.ProfileOrientationPortrait
+	}
+	if !updateDeviceProfileFromRequest(w, user, &profile, request) {
+		return
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, profileService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}}
+	update := bson.D{
+		{"$push", bson.D{
+			{"profiles", profile},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, profileService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	writeDeviceProfileResponse(w, user, profile)
+}
+
+// handleDeviceProfilePut updates the profile, the renderings of its previous settings are removed and the
+// images of user are rendered again
+func handleDeviceProfilePut(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request deviceProfileRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, profileService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	profile := findDeviceProfile(user, request.ID)
+	if profile == nil {
+		log.Printf(errLogTemplate, errLogNotFound, profileService, user.Email, request.ID)
+		WriteErrorOnResponse(errDeviceProfileNotFound, &w, http.StatusNotFound)
+		return
+	}
+	previous := *profile
+	if len(request.Name) > 0 {
+		profile.Name = request.Name
+	}
+	if !updateDeviceProfileFromRequest(w, user, profile, request) {
+		return
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, profileService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}, {"profiles.id", profile.ID}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"profiles.$", *profile},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, profileService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	removeProfileRenderings(user, previous)
+	writeDeviceProfileResponse(w, user, *profile)
+}
+
+func handleDeviceProfileDel(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request deviceProfileDeleteRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, profileService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	deleteRequestSet := make(map[string]bool)
+	for _, profileID := range request.ProfileIds {
+		deleteRequestSet[profileID] = true
+	}
+	deletedProfiles := []db.DeviceProfile{}
+	deletedIDs := []string{}
+	for _, profile := range user.Profiles {
+		if deleteRequestSet[profile.ID] {
+			deletedProfiles = append(deletedProfiles, profile)
+			deletedIDs = append(deletedIDs, profile.ID)
+		}
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, profileService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}}
+	update := bson.D{
+		{"$pull", bson.D{
+			{"profiles", bson.D{
+				{"id", bson.D{
+					{"$in", deletedIDs},
+				}},
+			}},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, profileService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	for _, profile := range deletedProfiles {
+		removeProfileRenderings(user, profile)
+	}
+	js, _ := json.Marshal(deviceProfileDeleteResponse{
+		NumberDeleted: len(deletedProfiles),
+	})
+	w.Write(js)
+}
+
+// updateDeviceProfileFromRequest validates the settings in request and sets them on profile with a new version,
+// if they are not valid appropriate response is written to output
+func updateDeviceProfileFromRequest(w http.ResponseWriter, user *db.User, profile *db.DeviceProfile, request deviceProfileRequest) bool {
+	if !isProfileDimension(request.Width) || !isProfileDimension(request.Height) ||
+		!isProfileOrientation(request.Orientation) || !isProfileFit(request.Fit) || !isProfileColorMode(request.ColorMode) ||
+		(request.MaxFileSize != nil && *request.MaxFileSize < 0) {
+		log.Printf(errLogTemplate, errLogValidation, profileService, user.Email, request.Name)
+		WriteErrorOnResponse(errInvalidDeviceProfile, &w, http.StatusBadRequest)
+		return false
+	}
+
+	if request.Width > 0 {
+		profile.Width = request.Width
+	}
+	if request.Height > 0 {
+		profile.Height = request.Height
+	}
+	if len(request.Orientation) > 0 {
+		profile.Orientation = request.Orientation
+	}
+	if len(request.Fit) > 0 {
+		profile.Fit = request.Fit
+	}
+	if len(request.ColorMode) > 0 {
+		profile.ColorMode = request.ColorMode
+	}
+	if request.MaxFileSize != nil {
+		profile.MaxFileSize = *request.MaxFileSize
+	}
+	if request.Overlays != nil {
+		overlays, err := parseOverlays(*request.Overlays)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogValidation, profileService, user.Email, err.Error())
+			WriteErrorOnResponse(errInvalidOverlay, &w, http.StatusBadRequest)
+			return false
+		}
+		profile.Overlays = overlays
+	}
+	version, _ := uuid.NewRandom()
+	profile.Version = version.String()
+	return true
+}
+
+func isProfileDimension(dimension int) bool {
+	return dimension == 0 || (dimension >= minProfileDimension && dimension <= maxProfileDimension)
+}
+
+func isProfileOrientation(orientation string) bool {
+	return orientation == "" || orientation == db.ProfileOrientationLandscape || orientation == db.ProfileOrientationPortrait
+}
+
+func isProfileFit(fit string) bool {
+	return fit == "" || fit == fitContain || fit == fitCover || fit == fitFill || fit == fitPad
+}
+
+func isProfileColorMode(colorMode string) bool {
+	return colorMode == "" || colorMode == db.ProfileColorModeColor || colorMode == db.ProfileColorModeGrayscale
+}
+
+// writeDeviceProfileResponse queues pre-rendering the images of user for the profile and writes the profile
+// with the job to output
+func writeDeviceProfileResponse(w http.ResponseWriter, user *db.User, profile db.DeviceProfile) {
+	profileJSON := toUserDeviceProfile(profile)
+	job, err := jobs.GetQueue().Enqueue(renderProfilesJobType, user.ID, map[string]string{
+		profilePayloadKey: profile.ID,
+	})
+	if err != nil {
+		// the images are still rendered for the profile when frames request them
+		log.Printf(errLogTemplate, errLogCannotInsertToDb, profileService, user.Email, err.Error())
+	} else {
+		profileJSON.JobID = job.ID
+	}
+
+	js, _ := json.Marshal(profileJSON)
+	w.Write(js)
+}
+
+// findDeviceProfile returns the profile of user with the id or nil if the user does not have such profile
+func findDeviceProfile(user *db.User, profileID string) *db.DeviceProfile {
+	for i := range user.Profiles {
+		if user.Profiles[i].ID == profileID {
+			return &user.Profiles[i]
+		}
+	}
+	return nil
+}
+
+// serveProfileImage serves the image rendered for the profile in the request, the rendering is created if
+// it is not pre-rendered yet
+func serveProfileImage(w http.ResponseWriter, r *http.Request, user *db.User, img db.ImageInfo) {
+	profile := findDeviceProfile(user, r.FormValue("profile"))
+	if profile == nil {
+		log.Printf(errLogTemplate, errLogNotFound, profileService, user.Email, r.FormValue("profile"))
+		SetJsonContentType(w)
+		WriteErrorOnResponse(errDeviceProfileNotFound, &w, http.StatusNotFound)
+		return
+	}
+
+	fp, err := getProfileRendering(user, img, *profile)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogIoError, profileService, user.Email, err.Error())
+		SetJsonContentType(w)
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+	version := getImageVersion(user.ID, img, false)
+	overlays := getImageOverlays(user, img, profile.Overlays, "")
+	serveImageFile(w, r, fp, getVariantETag(version, getProfileVariantKey(*profile, overlays)), getOverlaysVersion(version, overlays))
+}
+
+// getProfileRendering returns the path of the image rendered for the profile, it is rendered if it does not exist.
+// The renderings are kept out of the variant cache so they are not evicted, they are removed when the image or
+// the profile changes.
+func getProfileRendering(user *db.User, img db.ImageInfo, profile db.DeviceProfile) (string, error) {
+	overlays := getImageOverlays(user, img, profile.Overlays, "")
+	fp := getUserProfileRenderingPath(user.ID, img.ID, getProfileVariantKey(profile, overlays))
+	if _, err := os.Stat(fp); err == nil {
+		return fp, nil
+	}
+
+	log.Printf("Rendering image %q for profile %q", img.Name, profile.Name)
+	err := os.MkdirAll(path.Dir(fp), 0777)
+	if err != nil {
+		return "", err
+	}
+	err = createProfileRendering(getUserImagePath(user.ID, img.ID, false), fp, profile, overlays)
+	if err != nil {
+		return "", err
+	}
+	// the renderings of the image with the previous overlays of profile, like a changed caption, are stale
+	removeRenderingFiles(user.ID, img.ID+"-profile-"+profile.ID+"-*"+jpegExtension, fp)
+	return fp, nil
+}
+
+// createProfileRendering renders the source image at the resolution of profile with its fit, overlays and colour
+// mode, the quality is lowered until the file fits the size limit of profile. If even the lowest quality does
+// not fit, the lowest quality is kept.
+func createProfileRendering(sourcePath string, variantPath string, profile db.DeviceProfile, overlays []renderedOverlay) error {
+	source, err := imaging.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	width, height := getProfileSize(profile)
+	options := renderOptions{
+		Width:      width,
+		Height:     height,
+		Fit:        profile.Fit,
+		Background: color.NRGBA{0, 0, 0, 255},
+		FocalX:     50,
+		FocalY:     50,
+		Format:     formatJpeg,
+	}
+	rendered, err := drawOverlays(renderImage(source, options), overlays)
+	if err != nil {
+		return err
+	}
+	if profile.ColorMode == db.ProfileColorModeGrayscale {
+		rendered = imaging.Grayscale(rendered)
+	}
+
+	var encoded bytes.Buffer
+	for options.Quality = profileRenderQuality; ; options.Quality -= profileRenderQualityStep {
+		encoded.Reset()
+		err = encodeVariantImage(&encoded, rendered, options)
+		if err != nil {
+			return err
+		}
+		if profile.MaxFileSize == 0 || int64(encoded.Len()) <= profile.MaxFileSize {
+			break
+		}
+		if options.Quality-profileRenderQualityStep < minProfileRenderQuality {
+			log.Printf("Rendering for profile %q is %d bytes at the lowest quality", profile.Name, encoded.Len())
+			break
+		}
+	}
+	return writeFileAtomically(variantPath, encoded.Bytes())
+}
+
+// getProfileSize returns the width and height images are rendered at for the profile
+func getProfileSize(profile db.DeviceProfile) (int, int) {
+	long, short := profile.Width, profile.Height
+	if short > long {
+		long, short = short, long
+	}
+	if profile.Orientation == db.ProfileOrientationPortrait {
+		return short, long
+	}
+	return long, short
+}
+
+// getProfileVariantKey identifies the renderings of the current settings of profile with the overlays of image
+func getProfileVariantKey(profile db.DeviceProfile, overlays []renderedOverlay) string {
+	return "profile-" + profile.ID + "-" + profile.Version + getOverlaysKey(overlays)
+}
+
+// removeProfileRenderings deletes the renderings of the images of user for the settings of profile
+func removeProfileRenderings(user *db.User, profile db.DeviceProfile) {
+	removeRenderingFiles(user.ID, "*-profile-"+profile.ID+"-"+profile.Version+"*"+jpegExtension, "")
+}
+
+// removeImageProfileRenderings deletes the renderings of the image for all profiles of user
+func removeImageProfileRenderings(userID string, imageID string) {
+	removeRenderingFiles(userID, imageID+"-profile-*"+jpegExtension, "")
+}
+
+// removeRenderingFiles deletes the profile renderings of user matching the pattern except the kept one
+func removeRenderingFiles(userID string, pattern string, kept string) {
+	files, err := filepath.Glob(path.Join(getCurUserDirectory(userID)+profilesDirectory, pattern))
+	if err != nil {
+		log.Printf(errLogTemplate, errLogIoError, profileService, userID, err.Error())
+		return
+	}
+	for _, file := range files {
+		if file == kept {
+			continue
+		}
+		err = os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf(errLogTemplate, errLogIoError, profileService, userID, err.Error())
+		}
+	}
+}
+
+func getUserProfileRenderingPath(userID string, imageID string, variantKey string) string {
+	return path.Join(getCurUserDirectory(userID)+profilesDirectory, imageID+"-"+variantKey+jpegExtension)
+}
+
+// registerProfileJobs registers the handlers of profile jobs in the job queue
+func registerProfileJobs() {
+	jobs.GetQueue().RegisterHandler(renderProfilesJobType, renderProfilesJob)
+}
+
+// renderProfilesJob pre-renders the image in the payload for all profiles of user, or all images of user
+// for the profile in the payload
+func renderProfilesJob(job *db.Job) error {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		return err
+	}
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+
+	var user db.User
+	err = collection.FindOne(context.TODO(), bson.D{{"id", job.UserID}}).Decode(&user)
+	if err != nil {
+		return err
+	}
+
+	profiles := user.Profiles
+	if profileID := job.Payload[profilePayloadKey]; len(profileID) > 0 {
+		profile := findDeviceProfile(&user, profileID)
+		// the profile is deleted before it was rendered
+		if profile == nil {
+			return nil
+		}
+		profiles = []db.DeviceProfile{*profile}
+	}
+	images := getActiveImages(&user)
+	if imageID := job.Payload[imagePayloadKey]; len(imageID) > 0 {
+		img := findUserImage(&user, imageID)
+		if img == nil {
+			return nil
+		}
+		images = []db.ImageInfo{*img}
+	}
+
+	for _, img := range images {
+		if !img.IsReady() {
+			continue
+		}
+		for _, profile := range profiles {
+			_, err = getProfileRendering(&user, img, profile)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// queueProfileRenderings queues pre-rendering the image for the profiles of user, if the user has any
+func queueProfileRenderings(user *db.User, imageID string) {
+	if len(user.Profiles) == 0 {
+		return
+	}
+	_, err := jobs.GetQueue().Enqueue(renderProfilesJobType, user.ID, map[string]string{
+		imagePayloadKey: imageID,
+	})
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotInsertToDb, profileService, user.ID, err.Error())
+	}
+}
+
+func toUserDeviceProfile(profile db.DeviceProfile) userDeviceProfile {
+	return userDeviceProfile{
+		ID:           profile.ID,
+		Name:         profile.Name,
+		Width:        profile.Width,
+		Height:       profile.Height,
+		Orientation:  profile.Orientation,
+		Fit:          profile.Fit,
+		ColorMode:    profile.ColorMode,
+		MaxFileSize:  profile.MaxFileSize,
+		Overlays:     toUserOverlays(profile.Overlays),
+		Version:      profile.Version,
+		CreationDate: profile.CreationDate,
+	}
+}
@@ -0,0 +1,428 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/matba/slyde-server/internals/db"
+	"github.com/matba/slyde-server/internals/variants"
+)
+
+const imageRenderService = "IMAGE_RENDER"
+
+const fitContain = "contain"
+const fitCover = "cover"
+const fitFill = "fill"
+const fitPad = "pad"
+
+const formatJpeg = "jpeg"
+const formatPng = "png"
+
+const defaultRenderQuality = 75
+const renderQualityStep = 5
+
+// allowedRenderSizes are the only widths and heights that can be requested, so the number of
+// variants kept for every image stays bounded
+var allowedRenderSizes = map[int]bool{
+	150: true, 240: true, 320: true, 480: true, 600: true, 640: true, 720: true, 768: true,
+	800: true, 900: true, 1024: true, 1080: true, 1200: true, 1280: true, 1366: true,
+	1440: true, 1536: true, 1600: true, 1920: true, 2048: true, 2160: true, 2560: true, 3840: true,
+}
+
+// renderOptions describes how a stored image should be rendered for the client
+type renderOptions struct {
+	Width      int
+	Height     int
+	Fit        string
+	Background color.NRGBA
+	// the focal point in percent of width and height, it is kept when the image is cropped
+	FocalX  int
+	FocalY  int
+	Quality int
+	Format  string
+	// the texts drawn on the rendered image
+	Overlays []renderedOverlay
+}
+
+// isRenderRequest checks whether the client asked for an exact size rendering of the image or for the image
+// with the overlays of a slideshow
+func isRenderRequest(r *http.Request) bool {
+	return len(r.FormValue("w")) > 0 || len(r.FormValue("h")) > 0 || len(r.FormValue("slideshow")) > 0
+}
+
+// parseRenderOptions reads the rendering options from request, if the options are not valid
+// the returned string is the description that should be sent to client
+func parseRenderOptions(r *http.Request) (*renderOptions, string, error) {
+	options := renderOptions{
+		Fit:        fitContain,
+		Background: color.NRGBA{0, 0, 0, 255},
+		FocalX:     50,
+		FocalY:     50,
+		Quality:    defaultRenderQuality,
+	}
+
+	var err error
+	options.Width, err = parseRenderSize(r.FormValue("w"))
+	if err != nil {
+		return nil, errInvalidRenderSize, err
+	}
+	options.Height, err = parseRenderSize(r.FormValue("h"))
+	if err != nil {
+		return nil, errInvalidRenderSize, err
+	}
+
+	if fit := r.FormValue("fit"); len(fit) > 0 {
+		if fit != fitContain && fit != fitCover && fit != fitFill && fit != fitPad {
+			return nil, errInvalidRenderFit, errors.New("Unknown fit mode " + fit)
+		}
+		options.Fit = fit
+	}
+
+	if bg := r.FormValue("bg"); len(bg) > 0 {
+		options.Background, err = parseHexColor(bg)
+		if err != nil {
+			return nil, errInvalidRenderColor, err
+		}
+	}
+
+	options.FocalX, err = parsePercent(r.FormValue("fx"), options.FocalX)
+	if err != nil {
+		return nil, errInvalidRenderFocalPoint, err
+	}
+	options.FocalY, err = parsePercent(r.FormValue("fy"), options.FocalY)
+	if err != nil {
+		return nil, errInvalidRenderFocalPoint, err
+	}
+
+	if qualityStr := r.FormValue("quality"); len(qualityStr) > 0 {
+		quality, err := strconv.Atoi(qualityStr)
+		if err != nil || quality < 1 || quality > 100 {
+			return nil, errInvalidRenderQuality, errors.New("Invalid quality " + qualityStr)
+		}
+		// the quality is snapped so the number of variants stays bounded
+		options.Quality = int(math.Round(float64(quality)/renderQualityStep)) * renderQualityStep
+		if options.Quality < renderQualityStep {
+			options.Quality = renderQualityStep
+		}
+	}
+
+	options.Format, err = negotiateRenderFormat(r)
+	if err != nil {
+		return nil, errUnsupportedRenderFormat, err
+	}
+
+	return &options, "", nil
+}
+
+// parseRenderSize parses a requested dimension, zero means the dimension is not requested
+func parseRenderSize(sizeStr string) (int, error) {
+	if len(sizeStr) == 0 {
+		return 0, nil
+	}
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil {
+		return 0, err
+	}
+	if !allowedRenderSizes[size] {
+		return 0, errors.New("Size is not allowed " + sizeStr)
+	}
+	return size, nil
+}
+
+// parsePercent parses a value between 0 and 1 and returns it as a rounded percent
+func parsePercent(valueStr string, defaultValue int) (int, error) {
+	if len(valueStr) == 0 {
+		return defaultValue, nil
+	}
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		return 0, err
+	}
+	if value < 0 || value > 1 {
+		return 0, errors.New("Value out of range " + valueStr)
+	}
+	return int(math.Round(value * 100)), nil
+}
+
+// parseHexColor parses colors in rrggbb format with or without leading #
+func parseHexColor(hex string) (color.NRGBA, error) {
+	hex = strings.TrimPrefix(hex, "#")
+	if len(hex) != 6 {
+		return color.NRGBA{}, errors.New("Invalid color " + hex)
+	}
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, err
+	}
+	return color.NRGBA{uint8(value >> 16), uint8(value >> 8), uint8(value), 255}, nil
+}
+
+// negotiateRenderFormat selects the output format from the format parameter or the Accept header
+func negotiateRenderFormat(r *http.Request) (string, error) {
+	if format := strings.ToLower(r.FormValue("format")); len(format) > 0 {
+		switch format {
+		case formatJpeg, "jpg":
+			return formatJpeg, nil
+		case formatPng:
+			return formatPng, nil
+		default:
+			return "", errors.New("Unknown format " + format)
+		}
+	}
+
+	for _, mediaType := range parseAcceptHeader(r.Header.Get("Accept")) {
+		switch mediaType {
+		case "image/jpeg", "image/*", "*/*":
+			return formatJpeg, nil
+		case "image/png":
+			return formatPng, nil
+		}
+	}
+	return formatJpeg, nil
+}
+
+// parseAcceptHeader returns the media types of the Accept header ordered by their q-values, the types with the
+// same q-value keep their order and the types with zero q-value are not acceptable so they are left out
+func parseAcceptHeader(header string) []string {
+	type acceptedType struct {
+		mediaType string
+		quality   float64
+	}
+	accepted := []acceptedType{}
+	for _, entry := range strings.Split(header, ",") {
+		parts := strings.Split(entry, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(parts[0]))
+		if len(mediaType) == 0 {
+			continue
+		}
+		quality := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+				quality = q
+			}
+		}
+		if quality <= 0 {
+			continue
+		}
+		accepted = append(accepted, acceptedType{mediaType: mediaType, quality: quality})
+	}
+
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return accepted[i].quality > accepted[j].quality
+	})
+	mediaTypes := []string{}
+	for _, a := range accepted {
+		mediaTypes = append(mediaTypes, a.mediaType)
+	}
+	return mediaTypes
+}
+
+// cacheKey creates the deterministic key that identifies the rendered variant of an image
+func (o renderOptions) cacheKey() string {
+	key := fmt.Sprintf("w%d-h%d-%s-q%d", o.Width, o.Height, o.Fit, o.Quality)
+	if o.Fit == fitCover {
+		key += fmt.Sprintf("-f%dx%d", o.FocalX, o.FocalY)
+	}
+	if o.Fit == fitPad {
+		key += fmt.Sprintf("-bg%02x%02x%02x", o.Background.R, o.Background.G, o.Background.B)
+	}
+	return key + getOverlaysKey(o.Overlays)
+}
+
+func (o renderOptions) extension() string {
+	if o.Format == formatPng {
+		return ".png"
+	}
+	return jpegExtension
+}
+
+// serveRenderedImage serves the variant of image described by the request, the variant is created on first
+// request. The overlays of the slideshow in request are drawn on the variant.
+func serveRenderedImage(w http.ResponseWriter, r *http.Request, user *db.User, img db.ImageInfo) {
+	options, description, err := parseRenderOptions(r)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogValidation, imageRenderService, user.Email, err.Error())
+		WriteErrorOnResponse(description, &w, http.StatusBadRequest)
+		return
+	}
+	if slideshowID := r.FormValue("slideshow"); len(slideshowID) > 0 {
+		slideshow := findUserSlideshow(user, slideshowID)
+		if slideshow == nil {
+			log.Printf(errLogTemplate, errLogNotFound, imageRenderService, user.Email, slideshowID)
+			WriteErrorOnResponse(errSlideshowNotFound, &w, http.StatusNotFound)
+			return
+		}
+		options.Overlays = getImageOverlays(user, img, slideshow.Overlays, slideshow.AlbumID)
+	}
+
+	fpv := getUserVariantImagePath(user.ID, img.ID, options.cacheKey(), options.extension())
+	if !variants.GetVariantCache().Lookup(fpv) {
+		log.Printf("Rendering image %q as %q", img.Name, options.cacheKey())
+		err = createRenderedImage(getUserImagePath(user.ID, img.ID, false), fpv, *options)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogIoError, imageRenderService, user.Email, err.Error())
+			WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+			return
+		}
+		err = variants.GetVariantCache().Add(variants.ImageKey(user.ID, img.ID), fpv)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogIoError, imageRenderService, user.Email, err.Error())
+		}
+	}
+
+	if len(r.FormValue("format")) == 0 {
+		w.Header().Set("Vary", "Accept")
+	}
+	version := getImageVersion(user.ID, img, false)
+	// the urls of images with overlays carry the overlays in their version, so they change with the texts
+	serveImageFile(w, r, fpv, getVariantETag(version, options.cacheKey()+options.extension()),
+		getOverlaysVersion(version, options.Overlays))
+}
+
+// createRenderedImage renders the source image and writes it to a temporary file first, so concurrent
+// requests never see a half written variant
+func createRenderedImage(sourcePath string, variantPath string, options renderOptions) error {
+	source, err := imaging.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	rendered, err := drawOverlays(renderImage(source, options), options.Overlays)
+	if err != nil {
+		return err
+	}
+	return writeVariantImage(rendered, variantPath, options)
+}
+
+// writeVariantImage encodes the image in the format of options and moves it to the variant path when it is
+// completely written
+func writeVariantImage(rendered image.Image, variantPath string, options renderOptions) error {
+	var encoded bytes.Buffer
+	err := encodeVariantImage(&encoded, rendered, options)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(variantPath, encoded.Bytes())
+}
+
+func encodeVariantImage(w io.Writer, rendered image.Image, options renderOptions) error {
+	format := imaging.JPEG
+	if options.Format == formatPng {
+		format = imaging.PNG
+	}
+	return imaging.Encode(w, rendered, format, imaging.JPEGQuality(options.Quality))
+}
+
+// writeFileAtomically writes the data to a temporary file first, so concurrent readers never see a half
+// written file
+func writeFileAtomically(filePath string, data []byte) error {
+	tmpFile, err := ioutil.TempFile(path.Dir(filePath), path.Base(filePath)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(data)
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filePath)
+}
+
+// renderImage resizes the image according to the requested size and fit mode
+func renderImage(source image.Image, options renderOptions) image.Image {
+	srcW := source.Bounds().Dx()
+	srcH := source.Bounds().Dy()
+	width, height := options.Width, options.Height
+
+	// the image keeps its size when only the overlays are drawn on it
+	if width == 0 && height == 0 {
+		return source
+	}
+	// if only one dimension is requested the aspect ratio of image is kept
+	if height == 0 {
+		height = int(math.Round(float64(srcH) * float64(width) / float64(srcW)))
+		return imaging.Resize(source, width, height, imaging.Lanczos)
+	}
+	if width == 0 {
+		width = int(math.Round(float64(srcW) * float64(height) / float64(srcH)))
+		return imaging.Resize(source, width, height, imaging.Lanczos)
+	}
+
+	switch options.Fit {
+	case fitFill:
+		return imaging.Resize(source, width, height, imaging.Lanczos)
+	case fitCover:
+		cropped := imaging.Crop(source, getFocalCropRectangle(srcW, srcH, width, height, options.FocalX, options.FocalY))
+		return imaging.Resize(cropped, width, height, imaging.Lanczos)
+	case fitPad:
+		fitW, fitH := getContainSize(srcW, srcH, width, height)
+		resized := imaging.Resize(source, fitW, fitH, imaging.Lanczos)
+		return imaging.PasteCenter(imaging.New(width, height, options.Background), resized)
+	default:
+		fitW, fitH := getContainSize(srcW, srcH, width, height)
+		return imaging.Resize(source, fitW, fitH, imaging.Lanczos)
+	}
+}
+
+// getContainSize returns the biggest size with the aspect ratio of source that fits in the box
+func getContainSize(srcW int, srcH int, width int, height int) (int, int) {
+	scale := math.Min(float64(width)/float64(srcW), float64(height)/float64(srcH))
+	fitW := int(math.Round(float64(srcW) * scale))
+	fitH := int(math.Round(float64(srcH) * scale))
+	if fitW < 1 {
+		fitW = 1
+	}
+	if fitH < 1 {
+		fitH = 1
+	}
+	return fitW, fitH
+}
+
+// getFocalCropRectangle returns the biggest part of source with the aspect ratio of the box, centered on the
+// focal point as much as the borders of the source allow
+func getFocalCropRectangle(srcW int, srcH int, width int, height int, focalX int, focalY int) image.Rectangle {
+	scale := math.Max(float64(width)/float64(srcW), float64(height)/float64(srcH))
+	cropW := int(math.Min(math.Round(float64(width)/scale), float64(srcW)))
+	cropH := int(math.Min(math.Round(float64(height)/scale), float64(srcH)))
+
+	x0 := clamp(srcW*focalX/100-cropW/2, 0, srcW-cropW)
+	y0 := clamp(srcH*focalY/100-cropH/2, 0, srcH-cropH)
+	return image.Rect(x0, y0, x0+cropW, y0+cropH)
+}
+
+func clamp(value int, min int, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+func getUserVariantImagePath(userID string, imageUUID string, variantKey string, extension string) string {
+	return path.Join(getCurUserDirectory(userID)+imagesDiretory, imageUUID+"-"+variantKey+extension)
+}
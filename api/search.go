@@ -0,0 +1,583 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matba/slyde-server/internals/db"
+	"github.com/matba/slyde-server/internals/jobs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const searchService = "SEARCH"
+const reindexImagesJobType = "REINDEX_IMAGES"
+const maxCaptionLength = 2000
+const maxImageTags = 50
+const maxTagLength = 64
+const maxImageRating = 5
+const defaultSearchLimit = 50
+const maxSearchLimit = 200
+const maxTagFacets = 50
+const defaultTagSuggestions = 10
+const searchDateLayout = "2006-01-02"
+const indexNotFoundCode = 27
+
+// HandleImageMetadata handles API calls for setting the caption, tags, rating and favorite flag of images
+func HandleImageMetadata(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	log.Printf("Incoming call for image metadata")
+	if r.Method != "PUT" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, searchService)
+	if err != nil {
+		return
+	}
+
+	var request imageMetadataRequest
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, searchService, email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	img := findUserImage(user, request.ID)
+	if img == nil || img.IsTrashed() {
+		log.Printf(errLogTemplate, errLogNotFound, searchService, email, request.ID)
+		WriteErrorOnResponse(errNotFound, &w, http.StatusNotFound)
+		return
+	}
+	if request.Caption != nil {
+		img.Caption = strings.TrimSpace(*request.Caption)
+	}
+	if request.Tags != nil {
+		img.Tags = normalizeTags(request.Tags)
+	}
+	if request.Favorite != nil {
+		img.Favorite = *request.Favorite
+	}
+	if request.Rating != nil {
+		img.Rating = *request.Rating
+	}
+	if request.NeverShow != nil {
+		img.NeverShow = *request.NeverShow
+	}
+	if len(img.Caption) > maxCaptionLength || len(img.Tags) > maxImageTags || img.Rating < 0 || img.Rating > maxImageRating {
+		log.Printf(errLogTemplate, errLogValidation, searchService, email, "Caption or tags too long.")
+		WriteErrorOnResponse(errInvalidImageMetadata, &w, http.StatusBadRequest)
+		return
+	}
+	for _, tag := range img.Tags {
+		if len(tag) > maxTagLength {
+			log.Printf(errLogTemplate, errLogValidation, searchService, email, tag)
+			WriteErrorOnResponse(errInvalidImageMetadata, &w, http.StatusBadRequest)
+			return
+		}
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, searchService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}, {"images.id", img.ID}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"images.$.caption", img.Caption},
+			{"images.$.tags", img.Tags},
+			{"images.$.favorite", img.Favorite},
+			{"images.$.rating", img.Rating},
+			{"images.$.nevershow", img.NeverShow},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, searchService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	searchCollection := (*client).Database(db.MainDbName).Collection(db.ImagesCollection)
+	filter = bson.D{{"userid", user.ID}, {"imageid", img.ID}}
+	update = bson.D{
+		{"$set", bson.D{
+			{"caption", img.Caption},
+			{"tags", img.Tags},
+		}},
+	}
+	_, err = searchCollection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, searchService, email, err.Error())
+	}
+
+	js, _ := json.Marshal(toUserImage(*img))
+	w.Write(js)
+}
+
+// HandleImageSearch searches the images of user. The text in q is matched against the name, caption and
+// tags of images and the results can be filtered by all of tags, any of tags, excluded tags, upload date
+// range and album. The tags of all matching images are returned as facets.
+func HandleImageSearch(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	log.Printf("Incoming call for searching images")
+	if r.Method != "GET" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, searchService)
+	if err != nil {
+		return
+	}
+
+	filter, err := getSearchFilter(user.ID, r)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogValidation, searchService, email, err.Error())
+		WriteErrorOnResponse(errInvalidSearch, &w, http.StatusBadRequest)
+		return
+	}
+
+	limit := getSearchLimit(r.FormValue("limit"), defaultSearchLimit, maxSearchLimit)
+	offset, _ := strconv.ParseInt(r.FormValue("offset"), 10, 64)
+	findOptions := options.Find().SetLimit(limit).SetSkip(offset)
+	if len(r.FormValue("q")) > 0 {
+		score := bson.D{{"score", bson.D{{"$meta", "textScore"}}}}
+		findOptions.SetProjection(score).SetSort(score)
+	} else {
+		findOptions.SetSort(bson.D{{"uploaddate", -1}})
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, searchService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+	collection := (*client).Database(db.MainDbName).Collection(db.ImagesCollection)
+
+	total, err := collection.CountDocuments(context.TODO(), filter)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, searchService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	cursor, err := collection.Find(context.TODO(), filter, findOptions)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, searchService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.TODO())
+
+	userImages := make(map[string]db.ImageInfo)
+	for _, img := range user.Images {
+		userImages[img.ID] = img
+	}
+	response := imageSearchResponse{Total: total, Images: []UserImage{}}
+	for cursor.Next(context.TODO()) {
+		var entry db.ImageSearchEntry
+		err = cursor.Decode(&entry)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, searchService, email, err.Error())
+			WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+			return
+		}
+		if img, ok := userImages[entry.ImageID]; ok {
+			response.Images = append(response.Images, toUserImage(img))
+		}
+	}
+
+	response.Facets, err = aggregateTags(collection, filter, nil, maxTagFacets)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, searchService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(response)
+	w.Write(js)
+}
+
+// HandleTagSuggestions returns the most used tags of user that start with the prefix
+func HandleTagSuggestions(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	if r.Method != "GET" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, searchService)
+	if err != nil {
+		return
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, searchService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+	collection := (*client).Database(db.MainDbName).Collection(db.ImagesCollection)
+
+	// an anchored regex on the tags can use the index of user and tags
+	prefix := bson.D{{"$regex", "^" + regexp.QuoteMeta(strings.ToLower(strings.TrimSpace(r.FormValue("prefix"))))}}
+	filter := bson.D{{"userid", user.ID}, {"trashed", false}, {"tags", prefix}}
+	limit := getSearchLimit(r.FormValue("limit"), defaultTagSuggestions, maxTagFacets)
+	suggestions, err := aggregateTags(collection, filter, bson.D{{"tags", prefix}}, limit)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, searchService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(tagSuggestions{Tags: suggestions})
+	w.Write(js)
+}
+
+// HandleAdminSearchIndex queues rebuilding the search entries of the user with the id or of all users
+func HandleAdminSearchIndex(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	if r.Method != "POST" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	email := GetAdmin(w, r)
+	if email == "" {
+		return
+	}
+
+	enqueueUserJobs(w, r, email, reindexImagesJobType, searchService)
+}
+
+// getSearchFilter builds the filter of search entries from the parameters of request
+func getSearchFilter(userID string, r *http.Request) (bson.D, error) {
+	// the text search has to be a top level condition of the filter
+	filter := bson.D{{"userid", userID}, {"trashed", false}}
+	if q := strings.TrimSpace(r.FormValue("q")); len(q) > 0 {
+		filter = append(filter, bson.E{"$text", bson.D{{"$search", q}}})
+	}
+
+	conditions := bson.A{}
+	if tags := splitTags(r.FormValue("tags")); len(tags) > 0 {
+		conditions = append(conditions, bson.D{{"tags", bson.D{{"$all", tags}}}})
+	}
+	if tags := splitTags(r.FormValue("anyTags")); len(tags) > 0 {
+		conditions = append(conditions, bson.D{{"tags", bson.D{{"$in", tags}}}})
+	}
+	if tags := splitTags(r.FormValue("excludeTags")); len(tags) > 0 {
+		conditions = append(conditions, bson.D{{"tags", bson.D{{"$nin", tags}}}})
+	}
+	if from := r.FormValue("from"); len(from) > 0 {
+		date, err := time.Parse(searchDateLayout, from)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, bson.D{{"date", bson.D{{"$gte", date}}}})
+	}
+	if to := r.FormValue("to"); len(to) > 0 {
+		date, err := time.Parse(searchDateLayout, to)
+		if err != nil {
+			return nil, err
+		}
+		// the end date is inclusive
+		conditions = append(conditions, bson.D{{"date", bson.D{{"$lt", date.AddDate(0, 0, 1)}}}})
+	}
+	if album := r.FormValue("album"); len(album) > 0 {
+		conditions = append(conditions, bson.D{{"albumids", album}})
+	}
+
+	if len(conditions) > 0 {
+		filter = append(filter, bson.E{"$and", conditions})
+	}
+	return filter, nil
+}
+
+// aggregateTags counts the tags of the entries matching the filter, the most used tags come first. The tag
+// filter is applied after the tags of entries are separated, so only the matching tags are counted.
+func aggregateTags(collection *mongo.Collection, filter bson.D, tagFilter bson.D, limit int64) ([]tagFacet, error) {
+	pipeline := mongo.Pipeline{
+		{{"$match", filter}},
+		{{"$unwind", "$tags"}},
+	}
+	if tagFilter != nil {
+		pipeline = append(pipeline, bson.D{{"$match", tagFilter}})
+	}
+	pipeline = append(pipeline,
+		bson.D{{"$group", bson.D{{"_id", "$tags"}, {"count", bson.D{{"$sum", 1}}}}}},
+		bson.D{{"$sort", bson.D{{"count", -1}, {"_id", 1}}}},
+		bson.D{{"$limit", limit}},
+	)
+
+	cursor, err := collection.Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	facets := []tagFacet{}
+	for cursor.Next(context.TODO()) {
+		var facet tagFacet
+		err = cursor.Decode(&facet)
+		if err != nil {
+			return nil, err
+		}
+		facets = append(facets, facet)
+	}
+	return facets, cursor.Err()
+}
+
+// ensureSearchIndexes creates the indexes of search entries, creating an existing index does nothing
+func ensureSearchIndexes() error {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		return err
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.ImagesCollection)
+	// a collection can only have one text index, the text index without the user prefix is replaced
+	_, err = collection.Indexes().DropOne(context.TODO(), "image_text")
+	if commandErr, ok := err.(mongo.CommandError); err != nil && (!ok || commandErr.Code != indexNotFoundCode) {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, searchService, "", err.Error())
+	}
+	_, err = collection.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{"userid", 1}, {"imageid", 1}},
+			Options: options.Index().SetName("user_image").SetUnique(true),
+		},
+		{
+			// the text searches always filter by user, so only the entries of user are scanned
+			Keys: bson.D{{"userid", 1}, {"name", "text"}, {"caption", "text"}, {"tags", "text"}},
+			Options: options.Index().SetName("user_image_text").
+				SetWeights(bson.D{{"tags", 5}, {"caption", 2}, {"name", 1}}),
+		},
+		{
+			Keys:    bson.D{{"userid", 1}, {"tags", 1}},
+			Options: options.Index().SetName("user_tags"),
+		},
+		{
+			Keys:    bson.D{{"userid", 1}, {"uploaddate", -1}},
+			Options: options.Index().SetName("user_upload_date"),
+		},
+		{
+			Keys:    bson.D{{"userid", 1}, {"date", -1}},
+			Options: options.Index().SetName("user_date"),
+		},
+		{
+			Keys:    bson.D{{"userid", 1}, {"albumids", 1}},
+			Options: options.Index().SetName("user_albums"),
+		},
+	})
+	return err
+}
+
+// registerSearchJobs registers the handlers of search jobs in the job queue
+func registerSearchJobs() {
+	jobs.GetQueue().RegisterHandler(reindexImagesJobType, reindexImagesJob)
+}
+
+// reindexAllImages queues rebuilding the search entries of all users at start, so the images added before
+// their entries or before a field was added to entries can be found
+func reindexAllImages() {
+	userIDs, err := getAllUserIDs()
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, searchService, "", err.Error())
+		return
+	}
+	for _, userID := range userIDs {
+		_, err = jobs.GetQueue().Enqueue(reindexImagesJobType, userID, map[string]string{})
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotInsertToDb, searchService, userID, err.Error())
+		}
+	}
+}
+
+// reindexImagesJob rebuilds the search entries of user from its images and albums
+func reindexImagesJob(job *db.Job) error {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		return err
+	}
+
+	var user db.User
+	err = (*client).Database(db.MainDbName).Collection(db.UsersCollection).
+		FindOne(context.TODO(), bson.D{{"id", job.UserID}}).Decode(&user)
+	if err != nil {
+		return err
+	}
+
+	albumIDs := make(map[string][]string)
+	for _, album := range user.Albums {
+		for _, imgID := range album.ImageIDs {
+			albumIDs[imgID] = append(albumIDs[imgID], album.ID)
+		}
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.ImagesCollection)
+	imageIDs := []string{}
+	for _, img := range user.Images {
+		imageIDs = append(imageIDs, img.ID)
+		err = indexImage(collection, user.ID, img, albumIDs[img.ID])
+		if err != nil {
+			return err
+		}
+	}
+
+	// the entries of images that do not exist anymore
+	_, err = collection.DeleteMany(context.TODO(), bson.D{{"userid", user.ID}, {"imageid", bson.D{{"$nin", imageIDs}}}})
+	return err
+}
+
+// indexImage creates or replaces the search entry of image
+func indexImage(collection *mongo.Collection, userID string, img db.ImageInfo, albumIDs []string) error {
+	if albumIDs == nil {
+		albumIDs = []string{}
+	}
+	entry := db.ImageSearchEntry{
+		UserID:      userID,
+		ImageID:     img.ID,
+		Name:        img.Name,
+		Caption:     img.Caption,
+		Tags:        getImageTags(img),
+		AlbumIDs:    albumIDs,
+		UploadDate:  img.UploadDate,
+		CaptureDate: img.CaptureDate,
+		Date:        getImageDate(img),
+		Trashed:     img.IsTrashed(),
+	}
+	_, err := collection.ReplaceOne(context.TODO(), bson.D{{"userid", userID}, {"imageid", img.ID}}, entry,
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+// updateSearchEntries applies the update on the search entries of the images of user, the search entries
+// are secondary to the images so a failure is only logged and fixed by reindexing
+func updateSearchEntries(userID string, imageIDs []string, update bson.D) {
+	err := updateSearchEntriesWithFilter(bson.D{{"userid", userID}, {"imageid", bson.D{{"$in", imageIDs}}}}, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, searchService, userID, err.Error())
+	}
+}
+
+// updateSearchAlbum sets the images of album on the search entries of user
+func updateSearchAlbum(userID string, albumID string, imageIDs []string) {
+	err := updateSearchEntriesWithFilter(bson.D{{"userid", userID}}, bson.D{{"$pull", bson.D{{"albumids", albumID}}}})
+	if err == nil {
+		err = updateSearchEntriesWithFilter(bson.D{{"userid", userID}, {"imageid", bson.D{{"$in", imageIDs}}}},
+			bson.D{{"$addToSet", bson.D{{"albumids", albumID}}}})
+	}
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, searchService, userID, err.Error())
+	}
+}
+
+// removeSearchAlbums removes the albums from the search entries of user
+func removeSearchAlbums(userID string, albumIDs []string) {
+	err := updateSearchEntriesWithFilter(bson.D{{"userid", userID}},
+		bson.D{{"$pull", bson.D{{"albumids", bson.D{{"$in", albumIDs}}}}}})
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, searchService, userID, err.Error())
+	}
+}
+
+// addSearchEntry indexes a new image of user
+func addSearchEntry(userID string, img db.ImageInfo) {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err == nil {
+		err = indexImage((*client).Database(db.MainDbName).Collection(db.ImagesCollection), userID, img, nil)
+	}
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotInsertToDb, searchService, userID, err.Error())
+	}
+}
+
+// removeSearchEntries removes the search entries of the purged images of user
+func removeSearchEntries(userID string, imageIDs []string) {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err == nil {
+		_, err = (*client).Database(db.MainDbName).Collection(db.ImagesCollection).
+			DeleteMany(context.TODO(), bson.D{{"userid", userID}, {"imageid", bson.D{{"$in", imageIDs}}}})
+	}
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, searchService, userID, err.Error())
+	}
+}
+
+func updateSearchEntriesWithFilter(filter bson.D, update bson.D) error {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		return err
+	}
+	_, err = (*client).Database(db.MainDbName).Collection(db.ImagesCollection).UpdateMany(context.TODO(), filter, update)
+	return err
+}
+
+// normalizeTags lowercases and trims the tags and removes the empty and duplicate ones
+func normalizeTags(tags []string) []string {
+	normalized := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if len(tag) > 0 && !seen[tag] {
+			normalized = append(normalized, tag)
+			seen[tag] = true
+		}
+	}
+	return normalized
+}
+
+func splitTags(tags string) []string {
+	if len(tags) == 0 {
+		return nil
+	}
+	return normalizeTags(strings.Split(tags, ","))
+}
+
+func getImageTags(img db.ImageInfo) []string {
+	if img.Tags == nil {
+		return []string{}
+	}
+	return img.Tags
+}
+
+func getSearchLimit(limitStr string, defaultLimit int64, maxLimit int64) int64 {
+	limit, err := strconv.ParseInt(limitStr, 10, 64)
+	if err != nil || limit <= 0 {
+		return defaultLimit
+	}
+	if limit > maxLimit {
+		return maxLimit
+	}
+	return limit
+}
@@ -0,0 +1,424 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/matba/slyde-server/internals/db"
+	"github.com/matba/slyde-server/internals/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const shareService = "SHARE"
+const sharePasswordHeader = "X-Share-Password"
+const shareTokenLength = 24
+
+// HandleShareLink handles API calls of owners for creating, listing and revoking their share links
+func HandleShareLink(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	log.Printf("Incoming call for share links")
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, shareService)
+	if err != nil {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		handleShareLinkGet(w, user)
+	case "POST":
+		handleShareLinkPost(w, r, user)
+	case "DELETE":
+		handleShareLinkDel(w, r, user)
+	default:
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+}
+
+func handleShareLinkGet(w http.ResponseWriter, user *db.User) {
+	links := []userShareLink{}
+	for _, link := range user.ShareLinks {
+		links = append(links, toUserShareLink(link))
+	}
+	js, _ := json.Marshal(userShareLinks{ShareLinkList: links})
+	w.Write(js)
+}
+
+func handleShareLinkPost(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request shareLinkRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, shareService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	if len(request.Scope) == 0 {
+		request.Scope = db.ShareScopeView
+	}
+	if request.Scope != db.ShareScopeView || request.ExpiresIn < 0 {
+		log.Printf(errLogTemplate, errLogValidation, shareService, user.Email, request.Scope)
+		WriteErrorOnResponse(errInvalidShareLink, &w, http.StatusBadRequest)
+		return
+	}
+	switch request.Type {
+	case db.ShareTargetAlbum:
+		if findUserAlbum(user, request.Target) == nil {
+			log.Printf(errLogTemplate, errLogNotFound, shareService, user.Email, request.Target)
+			WriteErrorOnResponse(errAlbumNotFound, &w, http.StatusNotFound)
+			return
+		}
+	case db.ShareTargetSlideshow:
+		if findUserSlideshow(user, request.Target) == nil {
+			log.Printf(errLogTemplate, errLogNotFound, shareService, user.Email, request.Target)
+			WriteErrorOnResponse(errSlideshowNotFound, &w, http.StatusNotFound)
+			return
+		}
+	default:
+		log.Printf(errLogTemplate, errLogValidation, shareService, user.Email, request.Type)
+		WriteErrorOnResponse(errInvalidShareLink, &w, http.StatusBadRequest)
+		return
+	}
+
+	token, err := generateShareToken()
+	if err != nil {
+		log.Printf(errLogTemplate, errLogIoError, shareService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := uuid.NewUUID()
+	link := db.ShareLink{
+		ID:           id.String(),
+		TokenHash:    hashShareToken(token),
+		TargetType:   request.Type,
+		TargetID:     request.Target,
+		Scope:        request.Scope,
+		CreationDate: time.Now(),
+	}
+	if len(request.Password) > 0 {
+		link.PasswordHash = utils.HashAndSalt(request.Password)
+	}
+	if request.ExpiresIn > 0 {
+		link.ExpiryDate = link.CreationDate.Add(time.Duration(request.ExpiresIn) * time.Second)
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, shareService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}}
+	update := bson.D{
+		{"$push", bson.D{
+			{"sharelinks", link},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, shareService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	// the token is not stored, so this is the only time the url of link can be returned
+	userLink := toUserShareLink(link)
+	userLink.URL = "/shared?token=" + token
+	js, _ := json.Marshal(userLink)
+	w.Write(js)
+}
+
+// handleShareLinkDel revokes the share links, the links stop working immediately
+func handleShareLinkDel(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request shareLinkDeleteRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, shareService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	revokeRequestSet := make(map[string]bool)
+	for _, linkID := range request.ShareLinkIds {
+		revokeRequestSet[linkID] = true
+	}
+	revokedLinks := []string{}
+	for _, link := range user.ShareLinks {
+		if revokeRequestSet[link.ID] {
+			revokedLinks = append(revokedLinks, link.ID)
+		}
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, shareService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}}
+	update := bson.D{
+		{"$pull", bson.D{
+			{"sharelinks", bson.D{
+				{"id", bson.D{
+					{"$in", revokedLinks},
+				}},
+			}},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, shareService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(shareLinkDeleteResponse{
+		NumberRevoked: len(revokedLinks),
+	})
+	w.Write(js)
+}
+
+// HandleShared returns the read-only listing of the album or slideshow of a share link, it does not need a session
+func HandleShared(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	if r.Method != "GET" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	user, link := getSharedLink(w, r)
+	if link == nil {
+		return
+	}
+	if len(link.PasswordHash) > 0 && !utils.ComparePasswords(link.PasswordHash, getSharePassword(r)) {
+		log.Printf(errLogTemplate, errLogWrongCredentials, shareService, link.ID, "")
+		WriteErrorOnResponse(errSharePasswordRequired, &w, http.StatusUnauthorized)
+		return
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, shareService, link.ID, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}, {"sharelinks.id", link.ID}}
+	update := bson.D{
+		{"$inc", bson.D{
+			{"sharelinks.$.views", 1},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, shareService, link.ID, err.Error())
+	}
+
+	shared := sharedCollection{Type: link.TargetType, Views: link.Views + 1, Images: []sharedImage{}}
+	if link.TargetType == db.ShareTargetAlbum {
+		shared.Name = findUserAlbum(user, link.TargetID).Name
+	} else {
+		slideshow := findUserSlideshow(user, link.TargetID)
+		shared.Name = slideshow.Name
+		shared.Interval = slideshow.Interval
+	}
+	token := r.FormValue("token")
+	accessKey := getShareAccessKey(link)
+	for _, img := range getSharedImages(user, link) {
+		shared.Images = append(shared.Images, sharedImage{
+			ID:           img.ID,
+			Name:         img.Name,
+			Width:        img.Width,
+			Height:       img.Height,
+			URL:          getSharedImageURL(token, accessKey, img.ID, img.Hash, false),
+			ThumbnailURL: getSharedImageURL(token, accessKey, img.ID, img.ThumbnailHash, true),
+		})
+	}
+
+	js, _ := json.Marshal(shared)
+	w.Write(js)
+}
+
+// HandleSharedImage serves an image of a share link, only the images in the shared album or slideshow are served
+func HandleSharedImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	user, link := getSharedLink(w, r)
+	if link == nil {
+		return
+	}
+	// the listing gives the key to image urls after the password is checked
+	expectedKey := getShareAccessKey(link)
+	if len(expectedKey) > 0 && subtle.ConstantTimeCompare([]byte(expectedKey), []byte(r.FormValue("key"))) != 1 {
+		log.Printf(errLogTemplate, errLogWrongCredentials, shareService, link.ID, "")
+		WriteErrorOnResponse(errSharePasswordRequired, &w, http.StatusUnauthorized)
+		return
+	}
+
+	for _, img := range getSharedImages(user, link) {
+		if img.ID == r.FormValue("id") {
+			serveUserImage(w, withoutOwnerRenderParams(r), user, img, link.ID)
+			return
+		}
+	}
+	log.Printf(errLogTemplate, errLogNotFound, shareService, link.ID, r.FormValue("id"))
+	WriteErrorOnResponse(errNotFound, &w, http.StatusNotFound)
+}
+
+// getSharedLink finds the share link of the token in request and its owner, if the link does not work
+// appropriate response is written to output and nil is returned
+func getSharedLink(w http.ResponseWriter, r *http.Request) (*db.User, *db.ShareLink) {
+	token := r.FormValue("token")
+	if len(token) == 0 {
+		WriteErrorOnResponse(errShareLinkNotFound, &w, http.StatusNotFound)
+		return nil, nil
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, shareService, "", err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return nil, nil
+	}
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	tokenHash := hashShareToken(token)
+	var user db.User
+	err = collection.FindOne(context.TODO(), bson.D{{"sharelinks.tokenhash", tokenHash}}).Decode(&user)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogNotFound, shareService, "", err.Error())
+		WriteErrorOnResponse(errShareLinkNotFound, &w, http.StatusNotFound)
+		return nil, nil
+	}
+
+	var link *db.ShareLink
+	for i := range user.ShareLinks {
+		if user.ShareLinks[i].TokenHash == tokenHash {
+			link = &user.ShareLinks[i]
+		}
+	}
+	// the target of link may have been deleted after the link was created
+	if link == nil || (!link.ExpiryDate.IsZero() && time.Now().After(link.ExpiryDate)) ||
+		(link.TargetType == db.ShareTargetAlbum && findUserAlbum(&user, link.TargetID) == nil) ||
+		(link.TargetType == db.ShareTargetSlideshow && findUserSlideshow(&user, link.TargetID) == nil) {
+		log.Printf(errLogTemplate, errLogNotFound, shareService, "", "Share link expired or its target is deleted.")
+		WriteErrorOnResponse(errShareLinkNotFound, &w, http.StatusNotFound)
+		return nil, nil
+	}
+	return &user, link
+}
+
+// withoutOwnerRenderParams returns the request without the parameters that render an image with the
+// slideshows or profiles of owner, their overlays can show the names of other albums and other captions
+func withoutOwnerRenderParams(r *http.Request) *http.Request {
+	query := r.URL.Query()
+	query.Del("slideshow")
+	query.Del("profile")
+	shared := r.Clone(r.Context())
+	shared.URL.RawQuery = query.Encode()
+	// the form is parsed again from the url without the parameters
+	shared.Form = nil
+	shared.PostForm = nil
+	return shared
+}
+
+// getSharedImages returns the ready images of the album or slideshow of share link
+func getSharedImages(user *db.User, link *db.ShareLink) []db.ImageInfo {
+	if link.TargetType == db.ShareTargetSlideshow {
+		return getSlideshowImages(user, findUserSlideshow(user, link.TargetID), "")
+	}
+	images := []db.ImageInfo{}
+	for _, img := range getAlbumImages(user, findUserAlbum(user, link.TargetID)) {
+		if img.IsReady() {
+			images = append(images, img)
+		}
+	}
+	return images
+}
+
+// getShareAccessKey returns the key that image urls of a protected link carry, it is derived from the
+// salted hash of password so it cannot be computed without the password being checked by the server
+func getShareAccessKey(link *db.ShareLink) string {
+	if len(link.PasswordHash) == 0 {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(link.TokenHash + "/" + link.PasswordHash))
+	return hex.EncodeToString(hash[:])
+}
+
+func getSharePassword(r *http.Request) string {
+	if password := r.Header.Get(sharePasswordHeader); len(password) > 0 {
+		return password
+	}
+	return r.FormValue("password")
+}
+
+func getSharedImageURL(token string, accessKey string, imageID string, version string, isThumbnail bool) string {
+	query := url.Values{}
+	query.Set("token", token)
+	query.Set("id", imageID)
+	if len(accessKey) > 0 {
+		query.Set("key", accessKey)
+	}
+	if isThumbnail {
+		query.Set("thumbnail", "1")
+	}
+	if len(version) > 0 {
+		query.Set("v", version)
+	}
+	return "/shared/images?" + query.Encode()
+}
+
+func generateShareToken() (string, error) {
+	token := make([]byte, shareTokenLength)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+func hashShareToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func toUserShareLink(link db.ShareLink) userShareLink {
+	userLink := userShareLink{
+		ID:           link.ID,
+		Type:         link.TargetType,
+		Target:       link.TargetID,
+		Scope:        link.Scope,
+		Protected:    len(link.PasswordHash) > 0,
+		Views:        link.Views,
+		CreationDate: link.CreationDate,
+	}
+	if !link.ExpiryDate.IsZero() {
+		expiryDate := link.ExpiryDate
+		userLink.ExpiryDate = &expiryDate
+	}
+	return userLink
+}
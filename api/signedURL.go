@@ -0,0 +1,170 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/matba/slyde-server/internals/config"
+	"github.com/matba/slyde-server/internals/db"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const signedURLService = "SIGNED_URL"
+const signatureKey = "sig"
+const signatureKeyIDKey = "kid"
+const signatureExpiryKey = "exp"
+const signatureUserKey = "uid"
+
+// the render parameters of listing request that are copied to the signed urls of images
+var signedVariantKeys = []string{"w", "h", "fit", "bg", "fx", "fy", "quality", "format", "width"}
+
+// isSignedRequest checks whether the request carries a url signature instead of a session
+func isSignedRequest(r *http.Request) bool {
+	return len(r.URL.Query().Get(signatureKey)) > 0
+}
+
+// signImageURL signs the query of an image url with the current key, the signature covers every
+// parameter of the query, so the image, its variant and the expiry cannot be changed.
+func signImageURL(userID string, query url.Values, expiry time.Time) (string, error) {
+	keys := config.GetServerConfig().URLSigningKeys
+	if len(keys) == 0 {
+		return "", errors.New("No url signing key is configured")
+	}
+	key := keys[0]
+
+	signed := url.Values{}
+	for k, v := range query {
+		signed[k] = v
+	}
+	signed.Set(signatureUserKey, userID)
+	signed.Set(signatureExpiryKey, strconv.FormatInt(expiry.Unix(), 10))
+	signed.Set(signatureKeyIDKey, key.ID)
+	signed.Set(signatureKey, computeURLSignature(key.Secret, signed))
+	return "/images?" + signed.Encode(), nil
+}
+
+// verifySignedRequest checks the signature and expiry of request and returns the id of user that signed it
+func verifySignedRequest(r *http.Request) (string, error) {
+	query := r.URL.Query()
+	key := config.GetServerConfig().GetSigningKey(query.Get(signatureKeyIDKey))
+	if key == nil {
+		return "", errors.New("Unknown signing key")
+	}
+
+	expected := computeURLSignature(key.Secret, query)
+	if !hmac.Equal([]byte(expected), []byte(query.Get(signatureKey))) {
+		return "", errors.New("Signature mismatch")
+	}
+
+	expiry, err := strconv.ParseInt(query.Get(signatureExpiryKey), 10, 64)
+	if err != nil {
+		return "", err
+	}
+	if time.Now().Unix() > expiry {
+		return "", errors.New("Signed url expired")
+	}
+
+	// a signature only grants access to a single image, never to the listing
+	if len(query.Get("id")) == 0 || len(query.Get(signatureUserKey)) == 0 {
+		return "", errors.New("Signed url without image")
+	}
+	return query.Get(signatureUserKey), nil
+}
+
+// computeURLSignature returns the HMAC of the query without the signature, Encode sorts the parameters by key
+func computeURLSignature(secret string, query url.Values) string {
+	unsigned := url.Values{}
+	for k, v := range query {
+		if k != signatureKey {
+			unsigned[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// getSignedRequestUser verifies the signature of request and loads the user that signed it, if there is an
+// error appropriate response is written to output
+func getSignedRequestUser(w http.ResponseWriter, r *http.Request) (*db.User, error) {
+	userID, err := verifySignedRequest(r)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogInvalidSignature, signedURLService, r.URL.RawQuery, err.Error())
+		WriteErrorOnResponse(errInvalidSignature, &w, http.StatusForbidden)
+		return nil, err
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, signedURLService, userID, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return nil, err
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	var user db.User
+	err = collection.FindOne(context.TODO(), bson.D{{"id", userID}}).Decode(&user)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, signedURLService, userID, err.Error())
+		WriteErrorOnResponse(errInvalidSignature, &w, http.StatusForbidden)
+		return nil, err
+	}
+	return &user, nil
+}
+
+// getSignedURLExpiry returns the expiry of signed urls asked in the ttl parameter of request in seconds,
+// limited to the maximum of server
+func getSignedURLExpiry(r *http.Request) time.Time {
+	serverConfig := config.GetServerConfig()
+	ttl := serverConfig.SignedURLTTL
+	if requested, err := strconv.ParseInt(r.FormValue("ttl"), 10, 64); err == nil && requested > 0 {
+		ttl = requested
+	}
+	if ttl > serverConfig.MaxSignedURLTTL {
+		ttl = serverConfig.MaxSignedURLTTL
+	}
+	return time.Now().Add(time.Duration(ttl) * time.Second)
+}
+
+// addSignedURLs sets the signed urls of image and its thumbnail, the variant parameters of request
+// are kept in the url of image
+func addSignedURLs(userImage *UserImage, userID string, img db.ImageInfo, r *http.Request, expiry time.Time) error {
+	query := url.Values{}
+	query.Set("id", img.ID)
+	if len(img.Hash) > 0 {
+		query.Set("v", img.Hash)
+	}
+	for _, k := range signedVariantKeys {
+		if v := r.FormValue(k); len(v) > 0 {
+			query.Set(k, v)
+		}
+	}
+	signedURL, err := signImageURL(userID, query, expiry)
+	if err != nil {
+		return err
+	}
+
+	thumbnailQuery := url.Values{}
+	thumbnailQuery.Set("id", img.ID)
+	thumbnailQuery.Set("thumbnail", "1")
+	if len(img.ThumbnailHash) > 0 {
+		thumbnailQuery.Set("v", img.ThumbnailHash)
+	}
+	signedThumbnailURL, err := signImageURL(userID, thumbnailQuery, expiry)
+	if err != nil {
+		return err
+	}
+
+	userImage.SignedURL = signedURL
+	userImage.SignedThumbnailURL = signedThumbnailURL
+	return nil
+}
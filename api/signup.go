@@ -14,6 +14,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/matba/slyde-server/internals/cacher"
+	"github.com/matba/slyde-server/internals/config"
 	"github.com/matba/slyde-server/internals/db"
 	"github.com/matba/slyde-server/internals/email"
 	"github.com/matba/slyde-server/internals/utils"
@@ -215,8 +216,11 @@ func VerifyEmail(w http.ResponseWriter, r *http.Request) {
 		SecurityInfo: db.SecurityInformation{Password: utils.HashAndSalt(signupReq.Password)},
 		Name:         signupReq.Name,
 		CreationDate: time.Now(),
-		ImageQuota:   10,
+		StorageQuota: config.GetServerConfig().DefaultStorageQuota,
 		Images:       []db.ImageInfo{},
+		Albums:       []db.Album{},
+		Slideshows:   []db.Slideshow{},
+		ShareLinks:   []db.ShareLink{},
 	}
 
 	//get the client
@@ -0,0 +1,488 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/matba/slyde-server/internals/db"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const slideshowService = "SLIDESHOW"
+const defaultSlideshowInterval = 30
+const defaultSlideshowRepeatWindow = 20
+const maxSlideshowSlides = 1000
+
+// HandleSlideshow handles API calls for slideshows
+func HandleSlideshow(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	log.Printf("Incoming call for slideshows")
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, slideshowService)
+	if err != nil {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		handleSlideshowGet(w, r, user)
+	case "POST":
+		handleSlideshowPost(w, r, user)
+	case "PUT":
+		handleSlideshowPut(w, r, user)
+	case "DELETE":
+		handleSlideshowDel(w, r, user)
+	default:
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+}
+
+// handleSlideshowGet lists the slideshows of user, or returns a slideshow with its images in the order
+// they should be shown if an id is given. The same seed always gives the same order and count sets the
+// number of slides picked by weighted slideshows. Slideshows that pair portrait images get composites of
+// the pairs at the w and h resolution of frame as virtual slides.
+func handleSlideshowGet(w http.ResponseWriter, r *http.Request, user *db.User) {
+	if len(r.FormValue("id")) == 0 {
+		slideshows := []userSlideshow{}
+		for _, slideshow := range user.Slideshows {
+			slideshows = append(slideshows, toUserSlideshow(slideshow))
+		}
+		js, _ := json.Marshal(userSlideshows{SlideshowList: slideshows})
+		w.Write(js)
+		return
+	}
+
+	slideshow := findUserSlideshow(user, r.FormValue("id"))
+	if slideshow == nil {
+		log.Printf(errLogTemplate, errLogNotFound, slideshowService, user.Email, r.FormValue("id"))
+		WriteErrorOnResponse(errSlideshowNotFound, &w, http.StatusNotFound)
+		return
+	}
+
+	seed, err := strconv.ParseInt(r.FormValue("seed"), 10, 64)
+	if err != nil {
+		seed = time.Now().UnixNano()
+	}
+	images := getSlideshowImages(user, slideshow, "")
+	count, err := strconv.Atoi(r.FormValue("count"))
+	if err != nil || count <= 0 {
+		count = len(images)
+	}
+	if count > maxSlideshowSlides {
+		count = maxSlideshowSlides
+	}
+
+	width, height, err := parseCompositeSize(r)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogValidation, slideshowService, user.Email, err.Error())
+		WriteErrorOnResponse(errInvalidRenderSize, &w, http.StatusBadRequest)
+		return
+	}
+
+	slideshowJSON := toUserSlideshow(*slideshow)
+	slideshowJSON.Images = []UserImage{}
+	images = orderSlideshowImages(slideshow, images, seed, count)
+	// portrait images are only paired on landscape frames
+	if slideshow.Layout != db.SlideshowLayoutPortraitPairs || width <= height {
+		for _, img := range images {
+			slideshowJSON.Images = append(slideshowJSON.Images, toSlideshowImage(user, slideshow, img))
+		}
+		js, _ := json.Marshal(slideshowJSON)
+		w.Write(js)
+		return
+	}
+
+	for _, slide := range pairSlideshowImages(user, slideshow, images) {
+		if len(slide) == 1 {
+			slideshowJSON.Images = append(slideshowJSON.Images, toSlideshowImage(user, slideshow, slide[0]))
+		} else {
+			slideshowJSON.Images = append(slideshowJSON.Images, toCompositeSlide(user, slideshow, slide, width, height))
+		}
+	}
+	js, _ := json.Marshal(slideshowJSON)
+	w.Write(js)
+}
+
+func handleSlideshowPost(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request slideshowRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, slideshowService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+	if len(request.Name) == 0 {
+		log.Printf(errLogTemplate, errLogMissingField, slideshowService, user.Email, "Slideshow name not provided.")
+		WriteErrorOnResponse(errBadRequest, &w, http.StatusBadRequest)
+		return
+	}
+
+	id, _ := uuid.NewUUID()
+	slideshow := db.Slideshow{
+		ID:           id.String(),
+		Name:         request.Name,
+		Interval:     defaultSlideshowInterval,
+		Order:        db.SlideshowOrderSequential,
+		RepeatWindow: defaultSlideshowRepeatWindow,
+		Layout:       db.SlideshowLayoutSingle,
+		Pairing:      db.SlideshowPairingDate,
+		Gutter:       defaultSlideshowGutter,
+		Background:   defaultSlideshowBackground,
+		CreationDate: time.Now(),
+	}
+	if !updateSlideshowFromRequest(w, user, &slideshow, request) {
+		return
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, slideshowService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}}
+	update := bson.D{
+		{"$push", bson.D{
+			{"slideshows", slideshow},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, slideshowService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(toUserSlideshow(slideshow))
+	w.Write(js)
+}
+
+func handleSlideshowPut(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request slideshowRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, slideshowService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	slideshow := findUserSlideshow(user, request.ID)
+	if slideshow == nil {
+		log.Printf(errLogTemplate, errLogNotFound, slideshowService, user.Email, request.ID)
+		WriteErrorOnResponse(errSlideshowNotFound, &w, http.StatusNotFound)
+		return
+	}
+	if len(request.Name) > 0 {
+		slideshow.Name = request.Name
+	}
+	if !updateSlideshowFromRequest(w, user, slideshow, request) {
+		return
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, slideshowService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}, {"slideshows.id", slideshow.ID}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"slideshows.$", *slideshow},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, slideshowService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(toUserSlideshow(*slideshow))
+	w.Write(js)
+}
+
+func handleSlideshowDel(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request slideshowDeleteRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, slideshowService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	deleteRequestSet := make(map[string]bool)
+	for _, slideshowID := range request.SlideshowIds {
+		deleteRequestSet[slideshowID] = true
+	}
+	deletedSlideshows := []string{}
+	for _, slideshow := range user.Slideshows {
+		if deleteRequestSet[slideshow.ID] {
+			deletedSlideshows = append(deletedSlideshows, slideshow.ID)
+		}
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, slideshowService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}}
+	update := bson.D{
+		{"$pull", bson.D{
+			{"slideshows", bson.D{
+				{"id", bson.D{
+					{"$in", deletedSlideshows},
+				}},
+			}},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, slideshowService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(slideshowDeleteResponse{
+		NumberDeleted: len(deletedSlideshows),
+	})
+	w.Write(js)
+}
+
+// updateSlideshowFromRequest validates the settings in request and sets them on slideshow, if they are
+// not valid appropriate response is written to output
+func updateSlideshowFromRequest(w http.ResponseWriter, user *db.User, slideshow *db.Slideshow, request slideshowRequest) bool {
+	if request.AlbumID != nil && len(*request.AlbumID) > 0 && findUserAlbum(user, *request.AlbumID) == nil {
+		log.Printf(errLogTemplate, errLogNotFound, slideshowService, user.Email, *request.AlbumID)
+		WriteErrorOnResponse(errAlbumNotFound, &w, http.StatusNotFound)
+		return false
+	}
+	if request.Interval < 0 || !isSlideshowOrder(request.Order) || !isSlideshowSource(request.Source) || (request.RepeatWindow != nil && *request.RepeatWindow < 0) ||
+		!isSlideshowLayout(request.Layout) || !isSlideshowPairing(request.Pairing) ||
+		(request.Gutter != nil && (*request.Gutter < 0 || *request.Gutter > maxSlideshowGutter)) {
+		log.Printf(errLogTemplate, errLogValidation, slideshowService, user.Email, request.Order)
+		WriteErrorOnResponse(errInvalidSlideshow, &w, http.StatusBadRequest)
+		return false
+	}
+	if len(request.Background) > 0 {
+		background, err := parseHexColor(request.Background)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogValidation, slideshowService, user.Email, err.Error())
+			WriteErrorOnResponse(errInvalidSlideshow, &w, http.StatusBadRequest)
+			return false
+		}
+		slideshow.Background = toHexColor(int(background.R), int(background.G), int(background.B))
+	}
+	if request.Overlays != nil {
+		overlays, err := parseOverlays(*request.Overlays)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogValidation, slideshowService, user.Email, err.Error())
+			WriteErrorOnResponse(errInvalidOverlay, &w, http.StatusBadRequest)
+			return false
+		}
+		slideshow.Overlays = overlays
+	}
+
+	if request.AlbumID != nil {
+		slideshow.AlbumID = *request.AlbumID
+	}
+	if request.Source != nil {
+		slideshow.Source = *request.Source
+	}
+	if request.Interval > 0 {
+		slideshow.Interval = request.Interval
+	}
+	if len(request.Order) > 0 {
+		slideshow.Order = request.Order
+	}
+	if request.RepeatWindow != nil {
+		slideshow.RepeatWindow = *request.RepeatWindow
+	}
+	if len(request.Layout) > 0 {
+		slideshow.Layout = request.Layout
+	}
+	if len(request.Pairing) > 0 {
+		slideshow.Pairing = request.Pairing
+	}
+	if request.Gutter != nil {
+		slideshow.Gutter = *request.Gutter
+	}
+	return true
+}
+
+func isSlideshowOrder(order string) bool {
+	return order == "" || order == db.SlideshowOrderSequential || order == db.SlideshowOrderShuffle ||
+		order == db.SlideshowOrderWeighted
+}
+
+func isSlideshowSource(source *string) bool {
+	return source == nil || *source == "" || *source == db.SlideshowSourceMemories
+}
+
+func isSlideshowLayout(layout string) bool {
+	return layout == "" || layout == db.SlideshowLayoutSingle || layout == db.SlideshowLayoutPortraitPairs
+}
+
+func isSlideshowPairing(pairing string) bool {
+	return pairing == "" || pairing == db.SlideshowPairingDate || pairing == db.SlideshowPairingAlbum
+}
+
+// findUserSlideshow returns the slideshow of user with the id or nil if the user does not have such slideshow
+func findUserSlideshow(user *db.User, slideshowID string) *db.Slideshow {
+	for i := range user.Slideshows {
+		if user.Slideshows[i].ID == slideshowID {
+			return &user.Slideshows[i]
+		}
+	}
+	return nil
+}
+
+// getSlideshowImages returns the images that can be shown in the slideshow in the order of its source,
+// the images that are still processing and the images user never wants to see are left out. Memories are
+// picked by the day in the timezone, or in the timezone of user if it is empty.
+func getSlideshowImages(user *db.User, slideshow *db.Slideshow, timezone string) []db.ImageInfo {
+	sourceImages := getActiveImages(user)
+	if slideshow.Source == db.SlideshowSourceMemories {
+		sourceImages = getMemoryImages(user, timezone)
+	} else if len(slideshow.AlbumID) > 0 {
+		album := findUserAlbum(user, slideshow.AlbumID)
+		if album == nil {
+			return []db.ImageInfo{}
+		}
+		sourceImages = getAlbumImages(user, album)
+	}
+
+	images := []db.ImageInfo{}
+	for _, img := range sourceImages {
+		if img.IsReady() && !img.NeverShow {
+			images = append(images, img)
+		}
+	}
+	return images
+}
+
+// orderSlideshowImages puts the images in the order of slideshow, the same seed gives the same order. The
+// weighted order picks count slides and the other orders show each image once.
+func orderSlideshowImages(slideshow *db.Slideshow, images []db.ImageInfo, seed int64, count int) []db.ImageInfo {
+	random := rand.New(rand.NewSource(seed))
+	switch slideshow.Order {
+	case db.SlideshowOrderShuffle:
+		random.Shuffle(len(images), func(i, j int) {
+			images[i], images[j] = images[j], images[i]
+		})
+	case db.SlideshowOrderWeighted:
+		return selectWeightedImages(images, count, slideshow.RepeatWindow, random)
+	}
+	return images
+}
+
+// selectWeightedImages picks count images randomly with the weight of their rating. An image is not picked
+// again until window other slides are shown, the window is made smaller if there are not enough images.
+func selectWeightedImages(images []db.ImageInfo, count int, window int, random *rand.Rand) []db.ImageInfo {
+	selected := []db.ImageInfo{}
+	if len(images) == 0 {
+		return selected
+	}
+	if window >= len(images) {
+		window = len(images) - 1
+	}
+
+	// the indexes of images picked in the window, the oldest first
+	recent := []int{}
+	inWindow := make(map[int]bool)
+	for len(selected) < count {
+		var total float64
+		for i, img := range images {
+			if !inWindow[i] {
+				total += getImageWeight(img)
+			}
+		}
+
+		target := random.Float64() * total
+		picked := -1
+		for i, img := range images {
+			if inWindow[i] {
+				continue
+			}
+			picked = i
+			target -= getImageWeight(img)
+			if target < 0 {
+				break
+			}
+		}
+
+		selected = append(selected, images[picked])
+		if window > 0 {
+			recent = append(recent, picked)
+			inWindow[picked] = true
+			if len(recent) > window {
+				delete(inWindow, recent[0])
+				recent = recent[1:]
+			}
+		}
+	}
+	return selected
+}
+
+// getImageWeight returns how likely the image is picked, an unrated image has the weight of one and each
+// star adds one, favorites are picked twice as often
+func getImageWeight(img db.ImageInfo) float64 {
+	weight := float64(1 + img.Rating)
+	if img.Favorite {
+		weight *= 2
+	}
+	return weight
+}
+
+// toSlideshowImage converts the image of slideshow, if the slideshow has overlays the url of image selects
+// them so the sizes frames render the image at get the overlays. The version in url includes the texts of
+// overlays, so the url changes when a caption or album changes.
+func toSlideshowImage(user *db.User, slideshow *db.Slideshow, img db.ImageInfo) UserImage {
+	userImage := toUserImage(img)
+	if len(slideshow.Overlays) > 0 {
+		overlays := getImageOverlays(user, img, slideshow.Overlays, slideshow.AlbumID)
+		userImage.URL = getImageURL(img.ID, getOverlaysVersion(img.Hash, overlays), false) +
+			"&slideshow=" + url.QueryEscape(slideshow.ID)
+	}
+	return userImage
+}
+
+func toUserSlideshow(slideshow db.Slideshow) userSlideshow {
+	return userSlideshow{
+		ID:           slideshow.ID,
+		Name:         slideshow.Name,
+		AlbumID:      slideshow.AlbumID,
+		Source:       slideshow.Source,
+		Interval:     slideshow.Interval,
+		Order:        slideshow.Order,
+		RepeatWindow: slideshow.RepeatWindow,
+		Layout:       slideshow.Layout,
+		Pairing:      slideshow.Pairing,
+		Gutter:       slideshow.Gutter,
+		Background:   slideshow.Background,
+		Overlays:     toUserOverlays(slideshow.Overlays),
+		CreationDate: slideshow.CreationDate,
+	}
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/matba/slyde-server/internals/db"
+)
+
+func TestOrderSlideshowImages(t *testing.T) {
+	plain := []db.ImageInfo{{ID: "a"}, {ID: "b"}, {ID: "c"}, {ID: "d"}}
+	weighted := []db.ImageInfo{{ID: "unrated"}, {ID: "rated", Rating: 2}, {ID: "favorite", Rating: 5, Favorite: true}}
+
+	tests := []struct {
+		name      string
+		slideshow db.Slideshow
+		images    []db.ImageInfo
+		seed      int64
+		count     int
+		check     func(t *testing.T, ordered []db.ImageInfo)
+	}{
+		{
+			name:      "sequential keeps the order of source",
+			slideshow: db.Slideshow{Order: db.SlideshowOrderSequential},
+			images:    plain,
+			seed:      1,
+			count:     10,
+			check: func(t *testing.T, ordered []db.ImageInfo) {
+				assertImageIDs(t, ordered, []string{"a", "b", "c", "d"})
+			},
+		},
+		{
+			name:      "shuffle shows each image once",
+			slideshow: db.Slideshow{Order: db.SlideshowOrderShuffle},
+			images:    plain,
+			seed:      7,
+			count:     10,
+			check: func(t *testing.T, ordered []db.ImageInfo) {
+				counts := countImageIDs(ordered)
+				if len(ordered) != len(plain) || len(counts) != len(plain) {
+					t.Errorf("expected every image once, got %v", imageIDs(ordered))
+				}
+			},
+		},
+		{
+			name:      "weighted picks count slides by rating and favorite",
+			slideshow: db.Slideshow{Order: db.SlideshowOrderWeighted},
+			images:    weighted,
+			seed:      42,
+			count:     16000,
+			check: func(t *testing.T, ordered []db.ImageInfo) {
+				if len(ordered) != 16000 {
+					t.Fatalf("expected 16000 slides, got %d", len(ordered))
+				}
+				// the weights are 1, 3 and 12 so the images get 1/16, 3/16 and 12/16 of the slides
+				counts := countImageIDs(ordered)
+				assertShare(t, "unrated", counts["unrated"], 1000)
+				assertShare(t, "rated", counts["rated"], 3000)
+				assertShare(t, "favorite", counts["favorite"], 12000)
+			},
+		},
+		{
+			name:      "weighted does not repeat an image inside the window",
+			slideshow: db.Slideshow{Order: db.SlideshowOrderWeighted, RepeatWindow: 2},
+			images:    append([]db.ImageInfo{{ID: "top", Rating: 5, Favorite: true}}, plain...),
+			seed:      3,
+			count:     200,
+			check: func(t *testing.T, ordered []db.ImageInfo) {
+				assertNoRepeatInWindow(t, ordered, 2)
+			},
+		},
+		{
+			name:      "weighted shrinks a window larger than the images",
+			slideshow: db.Slideshow{Order: db.SlideshowOrderWeighted, RepeatWindow: 10},
+			images:    plain,
+			seed:      5,
+			count:     40,
+			check: func(t *testing.T, ordered []db.ImageInfo) {
+				if len(ordered) != 40 {
+					t.Fatalf("expected 40 slides, got %d", len(ordered))
+				}
+				assertNoRepeatInWindow(t, ordered, len(plain)-1)
+			},
+		},
+		{
+			name:      "weighted repeats a single image",
+			slideshow: db.Slideshow{Order: db.SlideshowOrderWeighted, RepeatWindow: 3},
+			images:    []db.ImageInfo{{ID: "only"}},
+			seed:      1,
+			count:     3,
+			check: func(t *testing.T, ordered []db.ImageInfo) {
+				assertImageIDs(t, ordered, []string{"only", "only", "only"})
+			},
+		},
+		{
+			name:      "weighted without images picks nothing",
+			slideshow: db.Slideshow{Order: db.SlideshowOrderWeighted},
+			images:    []db.ImageInfo{},
+			seed:      1,
+			count:     3,
+			check: func(t *testing.T, ordered []db.ImageInfo) {
+				assertImageIDs(t, ordered, []string{})
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			first := orderSlideshowImages(&test.slideshow, copyImages(test.images), test.seed, test.count)
+			test.check(t, first)
+
+			// the same seed gives the same order
+			second := orderSlideshowImages(&test.slideshow, copyImages(test.images), test.seed, test.count)
+			if !reflect.DeepEqual(imageIDs(first), imageIDs(second)) {
+				t.Errorf("expected the same order for the same seed")
+			}
+		})
+	}
+}
+
+func TestSlideshowNeverShowsExcludedImages(t *testing.T) {
+	user := db.User{Images: []db.ImageInfo{
+		{ID: "shown", Rating: 1},
+		{ID: "hidden", Rating: 5, Favorite: true, NeverShow: true},
+		{ID: "processing", Status: db.ImageStatusProcessing},
+		{ID: "legacy"},
+	}}
+	for _, order := range []string{db.SlideshowOrderSequential, db.SlideshowOrderShuffle, db.SlideshowOrderWeighted} {
+		slideshow := db.Slideshow{Order: order}
+		ordered := orderSlideshowImages(&slideshow, getSlideshowImages(&user, &slideshow, ""), 11, 500)
+		counts := countImageIDs(ordered)
+		if counts["hidden"] > 0 || counts["processing"] > 0 {
+			t.Errorf("%s order shows excluded images: %v", order, counts)
+		}
+		if counts["shown"] == 0 || counts["legacy"] == 0 {
+			t.Errorf("%s order misses images: %v", order, counts)
+		}
+	}
+}
+
+func TestSlideshowImageURL(t *testing.T) {
+	img := db.ImageInfo{ID: "image", Hash: "hash", Caption: "At the beach"}
+	user := db.User{Images: []db.ImageInfo{img}}
+	slideshow := db.Slideshow{ID: "slideshow", Overlays: []db.Overlay{{Type: db.OverlayTypeCaption}}}
+
+	query := parseImageURL(t, toSlideshowImage(&user, &slideshow, img).URL)
+	if query.Get("id") != "image" || query.Get("slideshow") != "slideshow" {
+		t.Errorf("expected the image with the overlays of slideshow, got %v", query)
+	}
+	if query.Get("v") == img.Hash {
+		t.Errorf("expected the version to include the overlays, got %q", query.Get("v"))
+	}
+	// the url without a size still renders the overlays
+	if !isRenderRequest(httptest.NewRequest("GET", "/images?"+query.Encode(), nil)) {
+		t.Errorf("expected the url of image to render the overlays")
+	}
+
+	captioned := img
+	captioned.Caption = "At the lake"
+	changed := parseImageURL(t, toSlideshowImage(&user, &slideshow, captioned).URL)
+	if changed.Get("v") == query.Get("v") {
+		t.Errorf("expected the version to change with the caption, got %q for both", query.Get("v"))
+	}
+
+	plain := parseImageURL(t, toSlideshowImage(&user, &db.Slideshow{ID: "plain"}, img).URL)
+	if plain.Get("v") != img.Hash || len(plain.Get("slideshow")) > 0 {
+		t.Errorf("expected the plain image for a slideshow without overlays, got %v", plain)
+	}
+}
+
+func parseImageURL(t *testing.T, imageURL string) url.Values {
+	t.Helper()
+	parsed, err := url.Parse(imageURL)
+	if err != nil {
+		t.Fatalf("invalid url %q: %v", imageURL, err)
+	}
+	return parsed.Query()
+}
+
+func copyImages(images []db.ImageInfo) []db.ImageInfo {
+	return append([]db.ImageInfo{}, images...)
+}
+
+func imageIDs(images []db.ImageInfo) []string {
+	ids := []string{}
+	for _, img := range images {
+		ids = append(ids, img.ID)
+	}
+	return ids
+}
+
+func countImageIDs(images []db.ImageInfo) map[string]int {
+	counts := make(map[string]int)
+	for _, img := range images {
+		counts[img.ID]++
+	}
+	return counts
+}
+
+func assertImageIDs(t *testing.T, images []db.ImageInfo, expected []string) {
+	t.Helper()
+	if !reflect.DeepEqual(imageIDs(images), expected) {
+		t.Errorf("expected %v, got %v", expected, imageIDs(images))
+	}
+}
+
+// assertShare checks the count is within 10 percent of the expected count
+func assertShare(t *testing.T, imageID string, count int, expected int) {
+	t.Helper()
+	if count < expected*9/10 || count > expected*11/10 {
+		t.Errorf("expected about %d slides of %s, got %d", expected, imageID, count)
+	}
+}
+
+func assertNoRepeatInWindow(t *testing.T, images []db.ImageInfo, window int) {
+	t.Helper()
+	lastSeen := make(map[string]int)
+	for i, img := range images {
+		if last, ok := lastSeen[img.ID]; ok && i-last <= window {
+			t.Fatalf("image %s is shown at %d and again at %d", img.ID, last, i)
+		}
+		lastSeen[img.ID] = i
+	}
+}
@@ -1,5 +1,9 @@
 package api
 
+import (
+	"time"
+)
+
 type errorResponse struct {
 	Description string `json:"description"`
 }
@@ -26,8 +30,14 @@ type verifyRequest struct {
 }
 
 type userInformation struct {
-	Email string `json:"email"`
-	Name  string `json:"name"`
+	Email    string `json:"email"`
+	Name     string `json:"name"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+type userUpdateRequest struct {
+	Name     string  `json:"name"`
+	Timezone *string `json:"timezone"`
 }
 
 type UserImage struct {
@@ -35,12 +45,210 @@ type UserImage struct {
 	Name   string `json:"name"`
 	Width  uint   `json:"width"`
 	Height uint   `json:"height"`
+	Status string `json:"status"`
+	// the edits of image are changed and its derivatives are being generated again
+	EditPending  bool     `json:"editPending,omitempty"`
+	JobID        string   `json:"job,omitempty"`
+	Version      string   `json:"version,omitempty"`
+	URL          string   `json:"url"`
+	ThumbnailURL string   `json:"thumbnailUrl"`
+	Caption      string   `json:"caption,omitempty"`
+	Tags         []string `json:"tags"`
+	Favorite     bool     `json:"favorite"`
+	Rating       int      `json:"rating"`
+	NeverShow    bool     `json:"neverShow"`
+	BlurHash     string   `json:"blurHash,omitempty"`
+	AverageColor string   `json:"averageColor,omitempty"`
+	Palette      []string `json:"palette,omitempty"`
+	// the urls that can be fetched without a session until they expire, only returned when requested
+	SignedURL          string `json:"signedUrl,omitempty"`
+	SignedThumbnailURL string `json:"signedThumbnailUrl,omitempty"`
+	// the images a virtual slide is composed of, only set for the composites of slideshows
+	Composite []string `json:"composite,omitempty"`
 }
 
 type UserImages struct {
 	ImageList []UserImage `json:"images"`
 }
 
+type userAppPassword struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// the password is only returned when it is created
+	Password     string    `json:"password,omitempty"`
+	CreationDate time.Time `json:"creationDate"`
+	LastUsedDate time.Time `json:"lastUsedDate"`
+}
+
+type userAppPasswords struct {
+	PasswordList []userAppPassword `json:"passwords"`
+}
+
+type appPasswordRequest struct {
+	Name string `json:"name"`
+}
+
+type appPasswordDeleteRequest struct {
+	PasswordIds []string `json:"passwords"`
+}
+
+type appPasswordDeleteResponse struct {
+	NumberDeleted int `json:"deleted"`
+}
+
+type userMailInbox struct {
+	ID           string    `json:"id"`
+	Address      string    `json:"address"`
+	AlbumID      string    `json:"album,omitempty"`
+	CreationDate time.Time `json:"creationDate"`
+}
+
+type userMailInboxes struct {
+	InboxList []userMailInbox `json:"inboxes"`
+	Senders   []string        `json:"senders"`
+}
+
+type mailInboxRequest struct {
+	// the photos are added to the album too if it is set
+	AlbumID string `json:"album"`
+}
+
+type mailInboxDeleteRequest struct {
+	InboxIds []string `json:"inboxes"`
+}
+
+type mailInboxDeleteResponse struct {
+	NumberDeleted int `json:"deleted"`
+}
+
+type mailSendersRequest struct {
+	Senders []string `json:"senders"`
+}
+
+type urlImportRequest struct {
+	URL string `json:"url"`
+	// the name of image, the last part of url path is used if it is not sent
+	Name string `json:"name"`
+}
+
+type bulkImportResult struct {
+	File    string     `json:"file"`
+	Success bool       `json:"success"`
+	Image   *UserImage `json:"image,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+type bulkImportResponse struct {
+	Succeeded int                `json:"succeeded"`
+	Failed    int                `json:"failed"`
+	Results   []bulkImportResult `json:"results"`
+}
+
+type userAlbum struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	ImageIds     []string  `json:"images"`
+	CreationDate time.Time `json:"creationDate"`
+}
+
+type userAlbums struct {
+	AlbumList []userAlbum `json:"albums"`
+}
+
+type albumRequest struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	ImageIds []string `json:"images"`
+}
+
+type albumDeleteRequest struct {
+	AlbumIds []string `json:"albums"`
+}
+
+type albumDeleteResponse struct {
+	NumberDeleted int `json:"deleted"`
+}
+
+type exportJobStatus struct {
+	ID string `json:"id"`
+	// the id of the queued job that writes the archive, only returned when the export is started
+	JobID        string    `json:"job,omitempty"`
+	Status       string    `json:"status"`
+	CreationDate time.Time `json:"creationDate"`
+	DownloadURL  string    `json:"downloadUrl,omitempty"`
+}
+
+// exportManifestImage describes an image of the archive with every field of the stored image, it is a stable
+// format independent of how images are stored and gets the fields added to images
+type exportManifestImage struct {
+	File          string `json:"file"`
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	OriginalFile  string `json:"originalFile,omitempty"`
+	Width         uint   `json:"width"`
+	Height        uint   `json:"height"`
+	Size          int64  `json:"size"`
+	Status        string `json:"status,omitempty"`
+	Hash          string `json:"hash"`
+	ThumbnailHash string `json:"thumbnailHash"`
+	// the archive has the original, the edits are applied on it to get the image user sees
+	Edits              []imageEditOperation `json:"edits"`
+	EditVersion        int                  `json:"editVersion"`
+	AppliedEditVersion int                  `json:"appliedEditVersion"`
+	UploadDate         time.Time            `json:"uploadDate"`
+	CaptureDate        *time.Time           `json:"captureDate,omitempty"`
+	DeletionDate       *time.Time           `json:"deletionDate,omitempty"`
+	Caption            string               `json:"caption,omitempty"`
+	Tags               []string             `json:"tags"`
+	Favorite           bool                 `json:"favorite"`
+	Rating             int                  `json:"rating"`
+	NeverShow          bool                 `json:"neverShow"`
+	BlurHash           string               `json:"blurHash,omitempty"`
+	AverageColor       string               `json:"averageColor,omitempty"`
+	Palette            []string             `json:"palette"`
+	// the ids of the albums of manifest the image is in
+	Albums []string `json:"albums"`
+}
+
+type exportManifestAlbum struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type exportManifest struct {
+	ExportDate time.Time             `json:"exportDate"`
+	Album      string                `json:"album,omitempty"`
+	Albums     []exportManifestAlbum `json:"albums"`
+	Images     []exportManifestImage `json:"images"`
+}
+
+type jobStatus struct {
+	ID           string    `json:"id"`
+	Type         string    `json:"type"`
+	Status       string    `json:"status"`
+	Attempts     int       `json:"attempts"`
+	Error        string    `json:"error,omitempty"`
+	ImageID      string    `json:"image,omitempty"`
+	CreationDate time.Time `json:"creationDate"`
+	UpdateDate   time.Time `json:"updateDate"`
+}
+
+type imageEditOperation struct {
+	Type      string  `json:"type"`
+	Angle     int     `json:"angle,omitempty"`
+	X         float64 `json:"x,omitempty"`
+	Y         float64 `json:"y,omitempty"`
+	Width     float64 `json:"width,omitempty"`
+	Height    float64 `json:"height,omitempty"`
+	Direction string  `json:"direction,omitempty"`
+	Amount    float64 `json:"amount,omitempty"`
+}
+
+type imageEdits struct {
+	ImageID string               `json:"id"`
+	Edits   []imageEditOperation `json:"edits"`
+}
+
 type ImageDeleteRequest struct {
 	ImageIds []string `json:"images"`
 }
@@ -48,3 +256,410 @@ type ImageDeleteRequest struct {
 type ImageDeleteResponse struct {
 	NumberDeleted int `json:"deleted"`
 }
+
+type userUsage struct {
+	Used  int64 `json:"used"`
+	Limit int64 `json:"limit"`
+	// the images in trash are counted separately, their files are still counted in used until they are purged
+	Count   int `json:"count"`
+	Trashed int `json:"trashed"`
+}
+
+type trashedImage struct {
+	UserImage
+	DeletionDate time.Time `json:"deletionDate"`
+	PurgeDate    time.Time `json:"purgeDate"`
+}
+
+type trashedImages struct {
+	ImageList []trashedImage `json:"images"`
+}
+
+type trashResponse struct {
+	NumberRestored int `json:"restored,omitempty"`
+	NumberPurged   int `json:"purged,omitempty"`
+}
+
+type userSlideshow struct {
+	ID           string        `json:"id"`
+	Name         string        `json:"name"`
+	AlbumID      string        `json:"album,omitempty"`
+	Source       string        `json:"source,omitempty"`
+	Interval     int           `json:"interval"`
+	Order        string        `json:"order"`
+	RepeatWindow int           `json:"repeatWindow"`
+	Layout       string        `json:"layout"`
+	Pairing      string        `json:"pairing"`
+	Gutter       int           `json:"gutter"`
+	Background   string        `json:"background"`
+	Overlays     []userOverlay `json:"overlays"`
+	CreationDate time.Time     `json:"creationDate"`
+	Images       []UserImage   `json:"images,omitempty"`
+}
+
+type userSlideshows struct {
+	SlideshowList []userSlideshow `json:"slideshows"`
+}
+
+type slideshowRequest struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// an empty album shows all images of user, the album is kept if it is not sent on update
+	AlbumID *string `json:"album"`
+	// memories shows the images taken around the same day in previous years, empty shows the album
+	Source       *string `json:"source"`
+	Interval     int     `json:"interval"`
+	Order        string  `json:"order"`
+	RepeatWindow *int    `json:"repeatWindow"`
+	Layout       string  `json:"layout"`
+	Pairing      string  `json:"pairing"`
+	Gutter       *int    `json:"gutter"`
+	Background   string  `json:"background"`
+	// the overlays are kept if they are not sent on update
+	Overlays *[]userOverlay `json:"overlays"`
+}
+
+type userOverlay struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	Position string `json:"position"`
+	FontSize int    `json:"fontSize"`
+	Color    string `json:"color"`
+	Shadow   bool   `json:"shadow"`
+	// the overlay is opaque if the opacity is not sent
+	Opacity *float64 `json:"opacity"`
+}
+
+type slideshowDeleteRequest struct {
+	SlideshowIds []string `json:"slideshows"`
+}
+
+type slideshowDeleteResponse struct {
+	NumberDeleted int `json:"deleted"`
+}
+
+type memoryYear struct {
+	Year     int         `json:"year"`
+	YearsAgo int         `json:"yearsAgo"`
+	Images   []UserImage `json:"images"`
+}
+
+type memoriesResponse struct {
+	Date     string       `json:"date"`
+	Timezone string       `json:"timezone"`
+	Window   int          `json:"window"`
+	Years    []memoryYear `json:"years"`
+}
+
+type userDeviceProfile struct {
+	ID           string        `json:"id"`
+	Name         string        `json:"name"`
+	Width        int           `json:"width"`
+	Height       int           `json:"height"`
+	Orientation  string        `json:"orientation"`
+	Fit          string        `json:"fit"`
+	ColorMode    string        `json:"colorMode"`
+	MaxFileSize  int64         `json:"maxFileSize"`
+	Overlays     []userOverlay `json:"overlays"`
+	Version      string        `json:"version"`
+	CreationDate time.Time     `json:"creationDate"`
+	// the job that pre-renders the images of user for the profile
+	JobID string `json:"job,omitempty"`
+}
+
+type userDeviceProfiles struct {
+	ProfileList []userDeviceProfile `json:"profiles"`
+}
+
+type deviceProfileRequest struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Orientation string `json:"orientation"`
+	Fit         string `json:"fit"`
+	ColorMode   string `json:"colorMode"`
+	// the size limit is kept if it is not sent on update
+	MaxFileSize *int64 `json:"maxFileSize"`
+	// the overlays are kept if they are not sent on update
+	Overlays *[]userOverlay `json:"overlays"`
+}
+
+type deviceProfileDeleteRequest struct {
+	ProfileIds []string `json:"profiles"`
+}
+
+type deviceProfileDeleteResponse struct {
+	NumberDeleted int `json:"deleted"`
+}
+
+type userShareLink struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Target string `json:"target"`
+	Scope  string `json:"scope"`
+	// the url of link, only returned when the link is created since its token is not stored
+	URL          string     `json:"url,omitempty"`
+	Protected    bool       `json:"protected"`
+	ExpiryDate   *time.Time `json:"expiryDate,omitempty"`
+	Views        int64      `json:"views"`
+	CreationDate time.Time  `json:"creationDate"`
+}
+
+type userShareLinks struct {
+	ShareLinkList []userShareLink `json:"shares"`
+}
+
+type shareLinkRequest struct {
+	Type     string `json:"type"`
+	Target   string `json:"target"`
+	Scope    string `json:"scope"`
+	Password string `json:"password"`
+	// the seconds the link works, zero means the link does not expire
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+type shareLinkDeleteRequest struct {
+	ShareLinkIds []string `json:"shares"`
+}
+
+type shareLinkDeleteResponse struct {
+	NumberRevoked int `json:"revoked"`
+}
+
+type sharedImage struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Width        uint   `json:"width"`
+	Height       uint   `json:"height"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnailUrl"`
+}
+
+type sharedCollection struct {
+	Type     string        `json:"type"`
+	Name     string        `json:"name"`
+	Interval int           `json:"interval,omitempty"`
+	Views    int64         `json:"views"`
+	Images   []sharedImage `json:"images"`
+}
+
+type userLibrary struct {
+	ID           string              `json:"id"`
+	Name         string              `json:"name"`
+	Role         string              `json:"role"`
+	Members      []libraryMember     `json:"members"`
+	Invitations  []libraryInvitation `json:"invitations,omitempty"`
+	ImageCount   int                 `json:"imageCount"`
+	CreationDate time.Time           `json:"creationDate"`
+}
+
+type userLibraries struct {
+	LibraryList []userLibrary `json:"libraries"`
+}
+
+type libraryMember struct {
+	UserID   string    `json:"user"`
+	Email    string    `json:"email"`
+	Role     string    `json:"role"`
+	JoinDate time.Time `json:"joinDate"`
+}
+
+type libraryInvitation struct {
+	Library      string    `json:"library"`
+	LibraryName  string    `json:"libraryName,omitempty"`
+	Email        string    `json:"email"`
+	Role         string    `json:"role"`
+	InvitedBy    string    `json:"invitedBy"`
+	Token        string    `json:"token,omitempty"`
+	CreationDate time.Time `json:"creationDate"`
+}
+
+type libraryInvitations struct {
+	InvitationList []libraryInvitation `json:"invitations"`
+}
+
+type libraryRequest struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type libraryDeleteRequest struct {
+	LibraryIds []string `json:"libraries"`
+}
+
+type libraryDeleteResponse struct {
+	NumberDeleted int `json:"deleted"`
+}
+
+type libraryMemberRequest struct {
+	Library string `json:"library"`
+	Email   string `json:"email"`
+	UserID  string `json:"user"`
+	Role    string `json:"role"`
+}
+
+type invitationAcceptRequest struct {
+	Token string `json:"token"`
+}
+
+type libraryImage struct {
+	UserImage
+	Uploader string `json:"uploader"`
+}
+
+type libraryImages struct {
+	ImageList []libraryImage `json:"images"`
+}
+
+type imageMetadataRequest struct {
+	ID string `json:"id"`
+	// the fields that are not sent are kept
+	Caption   *string  `json:"caption"`
+	Tags      []string `json:"tags"`
+	Favorite  *bool    `json:"favorite"`
+	Rating    *int     `json:"rating"`
+	NeverShow *bool    `json:"neverShow"`
+}
+
+type tagFacet struct {
+	Tag   string `json:"tag" bson:"_id"`
+	Count int    `json:"count" bson:"count"`
+}
+
+type imageSearchResponse struct {
+	Total  int64       `json:"total"`
+	Images []UserImage `json:"images"`
+	Facets []tagFacet  `json:"facets"`
+}
+
+type tagSuggestions struct {
+	Tags []tagFacet `json:"tags"`
+}
+
+type fsckIssue struct {
+	Type    string `json:"type"`
+	UserID  string `json:"userId"`
+	ImageID string `json:"imageId,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Action  string `json:"action"`
+	// for regenerations it means the processing of image is queued
+	Repaired bool   `json:"repaired"`
+	Error    string `json:"error,omitempty"`
+}
+
+type fsckReport struct {
+	Repair        bool        `json:"repair"`
+	CheckedUsers  int         `json:"checkedUsers"`
+	CheckedImages int         `json:"checkedImages"`
+	CheckedFiles  int         `json:"checkedFiles"`
+	Issues        []fsckIssue `json:"issues"`
+}
+
+type userBrightnessPeriod struct {
+	Start      string `json:"start"`
+	Brightness int    `json:"brightness"`
+}
+
+type userDevice struct {
+	ID                  string                 `json:"id"`
+	Name                string                 `json:"name"`
+	Model               string                 `json:"model"`
+	Width               int                    `json:"width"`
+	Height              int                    `json:"height"`
+	Orientation         string                 `json:"orientation"`
+	Timezone            string                 `json:"timezone,omitempty"`
+	SlideshowID         string                 `json:"slideshow,omitempty"`
+	AlbumID             string                 `json:"album,omitempty"`
+	ProfileID           string                 `json:"profile,omitempty"`
+	SlideDuration       int                    `json:"slideDuration"`
+	BrightnessSchedule  []userBrightnessPeriod `json:"brightnessSchedule"`
+	LastSeenDate        time.Time              `json:"lastSeenDate"`
+	LastSeenAddress     string                 `json:"lastSeenAddress,omitempty"`
+	OfflineAlertMinutes int                    `json:"offlineAlertMinutes"`
+	// the frame is online if its latest heartbeat is more recent than the offline alert period
+	Online        bool           `json:"online"`
+	LastHeartbeat *userHeartbeat `json:"lastHeartbeat,omitempty"`
+	CreationDate  time.Time      `json:"creationDate"`
+	// the token is only sent when the device is created or its token is renewed
+	Token string `json:"token,omitempty"`
+}
+
+type userDevices struct {
+	DeviceList []userDevice `json:"devices"`
+}
+
+type deviceRequest struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	Model       *string `json:"model"`
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+	Orientation string  `json:"orientation"`
+	// the fields that are not sent are kept on update, empty clears them
+	Timezone           *string                 `json:"timezone"`
+	SlideshowID        *string                 `json:"slideshow"`
+	AlbumID            *string                 `json:"album"`
+	ProfileID          *string                 `json:"profile"`
+	SlideDuration      *int                    `json:"slideDuration"`
+	BrightnessSchedule *[]userBrightnessPeriod `json:"brightnessSchedule"`
+	// zero alerts after the default period of server
+	OfflineAlertMinutes *int `json:"offlineAlertMinutes"`
+	// a new token is created and the previous one stops working
+	RenewToken bool `json:"renewToken"`
+}
+
+type deviceDeleteRequest struct {
+	DeviceIds []string `json:"devices"`
+}
+
+type deviceDeleteResponse struct {
+	NumberDeleted int `json:"deleted"`
+}
+
+// deviceConfig is the configuration of device with the settings it inherits from user and slideshow resolved
+type deviceConfig struct {
+	ID                 string                 `json:"id"`
+	Name               string                 `json:"name"`
+	Width              int                    `json:"width"`
+	Height             int                    `json:"height"`
+	Orientation        string                 `json:"orientation"`
+	Timezone           string                 `json:"timezone"`
+	UTCOffset          int                    `json:"utcOffset"`
+	Slideshow          *userSlideshow         `json:"slideshow,omitempty"`
+	AlbumID            string                 `json:"album,omitempty"`
+	Images             []UserImage            `json:"images,omitempty"`
+	ProfileID          string                 `json:"profile,omitempty"`
+	SlideDuration      int                    `json:"slideDuration"`
+	BrightnessSchedule []userBrightnessPeriod `json:"brightnessSchedule"`
+	// the brightness the screen should have now
+	Brightness int       `json:"brightness"`
+	ServerTime time.Time `json:"serverTime"`
+}
+
+type userHeartbeat struct {
+	Date           time.Time      `json:"date"`
+	Uptime         int64          `json:"uptime"`
+	Firmware       string         `json:"firmware"`
+	FreeStorage    int64          `json:"freeStorage"`
+	CurrentImageID string         `json:"currentImage,omitempty"`
+	ErrorCounters  map[string]int `json:"errors"`
+	WifiSignal     int            `json:"wifiSignal"`
+}
+
+type heartbeatRequest struct {
+	Uptime         int64          `json:"uptime"`
+	Firmware       string         `json:"firmware"`
+	FreeStorage    int64          `json:"freeStorage"`
+	CurrentImageID string         `json:"currentImage"`
+	ErrorCounters  map[string]int `json:"errors"`
+	WifiSignal     int            `json:"wifiSignal"`
+}
+
+type deviceStatus struct {
+	ID     string `json:"id"`
+	Online bool   `json:"online"`
+	// the time the owner was alerted that the frame is offline, only set while it is offline
+	OfflineAlertDate *time.Time      `json:"offlineAlertDate,omitempty"`
+	Heartbeats       []userHeartbeat `json:"heartbeats"`
+}
@@ -0,0 +1,313 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/matba/slyde-server/internals/config"
+	"github.com/matba/slyde-server/internals/db"
+	"github.com/matba/slyde-server/internals/variants"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const trashService = "TRASH"
+const trashPurgeInterval = time.Hour
+
+// HandleTrash handles API calls for the deleted images, they can be listed, restored or purged
+func HandleTrash(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	log.Printf("Incoming call for trash")
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, trashService)
+	if err != nil {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		handleTrashGet(w, r, user)
+	case "POST":
+		handleTrashRestore(w, r, user)
+	case "DELETE":
+		handleTrashPurge(w, r, user)
+	default:
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+}
+
+func handleTrashGet(w http.ResponseWriter, r *http.Request, user *db.User) {
+	retention := getTrashRetention()
+	imList := []trashedImage{}
+	for _, img := range getTrashedImages(user) {
+		imList = append(imList, trashedImage{
+			UserImage:    toUserImage(img),
+			DeletionDate: img.DeletionDate,
+			PurgeDate:    img.DeletionDate.Add(retention),
+		})
+	}
+
+	js, _ := json.Marshal(trashedImages{ImageList: imList})
+	w.Write(js)
+}
+
+// handleTrashRestore moves the requested images out of trash
+func handleTrashRestore(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request ImageDeleteRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, trashService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	restoredIds := []string{}
+	for _, img := range filterTrashedImages(user, request.ImageIds) {
+		restoredIds = append(restoredIds, img.ID)
+	}
+
+	if len(restoredIds) > 0 {
+		client, err := db.CreateMongoClient()
+		defer db.CloseClient(client)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotConnectToDb, trashService, user.Email, err.Error())
+			WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+			return
+		}
+		collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+		err = setImagesDeletionDate(collection, user.ID, restoredIds, time.Time{})
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotUpdateTheDb, trashService, user.Email, err.Error())
+			WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+			return
+		}
+		updateSearchEntries(user.ID, restoredIds, bson.D{{"$set", bson.D{{"trashed", false}}}})
+	}
+
+	js, _ := json.Marshal(trashResponse{NumberRestored: len(restoredIds)})
+	w.Write(js)
+}
+
+// handleTrashPurge permanently deletes the requested images, only the images in trash can be purged
+func handleTrashPurge(w http.ResponseWriter, r *http.Request, user *db.User) {
+	var request ImageDeleteRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, trashService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+
+	purgedImages := filterTrashedImages(user, request.ImageIds)
+	if len(purgedImages) > 0 {
+		client, err := db.CreateMongoClient()
+		defer db.CloseClient(client)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotConnectToDb, trashService, user.Email, err.Error())
+			WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+			return
+		}
+		collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+		// the images restored since the user was read are not purged
+		purgedImages, err = purgeImages(collection, user, purgedImages, time.Now())
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotUpdateTheDb, trashService, user.Email, err.Error())
+			WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	js, _ := json.Marshal(trashResponse{NumberPurged: len(purgedImages)})
+	w.Write(js)
+}
+
+// trashImages moves the images with the ids to trash and hides them from search
+func trashImages(collection *mongo.Collection, userID string, imageIds []string) error {
+	err := setImagesDeletionDate(collection, userID, imageIds, time.Now())
+	if err != nil {
+		return err
+	}
+	updateSearchEntries(userID, imageIds, bson.D{{"$set", bson.D{{"trashed", true}}}})
+	return nil
+}
+
+// setImagesDeletionDate moves the images with the ids to trash, a zero date restores them
+func setImagesDeletionDate(collection *mongo.Collection, userID string, imageIds []string, deletionDate time.Time) error {
+	filter := bson.D{{"id", userID}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"images.$[image].deletiondate", deletionDate},
+		}},
+	}
+	arrayFilters := options.ArrayFilters{Filters: []interface{}{
+		bson.D{{"image.id", bson.D{{"$in", imageIds}}}},
+	}}
+	_, err := collection.UpdateOne(context.TODO(), filter, update, options.Update().SetArrayFilters(arrayFilters))
+	return err
+}
+
+// purgeImages permanently removes the images from user, its albums and the disk and returns the removed images.
+// An image is only removed if it has the same size and, unless the cutoff is zero, it is still in trash since
+// before the cutoff, so an image restored or changed after user was read is kept and the usage is decreased by
+// exactly what was removed.
+func purgeImages(collection *mongo.Collection, user *db.User, images []db.ImageInfo, cutoff time.Time) ([]db.ImageInfo, error) {
+	purged := []db.ImageInfo{}
+	for _, img := range images {
+		imageFilter := bson.D{{"id", img.ID}, {"size", img.Size}}
+		if !cutoff.IsZero() {
+			imageFilter = append(imageFilter, bson.E{"deletiondate", bson.D{{"$gt", time.Time{}}, {"$lt", cutoff}}})
+		}
+		filter := bson.D{{"id", user.ID}, {"images", bson.D{{"$elemMatch", imageFilter}}}}
+		update := bson.D{
+			{"$pull", bson.D{
+				{"images", bson.D{
+					{"id", img.ID},
+				}},
+			}},
+			{"$inc", bson.D{
+				{"storageused", -img.Size},
+				{"usageversion", 1},
+			}},
+		}
+		result, err := collection.UpdateOne(context.TODO(), filter, update)
+		if err != nil {
+			return purged, err
+		}
+		if result.ModifiedCount > 0 {
+			purged = append(purged, img)
+		}
+	}
+	if len(purged) == 0 {
+		return purged, nil
+	}
+	imageIds := []string{}
+	for _, img := range purged {
+		imageIds = append(imageIds, img.ID)
+	}
+
+	// the purged images should not be referenced from albums anymore
+	if len(user.Albums) > 0 {
+		err := removeImagesFromAlbums(collection, user.ID, purged)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotUpdateTheDb, trashService, user.Email, err.Error())
+		}
+	}
+
+	// the purged images should not be referenced from shared libraries either
+	err := removeImagesFromLibraries(user.ID, imageIds)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, trashService, user.Email, err.Error())
+	}
+	removeSearchEntries(user.ID, imageIds)
+
+	for _, img := range purged {
+		os.Remove(getUserImagePath(user.ID, img.ID, true))
+		os.Remove(getUserImagePath(user.ID, img.ID, false))
+		if len(img.OriginalFile) > 0 {
+			os.Remove(getUserOriginalImagePath(user.ID, img.OriginalFile))
+		}
+		variants.GetVariantCache().RemoveImage(variants.ImageKey(user.ID, img.ID))
+		removeImageProfileRenderings(user.ID, img.ID)
+	}
+	return purged, nil
+}
+
+// purgeExpiredTrash periodically purges the images that have been in trash longer than the retention
+func purgeExpiredTrash() {
+	for {
+		err := purgeExpiredTrashOnce()
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotUpdateTheDb, trashService, "", err.Error())
+		}
+		time.Sleep(trashPurgeInterval)
+	}
+}
+
+func purgeExpiredTrashOnce() error {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		return err
+	}
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+
+	cutoff := time.Now().Add(-getTrashRetention())
+	filter := bson.D{{"images", bson.D{{"$elemMatch", bson.D{
+		{"deletiondate", bson.D{{"$gt", time.Time{}}, {"$lt", cutoff}}},
+	}}}}}
+	cursor, err := collection.Find(context.TODO(), filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.TODO())
+
+	for cursor.Next(context.TODO()) {
+		var user db.User
+		err = cursor.Decode(&user)
+		if err != nil {
+			return err
+		}
+		expiredImages := []db.ImageInfo{}
+		for _, img := range getTrashedImages(&user) {
+			if img.DeletionDate.Before(cutoff) {
+				expiredImages = append(expiredImages, img)
+			}
+		}
+		purgedImages, err := purgeImages(collection, &user, expiredImages, cutoff)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotUpdateTheDb, trashService, user.Email, err.Error())
+			continue
+		}
+		log.Printf("Purged %d images of user %s from trash", len(purgedImages), user.ID)
+	}
+	return cursor.Err()
+}
+
+// getActiveImages returns the images of user that are not in trash
+func getActiveImages(user *db.User) []db.ImageInfo {
+	images := []db.ImageInfo{}
+	for _, img := range user.Images {
+		if !img.IsTrashed() {
+			images = append(images, img)
+		}
+	}
+	return images
+}
+
+func getTrashedImages(user *db.User) []db.ImageInfo {
+	images := []db.ImageInfo{}
+	for _, img := range user.Images {
+		if img.IsTrashed() {
+			images = append(images, img)
+		}
+	}
+	return images
+}
+
+// filterTrashedImages returns the images in trash of user with the requested ids
+func filterTrashedImages(user *db.User, imageIds []string) []db.ImageInfo {
+	requested := make(map[string]bool)
+	for _, imgID := range imageIds {
+		requested[imgID] = true
+	}
+	images := []db.ImageInfo{}
+	for _, img := range getTrashedImages(user) {
+		if requested[img.ID] {
+			images = append(images, img)
+		}
+	}
+	return images
+}
+
+func getTrashRetention() time.Duration {
+	return time.Duration(config.GetServerConfig().TrashRetentionDays) * 24 * time.Hour
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/matba/slyde-server/internals/db"
+)
+
+const urlImportService = "URL_IMPORT"
+const urlImportTimeout = 20 * time.Second
+const urlImportDialTimeout = 5 * time.Second
+const maxURLImportRedirects = 3
+const defaultImportedImageName = "imported-image"
+
+var allowedImportContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/bmp":  true,
+	"image/tiff": true,
+}
+
+// blockedImportNetworks are the address ranges that are not reachable from the internet, imported urls can
+// not point to them so the server can not be used to reach its own network
+var blockedImportNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.0.0.0/24", "192.0.2.0/24", "192.168.0.0/16", "198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24",
+	"224.0.0.0/4", "240.0.0.0/4", "::/128", "::1/128", "64:ff9b::/96", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+var errBlockedImportAddress = errors.New("The address is not allowed")
+var errImportedImageTooBig = errors.New("The imported image is too big")
+
+// urlImportClient fetches the imported urls, it can be replaced with newURLImportClient that allows the
+// address of a local stand-in server
+var urlImportClient = newURLImportClient(isPublicAddress)
+
+// HandleImageImport fetches the image at the url in request and adds it to the images of user like an
+// uploaded image
+func HandleImageImport(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	if r.Method != "POST" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	log.Printf("Incoming call for importing an image from url")
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, urlImportService)
+	if err != nil {
+		return
+	}
+
+	var request urlImportRequest
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, urlImportService, email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return
+	}
+	importURL, err := url.Parse(request.URL)
+	if err != nil || (importURL.Scheme != "http" && importURL.Scheme != "https") || len(importURL.Hostname()) == 0 {
+		log.Printf(errLogTemplate, errLogValidation, urlImportService, email, request.URL)
+		WriteErrorOnResponse(errInvalidImportURL, &w, http.StatusBadRequest)
+		return
+	}
+
+	content, description, status, err := fetchImportedImage(r.Context(), importURL)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogImageUploadError, urlImportService, email, err.Error())
+		WriteErrorOnResponse(description, &w, status)
+		return
+	}
+
+	fileName := request.Name
+	if len(fileName) == 0 {
+		fileName = path.Base(importURL.Path)
+	}
+	if fileName == "." || fileName == "/" {
+		fileName = defaultImportedImageName
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, urlImportService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return
+	}
+
+	// the fetched image goes through the same validation and processing as uploaded images
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	imgInfo, job, uploadErr := acceptUpload(collection, user, fileName, bytes.NewReader(content))
+	if uploadErr != nil {
+		log.Printf(errLogTemplate, errLogImageValidationError, urlImportService, email, uploadErr.Error())
+		WriteErrorOnResponse(uploadErr.description, &w, uploadErr.status)
+		return
+	}
+
+	newImageJSON := toUserImage(*imgInfo)
+	newImageJSON.JobID = job.ID
+	js, _ := json.Marshal(newImageJSON)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(js)
+}
+
+// fetchImportedImage downloads the image at the url, if it can not be downloaded the returned string and
+// status are the description and status that should be sent to client
+func fetchImportedImage(ctx context.Context, importURL *url.URL) ([]byte, string, int, error) {
+	request, err := http.NewRequest("GET", importURL.String(), nil)
+	if err != nil {
+		return nil, errInvalidImportURL, http.StatusBadRequest, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Accept", "image/jpeg, image/png, image/gif, image/bmp, image/tiff")
+
+	response, err := urlImportClient.Do(request)
+	if err != nil {
+		if errors.Is(err, errBlockedImportAddress) {
+			return nil, errImportAddressNotAllowed, http.StatusBadRequest, err
+		}
+		return nil, errImportFailed, http.StatusBadGateway, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errImportFailed, http.StatusBadGateway, fmt.Errorf("Fetching %s returned %d", importURL, response.StatusCode)
+	}
+	mediaType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil || !allowedImportContentTypes[mediaType] {
+		return nil, errUnsupportedImage, http.StatusUnsupportedMediaType,
+			errors.New("Unsupported content type " + response.Header.Get("Content-Type"))
+	}
+	if response.ContentLength > maxUploadSize {
+		return nil, errFileTooBig, http.StatusRequestEntityTooLarge, errImportedImageTooBig
+	}
+
+	// the length header may be missing or wrong, so the body is read up to the limit
+	content, err := ioutil.ReadAll(io.LimitReader(response.Body, maxUploadSize+1))
+	if err != nil {
+		return nil, errImportFailed, http.StatusBadGateway, err
+	}
+	if len(content) > maxUploadSize {
+		return nil, errFileTooBig, http.StatusRequestEntityTooLarge, errImportedImageTooBig
+	}
+	return content, "", http.StatusOK, nil
+}
+
+// newURLImportClient creates the client that fetches imported urls with a timeout and a limited number of
+// redirects. The address is checked after the host is resolved, on each connection including redirects,
+// so a host can not resolve to a blocked address after it is checked.
+func newURLImportClient(isAllowedAddress func(ip net.IP) bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: urlImportDialTimeout,
+		Control: func(network string, address string, conn syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !isAllowedAddress(ip) {
+				return fmt.Errorf("%w: %s", errBlockedImportAddress, host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: urlImportTimeout,
+		Transport: &http.Transport{
+			// the proxy of environment is not used, the checked address would be the address of proxy
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   urlImportDialTimeout,
+			ResponseHeaderTimeout: urlImportTimeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       30 * time.Second,
+		},
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if len(via) > maxURLImportRedirects {
+				return errors.New("Too many redirects")
+			}
+			if request.URL.Scheme != "http" && request.URL.Scheme != "https" {
+				return errors.New("Redirect to unsupported scheme " + request.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// isPublicAddress checks that the address is not in any of the blocked ranges
+func isPublicAddress(ip net.IP) bool {
+	for _, network := range blockedImportNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestFetchImportedImage(t *testing.T) {
+	image := []byte("image content")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(image)
+	})
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html></html>"))
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", strconv.Itoa(maxUploadSize+1))
+		w.Write(bytes.Repeat([]byte{0}, maxUploadSize+1))
+	})
+	mux.HandleFunc("/big-without-length", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		// flushing before the body is written sends it chunked without a length
+		w.(http.Flusher).Flush()
+		w.Write(bytes.Repeat([]byte{0}, maxUploadSize+1))
+	})
+	// /redirect?left=n redirects n times before it redirects to the image
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		left, _ := strconv.Atoi(r.FormValue("left"))
+		if left == 0 {
+			http.Redirect(w, r, "/image", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/redirect?left=%d", left-1), http.StatusFound)
+	})
+	mux.HandleFunc("/redirect-to-file", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	allowLoopback := func(ip net.IP) bool { return ip.IsLoopback() }
+	tests := []struct {
+		name             string
+		isAllowedAddress func(ip net.IP) bool
+		path             string
+		status           int
+		description      string
+		err              error
+	}{
+		{"image is fetched", allowLoopback, "/image", http.StatusOK, "", nil},
+		{"blocked address is not connected to", isPublicAddress, "/image", http.StatusBadRequest, errImportAddressNotAllowed, errBlockedImportAddress},
+		{"redirects up to the limit are followed", allowLoopback, fmt.Sprintf("/redirect?left=%d", maxURLImportRedirects-1), http.StatusOK, "", nil},
+		{"redirects past the limit fail", allowLoopback, fmt.Sprintf("/redirect?left=%d", maxURLImportRedirects), http.StatusBadGateway, errImportFailed, nil},
+		{"redirect to another scheme fails", allowLoopback, "/redirect-to-file", http.StatusBadGateway, errImportFailed, nil},
+		{"error status fails", allowLoopback, "/missing", http.StatusBadGateway, errImportFailed, nil},
+		{"wrong content type is rejected", allowLoopback, "/page", http.StatusUnsupportedMediaType, errUnsupportedImage, nil},
+		{"oversize length is rejected", allowLoopback, "/big", http.StatusRequestEntityTooLarge, errFileTooBig, errImportedImageTooBig},
+		{"oversize body without length is rejected", allowLoopback, "/big-without-length", http.StatusRequestEntityTooLarge, errFileTooBig, errImportedImageTooBig},
+	}
+
+	defaultClient := urlImportClient
+	defer func() { urlImportClient = defaultClient }()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			urlImportClient = newURLImportClient(test.isAllowedAddress)
+			importURL, _ := url.Parse(server.URL + test.path)
+
+			content, description, status, err := fetchImportedImage(context.Background(), importURL)
+			if status != test.status || description != test.description {
+				t.Fatalf("expected %d %q, got %d %q with error %v", test.status, test.description, status, description, err)
+			}
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Errorf("expected error %v, got %v", test.err, err)
+			}
+			if test.status == http.StatusOK && !bytes.Equal(content, image) {
+				t.Errorf("expected the image content, got %q", content)
+			}
+		})
+	}
+}
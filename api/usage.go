@@ -0,0 +1,242 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/matba/slyde-server/internals/config"
+	"github.com/matba/slyde-server/internals/db"
+	"github.com/matba/slyde-server/internals/jobs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const usageService = "USAGE"
+const recomputeUsageJobType = "RECOMPUTE_USAGE"
+const usageRecomputeInterval = 24 * time.Hour
+const usageRecomputeAttempts = 3
+
+// HandleUserUsage returns the storage used by user and its quota
+func HandleUserUsage(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	if r.Method != "GET" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	email := GetUser(w, r)
+	if email == "" {
+		return
+	}
+	user, err := GetUserByEmail(w, email, usageService)
+	if err != nil {
+		return
+	}
+
+	js, _ := json.Marshal(userUsage{
+		Used:    user.StorageUsed,
+		Limit:   getStorageQuota(user),
+		Count:   len(getActiveImages(user)),
+		Trashed: len(getTrashedImages(user)),
+	})
+	w.Write(js)
+}
+
+// HandleAdminUsage queues recomputing the storage usage of the user with the id or of all users
+func HandleAdminUsage(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	if r.Method != "POST" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	email := GetAdmin(w, r)
+	if email == "" {
+		return
+	}
+
+	enqueueUserJobs(w, r, email, recomputeUsageJobType, usageService)
+}
+
+// enqueueUserJobs queues a job of the type for the user with the id in request or for all users and
+// responds with the statuses of queued jobs
+func enqueueUserJobs(w http.ResponseWriter, r *http.Request, email string, jobType string, serviceName string) {
+	userIDs := []string{r.FormValue("id")}
+	if len(userIDs[0]) == 0 {
+		var err error
+		userIDs, err = getAllUserIDs()
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, serviceName, email, err.Error())
+			WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	statuses := []jobStatus{}
+	for _, userID := range userIDs {
+		job, err := jobs.GetQueue().Enqueue(jobType, userID, map[string]string{})
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotInsertToDb, serviceName, email, err.Error())
+			WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+			return
+		}
+		statuses = append(statuses, toJobStatus(*job))
+	}
+
+	js, _ := json.Marshal(statuses)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(js)
+}
+
+// registerUsageJobs registers the handlers of usage jobs in the job queue
+func registerUsageJobs() {
+	jobs.GetQueue().RegisterHandler(recomputeUsageJobType, recomputeUsageJob)
+}
+
+// recomputeUsageJob sets the size of every image of user from the files on disk and the usage of user to their sum
+func recomputeUsageJob(job *db.Job) error {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		return err
+	}
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+
+	// the usage is computed again when it changes while it is computed, the job is retried if it keeps changing
+	for attempt := 0; attempt < usageRecomputeAttempts; attempt++ {
+		saved, err := recomputeUserUsage(collection, job.UserID)
+		if err != nil || saved {
+			return err
+		}
+	}
+	return errors.New("The usage kept changing while it was recomputed.")
+}
+
+// recomputeUserUsage computes the usage of user from the files on disk and saves it if the usage has not changed
+// since the user was read
+func recomputeUserUsage(collection *mongo.Collection, userID string) (bool, error) {
+	var user db.User
+	err := collection.FindOne(context.TODO(), bson.D{{"id", userID}}).Decode(&user)
+	if err != nil {
+		return false, err
+	}
+
+	var used int64
+	for _, img := range user.Images {
+		size := getStoredImageSize(user.ID, img)
+		used += size
+		if size == img.Size {
+			continue
+		}
+		filter := bson.D{{"id", user.ID}, {"images.id", img.ID}}
+		update := bson.D{
+			{"$set", bson.D{
+				{"images.$.size", size},
+			}},
+		}
+		_, err = collection.UpdateOne(context.TODO(), filter, update)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// the users created before usage versions were introduced do not have the field
+	version := interface{}(user.UsageVersion)
+	if user.UsageVersion == 0 {
+		version = bson.D{{"$in", bson.A{0, nil}}}
+	}
+	filter := bson.D{{"id", user.ID}, {"usageversion", version}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"storageused", used},
+		}},
+		{"$inc", bson.D{
+			{"usageversion", 1},
+		}},
+	}
+	result, err := collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil || result.MatchedCount == 0 {
+		return false, err
+	}
+	if used != user.StorageUsed {
+		log.Printf("Usage of user %s corrected from %d to %d bytes", user.ID, user.StorageUsed, used)
+	}
+	return true, nil
+}
+
+// recomputeUsagePeriodically queues recomputing the usage of all users at start and then once a day, so the
+// users created before usage was measured get their usage without waiting a day
+func recomputeUsagePeriodically() {
+	for {
+		userIDs, err := getAllUserIDs()
+		if err != nil {
+			log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, usageService, "", err.Error())
+		}
+		for _, userID := range userIDs {
+			_, err = jobs.GetQueue().Enqueue(recomputeUsageJobType, userID, map[string]string{})
+			if err != nil {
+				log.Printf(errLogTemplate, errLogCannotInsertToDb, usageService, userID, err.Error())
+			}
+		}
+		time.Sleep(usageRecomputeInterval)
+	}
+}
+
+func getAllUserIDs() ([]string, error) {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		return nil, err
+	}
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+
+	cursor, err := collection.Find(context.TODO(), bson.D{}, options.Find().SetProjection(bson.D{{"id", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	userIDs := []string{}
+	for cursor.Next(context.TODO()) {
+		var user db.User
+		err = cursor.Decode(&user)
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, user.ID)
+	}
+	return userIDs, cursor.Err()
+}
+
+// getStoredImageSize returns the bytes of the original, the image and the thumbnail of img on disk
+func getStoredImageSize(userID string, img db.ImageInfo) int64 {
+	paths := []string{getUserImagePath(userID, img.ID, false), getUserImagePath(userID, img.ID, true)}
+	if len(img.OriginalFile) != 0 {
+		paths = append(paths, getUserOriginalImagePath(userID, img.OriginalFile))
+	}
+
+	var size int64
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// getStorageQuota returns the bytes the user can store
+func getStorageQuota(user *db.User) int64 {
+	if user.StorageQuota > 0 {
+		return user.StorageQuota
+	}
+	return config.GetServerConfig().DefaultStorageQuota
+}
+
+func getStorageQuotaDescription(user *db.User) string {
+	return fmt.Sprintf(errStorageQuotaExceeded, user.StorageUsed, getStorageQuota(user))
+}
@@ -1,9 +1,14 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
+	"time"
+
+	"github.com/matba/slyde-server/internals/db"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 const userService = "USER"
@@ -23,9 +28,64 @@ func HandleUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.Method == "PUT" {
+		if !updateUser(w, r, user) {
+			return
+		}
+	}
+
 	js, _ := json.Marshal(userInformation{
-		Email: user.Email,
-		Name:  user.Name,
+		Email:    user.Email,
+		Name:     user.Name,
+		Timezone: user.Timezone,
 	})
 	w.Write(js)
 }
+
+// updateUser sets the name and timezone in request on user, if they are not valid appropriate response is
+// written to output
+func updateUser(w http.ResponseWriter, r *http.Request, user *db.User) bool {
+	var request userUpdateRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotDecode, userService, user.Email, err.Error())
+		WriteErrorOnResponse(errCannotDecode, &w, http.StatusBadRequest)
+		return false
+	}
+	if request.Timezone != nil {
+		_, err = time.LoadLocation(*request.Timezone)
+		if err != nil {
+			log.Printf(errLogTemplate, errLogValidation, userService, user.Email, err.Error())
+			WriteErrorOnResponse(errInvalidTimezone, &w, http.StatusBadRequest)
+			return false
+		}
+		user.Timezone = *request.Timezone
+	}
+	if len(request.Name) > 0 {
+		user.Name = request.Name
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, userService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return false
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	filter := bson.D{{"id", user.ID}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"name", user.Name},
+			{"timezone", user.Timezone},
+		}},
+	}
+	_, err = collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotUpdateTheDb, userService, user.Email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
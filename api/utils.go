@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/matba/slyde-server/internals/cacher"
+	"github.com/matba/slyde-server/internals/config"
 	"github.com/matba/slyde-server/internals/db"
 	"go.mongodb.org/mongo-driver/bson"
 )
@@ -19,8 +20,9 @@ func SetJsonContentType(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
 }
 
+// WriteErrorOnResponse responds with the status and the error description in the body
 func WriteErrorOnResponse(error string, w *http.ResponseWriter, status int) {
-	(*w).WriteHeader(http.StatusInternalServerError)
+	(*w).WriteHeader(status)
 	errorResp := errorResponse{Description: error}
 	js, _ := json.Marshal(errorResp)
 	(*w).Write(js)
@@ -72,6 +74,21 @@ func GetUser(w http.ResponseWriter, r *http.Request) string {
 	return response
 }
 
+// GetAdmin if the session token in request belongs to an administrator it will get the user email
+// otherwise it will writes appropriate stuff in response and return empty string
+func GetAdmin(w http.ResponseWriter, r *http.Request) string {
+	email := GetUser(w, r)
+	if email == "" {
+		return ""
+	}
+	if !config.GetServerConfig().IsAdmin(email) {
+		log.Printf(errLogTemplate, errLogNotAdmin, "AUTH", email, "")
+		WriteErrorOnResponse(errUnAuthorized, &w, http.StatusForbidden)
+		return ""
+	}
+	return email
+}
+
 // GetUserByEmail Gets the user information for user if there is an error appropriate response is return to output
 func GetUserByEmail(w http.ResponseWriter, email string, serviceName string) (*db.User, error) {
 	client, err := db.CreateMongoClient()
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+
+	"github.com/matba/slyde-server/internals/variants"
+)
+
+const variantCacheService = "VARIANT_CACHE"
+
+// the variants are kept next to the images and named by the uuid of image followed by the variant key
+var variantFileRegex = regexp.MustCompile(`^([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})-[^.]+\.[a-z]+$`)
+
+type variantFile struct {
+	imageKey string
+	path     string
+	info     os.FileInfo
+}
+
+// loadVariantCache finds the variants that are already on disk and tracks them in the variant cache
+func loadVariantCache() {
+	users, err := ioutil.ReadDir(filesDirectory + userDirectory)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogIoError, variantCacheService, "", err.Error())
+		return
+	}
+
+	files := []variantFile{}
+	for _, userDir := range users {
+		if !userDir.IsDir() {
+			continue
+		}
+		userID := userDir.Name()
+		imagesDir := getCurUserDirectory(userID) + imagesDiretory
+		images, err := ioutil.ReadDir(imagesDir)
+		if err != nil {
+			continue
+		}
+		for _, file := range images {
+			match := variantFileRegex.FindStringSubmatch(file.Name())
+			if match == nil {
+				continue
+			}
+			files = append(files, variantFile{
+				imageKey: variants.ImageKey(userID, match[1]),
+				path:     path.Join(imagesDir, file.Name()),
+				info:     file,
+			})
+		}
+	}
+
+	// the most recently used variants are tracked first
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].info.ModTime().After(files[j].info.ModTime())
+	})
+	cache := variants.GetVariantCache()
+	for _, file := range files {
+		cache.Track(file.imageKey, file.path, file.info.Size())
+	}
+	log.Printf("Tracking %d variants of images", len(files))
+}
+
+// HandleAdminVariantCache returns the statistics of variant cache
+func HandleAdminVariantCache(w http.ResponseWriter, r *http.Request) {
+	SetJsonContentType(w)
+	if r.Method != "GET" {
+		WriteErrorOnResponse(errUnsupportedOperation, &w, http.StatusBadRequest)
+		return
+	}
+	if GetAdmin(w, r) == "" {
+		return
+	}
+
+	js, _ := json.Marshal(variants.GetVariantCache().Stats())
+	w.Write(js)
+}
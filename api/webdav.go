@@ -0,0 +1,819 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/matba/slyde-server/internals/cacher"
+	"github.com/matba/slyde-server/internals/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/net/webdav"
+)
+
+const webdavService = "WEBDAV"
+const webdavPath = "/dav"
+const webdavRealm = "Slyde library"
+const webdavTriesCacheKey = "WEBDAV_TRIES_"
+const maxWebDAVTries = 10
+const webdavNamespace = "urn:slyde:image"
+const defaultLibraryEntryName = "untitled"
+
+var errLibraryDirectory = errors.New("Is a directory")
+var errLibraryFile = errors.New("Is not a directory")
+
+// the locks of WebDAV clients are kept per user, so the same paths in the libraries of users do not conflict
+var webdavLockSystems = make(map[string]webdav.LockSystem)
+var webdavLockSystemsMutex sync.Mutex
+
+// HandleWebDAV serves the library of user over WebDAV so it can be mounted by file managers. The albums are
+// the directories at the root and the images are files, all images are in the root and the images of each
+// album are in its directory too. Clients authenticate with the email of user and an app password.
+func HandleWebDAV(w http.ResponseWriter, r *http.Request) {
+	user := getWebDAVUser(w, r)
+	if user == nil {
+		return
+	}
+
+	handler := &webdav.Handler{
+		Prefix:     webdavPath,
+		FileSystem: &libraryFileSystem{user: user, entries: make(map[string][]libraryEntry)},
+		LockSystem: getWebDAVLockSystem(user.ID),
+		Logger: func(r *http.Request, err error) {
+			// clients look for their own metadata files that do not exist, so those are not logged
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf(errLogTemplate, errLogIoError, webdavService, user.Email, r.Method+" "+r.URL.Path+": "+err.Error())
+			}
+		},
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// getWebDAVUser authenticates the request with the email of user and one of its app passwords, or with the
+// token of a device of user, WebDAV clients can not keep a session so the credentials are checked on every
+// request. If they are not valid appropriate response is written to output and nil is returned.
+func getWebDAVUser(w http.ResponseWriter, r *http.Request) *db.User {
+	if strings.HasPrefix(r.Header.Get("Authorization"), bearerPrefix) {
+		user, device := getDeviceFromToken(w, r)
+		if device == nil {
+			return nil
+		}
+		markDeviceSeen(user, device, r)
+		return user
+	}
+
+	email, password, ok := r.BasicAuth()
+	if !ok {
+		writeWebDAVChallenge(w)
+		return nil
+	}
+
+	// the tries are counted per address, so failed tries from elsewhere can not lock the user out
+	triesKey := webdavTriesCacheKey + strings.ToLower(email) + "_" + getRequestAddress(r)
+	triesNo := 0
+	tries, err := cacher.GetCache().GetKeyValue(triesKey)
+	if err == nil {
+		triesNo, _ = strconv.Atoi(tries)
+		if triesNo >= maxWebDAVTries {
+			log.Printf(errLogTemplate, errLogTooManyTries, webdavService, email, tries)
+			WriteErrorOnResponse(errTooMayTries, &w, http.StatusTooManyRequests)
+			return nil
+		}
+	}
+	if err != nil && err != cacher.NotFound {
+		log.Printf(errLogTemplate, errLogCacheFailure, webdavService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return nil
+	}
+
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		log.Printf(errLogTemplate, errLogCannotConnectToDb, webdavService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return nil
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	var user db.User
+	err = collection.FindOne(context.TODO(), bson.D{{"email", email}}).Decode(&user)
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Printf(errLogTemplate, errLogCannotRetrieveFromDb, webdavService, email, err.Error())
+		WriteErrorOnResponse(errInternalError, &w, http.StatusInternalServerError)
+		return nil
+	}
+
+	var appPassword *db.AppPassword
+	if err == nil {
+		appPassword = findAppPassword(&user, password)
+	}
+	if appPassword == nil {
+		cacher.GetCache().AddKeyValue(triesKey, strconv.Itoa(triesNo+1), twelveHours)
+		log.Printf(errLogTemplate, errLogWrongCredentials, webdavService, email, "")
+		writeWebDAVChallenge(w)
+		return nil
+	}
+
+	if triesNo > 0 {
+		cacher.GetCache().DeleteKey(triesKey)
+	}
+	markAppPasswordUsed(&user, appPassword)
+	return &user
+}
+
+func writeWebDAVChallenge(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+webdavRealm+`", charset="UTF-8"`)
+	WriteErrorOnResponse(errUnAuthorized, &w, http.StatusUnauthorized)
+}
+
+func getWebDAVLockSystem(userID string) webdav.LockSystem {
+	webdavLockSystemsMutex.Lock()
+	defer webdavLockSystemsMutex.Unlock()
+	lockSystem, ok := webdavLockSystems[userID]
+	if !ok {
+		lockSystem = webdav.NewMemLS()
+		webdavLockSystems[userID] = lockSystem
+	}
+	return lockSystem
+}
+
+// libraryFileSystem is the library of user as a WebDAV file system, it is created for each request and
+// the changes go through the same flows as the API
+type libraryFileSystem struct {
+	user *db.User
+	// the entries of the root and album directories by album id, the root is the empty id
+	entries map[string][]libraryEntry
+}
+
+// libraryEntry is an album directory or an image file, both are nil for the root
+type libraryEntry struct {
+	name  string
+	album *db.Album
+	image *db.ImageInfo
+}
+
+func (e libraryEntry) isDirectory() bool {
+	return e.image == nil
+}
+
+func (fs *libraryFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	parts := splitLibraryPath(name)
+	// albums can not be nested
+	if len(parts) > 1 {
+		return os.ErrPermission
+	}
+	if len(parts) == 0 || findLibraryEntry(fs.getEntries(nil), parts[0]) != nil {
+		return os.ErrExist
+	}
+
+	id, _ := uuid.NewUUID()
+	album := db.Album{
+		ID:           id.String(),
+		Name:         parts[0],
+		ImageIDs:     []string{},
+		CreationDate: time.Now(),
+	}
+	return fs.update(func(collection *mongo.Collection) error {
+		return insertAlbum(collection, fs.user.ID, album)
+	})
+}
+
+func (fs *libraryFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		return fs.createUpload(name)
+	}
+
+	entry, _, err := fs.findEntry(name)
+	if err != nil {
+		return nil, err
+	}
+	if entry.isDirectory() {
+		return &libraryDirectory{fs: fs, entry: entry}, nil
+	}
+	return &libraryFile{fs: fs, entry: entry}, nil
+}
+
+// RemoveAll moves an image to trash wherever it is removed from, removing an album directory only deletes
+// the album and its images stay in the root
+func (fs *libraryFileSystem) RemoveAll(ctx context.Context, name string) error {
+	entry, _, err := fs.findEntry(name)
+	if err != nil {
+		return err
+	}
+	if entry.album == nil && entry.image == nil {
+		return os.ErrPermission
+	}
+
+	return fs.update(func(collection *mongo.Collection) error {
+		if entry.album != nil {
+			return deleteAlbums(collection, fs.user.ID, []string{entry.album.ID})
+		}
+		return trashImages(collection, fs.user.ID, []string{entry.image.ID})
+	})
+}
+
+// Rename renames albums and images, moving an image into an album directory adds it to the album and moving
+// it out of an album directory removes it from that album
+func (fs *libraryFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	entry, sourceAlbum, err := fs.findEntry(oldName)
+	if err != nil {
+		return err
+	}
+	newParts := splitLibraryPath(newName)
+	if len(newParts) == 0 || (entry.album == nil && entry.image == nil) {
+		return os.ErrPermission
+	}
+
+	if entry.album != nil {
+		if len(newParts) > 1 {
+			return os.ErrPermission
+		}
+		album := *entry.album
+		album.Name = newParts[0]
+		return fs.update(func(collection *mongo.Collection) error {
+			return updateAlbum(collection, fs.user.ID, album)
+		})
+	}
+
+	targetAlbum, err := fs.findParentAlbum(newParts)
+	if err != nil {
+		return err
+	}
+	img := *entry.image
+	imageName := imageNameFromFileName(newParts[len(newParts)-1])
+	return fs.update(func(collection *mongo.Collection) error {
+		if !strings.EqualFold(entry.name, newParts[len(newParts)-1]) {
+			err := renameImage(collection, fs.user.ID, img.ID, imageName)
+			if err != nil {
+				return err
+			}
+		}
+		if sourceAlbum != nil && (targetAlbum == nil || targetAlbum.ID != sourceAlbum.ID) {
+			album := *sourceAlbum
+			album.ImageIDs = removeImageID(album.ImageIDs, img.ID)
+			err := updateAlbum(collection, fs.user.ID, album)
+			if err != nil {
+				return err
+			}
+		}
+		if targetAlbum != nil && (sourceAlbum == nil || targetAlbum.ID != sourceAlbum.ID) &&
+			len(removeImageID(targetAlbum.ImageIDs, img.ID)) == len(targetAlbum.ImageIDs) {
+			return addImagesToAlbum(collection, fs.user, targetAlbum.ID, []string{img.ID})
+		}
+		return nil
+	})
+}
+
+func (fs *libraryFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	entry, _, err := fs.findEntry(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.getFileInfo(entry), nil
+}
+
+// update applies the change to the library and reloads the library of user, so the following operations
+// of request see the change
+func (fs *libraryFileSystem) update(change func(collection *mongo.Collection) error) error {
+	client, err := db.CreateMongoClient()
+	defer db.CloseClient(client)
+	if err != nil {
+		return err
+	}
+
+	collection := (*client).Database(db.MainDbName).Collection(db.UsersCollection)
+	err = change(collection)
+	if err != nil {
+		return err
+	}
+	var user db.User
+	err = collection.FindOne(context.TODO(), bson.D{{"id", fs.user.ID}}).Decode(&user)
+	if err != nil {
+		return err
+	}
+	fs.user = &user
+	fs.entries = make(map[string][]libraryEntry)
+	return nil
+}
+
+// getEntries returns the entries of the album directory or the root if album is nil, the names of entries
+// are unique regardless of case so each entry can be found by its name
+func (fs *libraryFileSystem) getEntries(album *db.Album) []libraryEntry {
+	key := ""
+	if album != nil {
+		key = album.ID
+	}
+	if entries, ok := fs.entries[key]; ok {
+		return entries
+	}
+
+	entries := []libraryEntry{}
+	var images []db.ImageInfo
+	if album == nil {
+		for i := range fs.user.Albums {
+			entries = append(entries, libraryEntry{
+				name:  getLibraryEntryName(fs.user.Albums[i].Name),
+				album: &fs.user.Albums[i],
+			})
+		}
+		images = getActiveImages(fs.user)
+	} else {
+		images = getAlbumImages(fs.user, album)
+	}
+	for i := range images {
+		if images[i].IsReady() {
+			entries = append(entries, libraryEntry{
+				name:  getLibraryEntryName(images[i].Name) + getLibraryFileExtension(images[i]),
+				image: &images[i],
+			})
+		}
+	}
+
+	nameCounts := make(map[string]int)
+	for _, entry := range entries {
+		nameCounts[strings.ToLower(entry.name)]++
+	}
+	for i := range entries {
+		if nameCounts[strings.ToLower(entries[i].name)] > 1 {
+			entries[i].name = getUniqueEntryName(entries[i])
+		}
+	}
+
+	fs.entries[key] = entries
+	return entries
+}
+
+// findEntry returns the entry of path and the album of the directory it is in, the album is nil for the
+// entries of the root
+func (fs *libraryFileSystem) findEntry(name string) (libraryEntry, *db.Album, error) {
+	parts := splitLibraryPath(name)
+	if len(parts) == 0 {
+		return libraryEntry{name: "/"}, nil, nil
+	}
+	if len(parts) > 2 {
+		return libraryEntry{}, nil, os.ErrNotExist
+	}
+
+	album, err := fs.findParentAlbum(parts)
+	if err != nil {
+		return libraryEntry{}, nil, err
+	}
+	entry := findLibraryEntry(fs.getEntries(album), parts[len(parts)-1])
+	if entry == nil {
+		return libraryEntry{}, nil, os.ErrNotExist
+	}
+	return *entry, album, nil
+}
+
+// findParentAlbum returns the album of the directory of path, nil if it is in the root
+func (fs *libraryFileSystem) findParentAlbum(parts []string) (*db.Album, error) {
+	if len(parts) == 1 {
+		return nil, nil
+	}
+	if len(parts) != 2 {
+		return nil, os.ErrNotExist
+	}
+	directory := findLibraryEntry(fs.getEntries(nil), parts[0])
+	if directory == nil {
+		return nil, os.ErrNotExist
+	}
+	if directory.album == nil {
+		return nil, errLibraryFile
+	}
+	return directory.album, nil
+}
+
+// getFileInfo describes the entry with the metadata of its album or image
+func (fs *libraryFileSystem) getFileInfo(entry libraryEntry) *libraryFileInfo {
+	info := &libraryFileInfo{entry: entry, modTime: fs.user.CreationDate}
+	if entry.album != nil {
+		info.modTime = entry.album.CreationDate
+	}
+	if entry.image != nil {
+		info.modTime = getImageDate(*entry.image)
+		if stat, err := os.Stat(getLibraryFilePath(fs.user.ID, *entry.image)); err == nil {
+			info.size = stat.Size()
+		}
+	}
+	return info
+}
+
+// createUpload returns the file the content of a new image is written to, if there already is an image
+// with the name it is moved to trash when the new image is added
+func (fs *libraryFileSystem) createUpload(name string) (webdav.File, error) {
+	parts := splitLibraryPath(name)
+	if len(parts) == 0 {
+		return nil, os.ErrPermission
+	}
+	album, err := fs.findParentAlbum(parts)
+	if err != nil {
+		return nil, err
+	}
+	upload := &libraryUpload{fs: fs, name: parts[len(parts)-1], album: album}
+	if existing := findLibraryEntry(fs.getEntries(album), upload.name); existing != nil {
+		if existing.isDirectory() {
+			return nil, errLibraryDirectory
+		}
+		upload.replaced = existing.image
+	}
+	return upload, nil
+}
+
+// libraryFileInfo describes an entry of library, the images are shown with the date they were taken
+type libraryFileInfo struct {
+	entry   libraryEntry
+	size    int64
+	modTime time.Time
+}
+
+func (i *libraryFileInfo) Name() string {
+	return i.entry.name
+}
+
+func (i *libraryFileInfo) Size() int64 {
+	return i.size
+}
+
+func (i *libraryFileInfo) Mode() os.FileMode {
+	if i.entry.isDirectory() {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (i *libraryFileInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+func (i *libraryFileInfo) IsDir() bool {
+	return i.entry.isDirectory()
+}
+
+func (i *libraryFileInfo) Sys() interface{} {
+	return nil
+}
+
+// ETag is the content hash of image if its derivative is served, the originals never change so their id is
+// used instead
+func (i *libraryFileInfo) ETag(ctx context.Context) (string, error) {
+	if i.entry.image == nil {
+		return "", webdav.ErrNotImplemented
+	}
+	if len(i.entry.image.OriginalFile) > 0 {
+		return `"` + i.entry.image.ID + `"`, nil
+	}
+	return `"` + i.entry.image.Hash + `"`, nil
+}
+
+func (i *libraryFileInfo) ContentType(ctx context.Context) (string, error) {
+	if i.entry.image == nil {
+		return "", webdav.ErrNotImplemented
+	}
+	contentType := mime.TypeByExtension(getLibraryFileExtension(*i.entry.image))
+	if len(contentType) == 0 {
+		contentType = "image/jpeg"
+	}
+	return contentType, nil
+}
+
+// libraryFile serves the original of image, or the derivative of images uploaded before originals were kept.
+// The file on disk is only opened when it is read, since files are also opened for their properties.
+type libraryFile struct {
+	fs    *libraryFileSystem
+	entry libraryEntry
+	file  *os.File
+}
+
+func (f *libraryFile) open() error {
+	if f.file != nil {
+		return nil
+	}
+	file, err := os.Open(getLibraryFilePath(f.fs.user.ID, *f.entry.image))
+	if err != nil {
+		return err
+	}
+	f.file = file
+	return nil
+}
+
+func (f *libraryFile) Read(p []byte) (int, error) {
+	err := f.open()
+	if err != nil {
+		return 0, err
+	}
+	return f.file.Read(p)
+}
+
+func (f *libraryFile) Seek(offset int64, whence int) (int64, error) {
+	err := f.open()
+	if err != nil {
+		return 0, err
+	}
+	return f.file.Seek(offset, whence)
+}
+
+func (f *libraryFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *libraryFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errLibraryFile
+}
+
+func (f *libraryFile) Stat() (os.FileInfo, error) {
+	return f.fs.getFileInfo(f.entry), nil
+}
+
+func (f *libraryFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// DeadProps returns the metadata of image as properties in the namespace of server
+func (f *libraryFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	img := f.entry.image
+	props := make(map[xml.Name]webdav.Property)
+	addProp := func(name string, value string) {
+		var escaped bytes.Buffer
+		xml.EscapeText(&escaped, []byte(value))
+		xmlName := xml.Name{Space: webdavNamespace, Local: name}
+		props[xmlName] = webdav.Property{XMLName: xmlName, InnerXML: escaped.Bytes()}
+	}
+
+	addProp("id", img.ID)
+	addProp("width", strconv.Itoa(int(img.Width)))
+	addProp("height", strconv.Itoa(int(img.Height)))
+	addProp("uploadDate", img.UploadDate.UTC().Format(time.RFC3339))
+	if !img.CaptureDate.IsZero() {
+		addProp("captureDate", img.CaptureDate.UTC().Format("2006-01-02T15:04:05"))
+	}
+	addProp("caption", img.Caption)
+	addProp("tags", strings.Join(getImageTags(*img), ","))
+	addProp("favorite", strconv.FormatBool(img.Favorite))
+	addProp("rating", strconv.Itoa(img.Rating))
+	addProp("blurHash", img.BlurHash)
+	addProp("averageColor", img.AverageColor)
+	return props, nil
+}
+
+// Patch rejects all changes, the metadata of images is changed through the API
+func (f *libraryFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	forbidden := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, prop := range patch.Props {
+			forbidden.Props = append(forbidden.Props, webdav.Property{XMLName: prop.XMLName})
+		}
+	}
+	return []webdav.Propstat{forbidden}, nil
+}
+
+// libraryDirectory lists the entries of the root or an album
+type libraryDirectory struct {
+	fs     *libraryFileSystem
+	entry  libraryEntry
+	offset int
+}
+
+func (d *libraryDirectory) Read(p []byte) (int, error) {
+	return 0, errLibraryDirectory
+}
+
+func (d *libraryDirectory) Seek(offset int64, whence int) (int64, error) {
+	return 0, errLibraryDirectory
+}
+
+func (d *libraryDirectory) Write(p []byte) (int, error) {
+	return 0, errLibraryDirectory
+}
+
+func (d *libraryDirectory) Readdir(count int) ([]os.FileInfo, error) {
+	entries := d.fs.getEntries(d.entry.album)
+	if d.offset >= len(entries) && count > 0 {
+		return nil, io.EOF
+	}
+	end := len(entries)
+	if count > 0 && d.offset+count < end {
+		end = d.offset + count
+	}
+	infos := []os.FileInfo{}
+	for _, entry := range entries[d.offset:end] {
+		infos = append(infos, d.fs.getFileInfo(entry))
+	}
+	d.offset = end
+	return infos, nil
+}
+
+func (d *libraryDirectory) Stat() (os.FileInfo, error) {
+	return d.fs.getFileInfo(d.entry), nil
+}
+
+func (d *libraryDirectory) Close() error {
+	return nil
+}
+
+// libraryUpload keeps the content of an image that is being written in a temporary file, the image is
+// added through the upload validation when the file is closed
+type libraryUpload struct {
+	fs    *libraryFileSystem
+	name  string
+	album *db.Album
+	// the image with the same name that the upload replaces
+	replaced *db.ImageInfo
+	file     *os.File
+	size     int64
+}
+
+func (u *libraryUpload) Write(p []byte) (int, error) {
+	// the metadata files that file managers write next to the real files are dropped
+	if strings.HasPrefix(u.name, ".") {
+		return len(p), nil
+	}
+	if u.size+int64(len(p)) > maxUploadSize {
+		return 0, errors.New(errFileTooBig)
+	}
+	if u.file == nil {
+		file, err := ioutil.TempFile("", "webdav-upload-*")
+		if err != nil {
+			return 0, err
+		}
+		u.file = file
+	}
+	n, err := u.file.Write(p)
+	u.size += int64(n)
+	return n, err
+}
+
+// Close adds the written image to the library, clients create empty files before writing their content so
+// nothing is added for them
+func (u *libraryUpload) Close() error {
+	if u.file == nil {
+		return nil
+	}
+	defer os.Remove(u.file.Name())
+	defer u.file.Close()
+
+	_, err := u.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return u.fs.update(func(collection *mongo.Collection) error {
+		imgInfo, _, uploadErr := acceptUpload(collection, u.fs.user, imageNameFromFileName(u.name), u.file)
+		if uploadErr != nil {
+			log.Printf(errLogTemplate, errLogImageValidationError, webdavService, u.fs.user.Email, uploadErr.Error())
+			return errors.New(uploadErr.description)
+		}
+		if u.album != nil {
+			err := addImagesToAlbum(collection, u.fs.user, u.album.ID, []string{imgInfo.ID})
+			if err != nil {
+				return err
+			}
+		}
+		if u.replaced != nil {
+			return trashImages(collection, u.fs.user.ID, []string{u.replaced.ID})
+		}
+		return nil
+	})
+}
+
+func (u *libraryUpload) Read(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (u *libraryUpload) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrPermission
+}
+
+func (u *libraryUpload) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errLibraryFile
+}
+
+func (u *libraryUpload) Stat() (os.FileInfo, error) {
+	return &libraryUploadInfo{name: u.name, size: u.size, modTime: time.Now()}, nil
+}
+
+// libraryUploadInfo describes an upload before its image is added
+type libraryUploadInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i *libraryUploadInfo) Name() string {
+	return i.name
+}
+
+func (i *libraryUploadInfo) Size() int64 {
+	return i.size
+}
+
+func (i *libraryUploadInfo) Mode() os.FileMode {
+	return 0644
+}
+
+func (i *libraryUploadInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+func (i *libraryUploadInfo) IsDir() bool {
+	return false
+}
+
+func (i *libraryUploadInfo) Sys() interface{} {
+	return nil
+}
+
+// renameImage sets the name of image and its search entry
+func renameImage(collection *mongo.Collection, userID string, imageID string, name string) error {
+	filter := bson.D{{"id", userID}, {"images.id", imageID}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"images.$.name", name},
+		}},
+	}
+	_, err := collection.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		return err
+	}
+	updateSearchEntries(userID, []string{imageID}, bson.D{{"$set", bson.D{{"name", name}}}})
+	return nil
+}
+
+func removeImageID(imageIds []string, imageID string) []string {
+	filtered := []string{}
+	for _, id := range imageIds {
+		if id != imageID {
+			filtered = append(filtered, id)
+		}
+	}
+	return filtered
+}
+
+func splitLibraryPath(name string) []string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if len(name) == 0 {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+func findLibraryEntry(entries []libraryEntry, name string) *libraryEntry {
+	for i := range entries {
+		if entries[i].name == name {
+			return &entries[i]
+		}
+	}
+	for i := range entries {
+		if strings.EqualFold(entries[i].name, name) {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+// getLibraryEntryName makes the name of album or image usable as a file name
+func getLibraryEntryName(name string) string {
+	name = strings.TrimSpace(strings.NewReplacer("/", "_", "\\", "_").Replace(name))
+	if len(name) == 0 || name == "." || name == ".." {
+		return defaultLibraryEntryName
+	}
+	return name
+}
+
+// getUniqueEntryName adds the start of the id of album or image to its name
+func getUniqueEntryName(entry libraryEntry) string {
+	if entry.album != nil {
+		return entry.name + " (" + entry.album.ID[:8] + ")"
+	}
+	extension := path.Ext(entry.name)
+	return strings.TrimSuffix(entry.name, extension) + " (" + entry.image.ID[:8] + ")" + extension
+}
+
+func getLibraryFileExtension(img db.ImageInfo) string {
+	if len(img.OriginalFile) > 0 {
+		return path.Ext(img.OriginalFile)
+	}
+	return jpegExtension
+}
+
+func getLibraryFilePath(userID string, img db.ImageInfo) string {
+	if len(img.OriginalFile) > 0 {
+		return getUserOriginalImagePath(userID, img.OriginalFile)
+	}
+	return getUserImagePath(userID, img.ID, false)
+}
@@ -1,9 +1,32 @@
 package main
 
 import (
+	"flag"
+	"log"
+	"os"
+
 	"github.com/matba/slyde-server/api"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		runFsck(os.Args[2:])
+		return
+	}
 	api.GetController().Start()
 }
+
+// runFsck checks the records of images against the files on disk and prints the report, it is meant to be run
+// while the server is stopped and the regenerations it queues are done once the server starts. The end point
+// /admin/fsck does the same on a running server.
+func runFsck(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "repair the inconsistencies instead of only reporting them")
+	userID := flags.String("user", "", "check only the user with the id")
+	flags.Parse(args)
+
+	err := api.RunConsistencyCheck(*userID, *repair, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/matba/slyde-server/internals/utils"
+)
+
+const defaultVariantCacheBudget = 2 << 30
+const defaultImageWorkers = 4
+const defaultStorageQuota = 1 << 30
+const defaultTrashRetentionDays = 30
+const defaultSignedURLTTL = 3600
+const defaultMaxSignedURLTTL = 7 * 24 * 3600
+const defaultMemoriesWindowDays = 3
+const defaultSMTPAddress = ":2525"
+const defaultMaxMailBytes = 25 << 20
+const defaultDeviceOfflineMinutes = 60
+
+// ServerConfig keeps the configurable settings of the server
+type ServerConfig struct {
+	// the emails of users that can call the administration endpoints
+	Admins []string `yaml:"admins"`
+	// the maximum number of bytes the rendered variants of images can take on disk
+	VariantCacheBudget int64 `yaml:"variantCacheBudget"`
+	// the number of workers that process uploaded images in background
+	ImageWorkers int `yaml:"imageWorkers"`
+	// the bytes each user can store when the user does not have its own quota
+	DefaultStorageQuota int64 `yaml:"defaultStorageQuota"`
+	// the number of days deleted images are kept in trash before they are purged
+	TrashRetentionDays int `yaml:"trashRetentionDays"`
+	// the keys for signing image urls, the first key signs new urls and the others are still accepted
+	URLSigningKeys []SigningKey `yaml:"urlSigningKeys"`
+	// the seconds signed urls are valid when the client does not ask for a specific time
+	SignedURLTTL int64 `yaml:"signedUrlTtl"`
+	// the maximum seconds a client can ask signed urls to be valid
+	MaxSignedURLTTL int64 `yaml:"maxSignedUrlTtl"`
+	// the days before and after the same calendar day images are picked as memories by default
+	MemoriesWindowDays int `yaml:"memoriesWindowDays"`
+	// the receiver of the emails whose photos are added to the images of users
+	SMTP SMTPConfig `yaml:"smtp"`
+	// the minutes a frame can miss heartbeats before its owner is alerted, unless the frame sets its own
+	DeviceOfflineMinutes int `yaml:"deviceOfflineMinutes"`
+}
+
+// SMTPConfig keeps the settings of the embedded SMTP receiver, it only runs if it is enabled
+type SMTPConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Address string `yaml:"address"`
+	// the domain of the inbox addresses of users, the mail exchanger of the domain should point to the receiver
+	Domain string `yaml:"domain"`
+	// the biggest email accepted in bytes
+	MaxMessageBytes int `yaml:"maxMessageBytes"`
+}
+
+// SigningKey is a secret used for signing urls, the id is put in the url so the key can be rotated
+type SigningKey struct {
+	ID     string `yaml:"id"`
+	Secret string `yaml:"secret"`
+}
+
+var serverConfig *ServerConfig
+var mux sync.Mutex
+
+// GetServerConfig Get the configuration of server
+func GetServerConfig() *ServerConfig {
+	mux.Lock()
+	if serverConfig == nil {
+		sc, err := loadServerConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		serverConfig = sc
+	}
+	mux.Unlock()
+	return serverConfig
+}
+
+func loadServerConfig() (*ServerConfig, error) {
+	sc := ServerConfig{}
+	f, err := os.Open(utils.GetConfigPath() + "server.yaml")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	err = decoder.Decode(&sc)
+	if err != nil {
+		return nil, err
+	}
+
+	if sc.VariantCacheBudget <= 0 {
+		sc.VariantCacheBudget = defaultVariantCacheBudget
+	}
+	if sc.ImageWorkers <= 0 {
+		sc.ImageWorkers = defaultImageWorkers
+	}
+	if sc.DefaultStorageQuota <= 0 {
+		sc.DefaultStorageQuota = defaultStorageQuota
+	}
+	if sc.TrashRetentionDays <= 0 {
+		sc.TrashRetentionDays = defaultTrashRetentionDays
+	}
+	if sc.SignedURLTTL <= 0 {
+		sc.SignedURLTTL = defaultSignedURLTTL
+	}
+	if sc.MaxSignedURLTTL <= 0 {
+		sc.MaxSignedURLTTL = defaultMaxSignedURLTTL
+	}
+	if sc.MemoriesWindowDays <= 0 {
+		sc.MemoriesWindowDays = defaultMemoriesWindowDays
+	}
+	if len(sc.SMTP.Address) == 0 {
+		sc.SMTP.Address = defaultSMTPAddress
+	}
+	if sc.SMTP.MaxMessageBytes <= 0 {
+		sc.SMTP.MaxMessageBytes = defaultMaxMailBytes
+	}
+	if sc.DeviceOfflineMinutes <= 0 {
+		sc.DeviceOfflineMinutes = defaultDeviceOfflineMinutes
+	}
+	return &sc, nil
+}
+
+// GetSigningKey returns the key with the id or nil if there is no such key
+func (c *ServerConfig) GetSigningKey(id string) *SigningKey {
+	for i := range c.URLSigningKeys {
+		if c.URLSigningKeys[i].ID == id {
+			return &c.URLSigningKeys[i]
+		}
+	}
+	return nil
+}
+
+// IsAdmin checks whether the user with email can call administration endpoints
+func (c *ServerConfig) IsAdmin(email string) bool {
+	for _, admin := range c.Admins {
+		if strings.EqualFold(admin, email) {
+			return true
+		}
+	}
+	return false
+}
@@ -8,3 +8,132 @@ const UsersCollection = "users"
 
 // ImagesCollection the collection that keep the image info
 const ImagesCollection = "images"
+
+// JobsCollection the collection that keep the background jobs
+const JobsCollection = "jobs"
+
+// LibrariesCollection the collection that keep the shared libraries
+const LibrariesCollection = "libraries"
+
+// ImageStatusProcessing the image is uploaded and its derivatives are being generated
+const ImageStatusProcessing = "processing"
+
+// ImageStatusReady the image and its derivatives are ready to be served
+const ImageStatusReady = "ready"
+
+// ImageStatusFailed generating the derivatives of image failed
+const ImageStatusFailed = "failed"
+
+// ImageEditRotate rotates the image by multiples of 90 degrees
+const ImageEditRotate = "rotate"
+
+// ImageEditCrop crops a rectangle of the image
+const ImageEditCrop = "crop"
+
+// ImageEditFlip flips the image horizontally or vertically
+const ImageEditFlip = "flip"
+
+// ImageEditBrightness changes the brightness of image
+const ImageEditBrightness = "brightness"
+
+// ImageEditContrast changes the contrast of image
+const ImageEditContrast = "contrast"
+
+// JobStatusQueued the job is waiting for a worker
+const JobStatusQueued = "queued"
+
+// JobStatusRunning the job is being run by a worker
+const JobStatusRunning = "running"
+
+// JobStatusDone the job has finished successfully
+const JobStatusDone = "done"
+
+// JobStatusFailed the job has failed after all of its attempts
+const JobStatusFailed = "failed"
+
+// SlideshowOrderSequential shows the images of slideshow in the order of its source
+const SlideshowOrderSequential = "sequential"
+
+// SlideshowOrderShuffle shows the images of slideshow in a random order
+const SlideshowOrderShuffle = "shuffle"
+
+// SlideshowOrderWeighted picks the images of slideshow randomly, images with higher ratings are picked more often
+const SlideshowOrderWeighted = "weighted"
+
+// SlideshowSourceMemories shows the images taken around the same calendar day in previous years
+const SlideshowSourceMemories = "memories"
+
+// SlideshowLayoutSingle shows one image on each slide
+const SlideshowLayoutSingle = "single"
+
+// SlideshowLayoutPortraitPairs shows two portrait images side by side on landscape frames
+const SlideshowLayoutPortraitPairs = "portraitPairs"
+
+// SlideshowPairingDate pairs the portrait images that are taken closest in time
+const SlideshowPairingDate = "date"
+
+// SlideshowPairingAlbum pairs the portrait images that are in the same album
+const SlideshowPairingAlbum = "album"
+
+// ProfileOrientationLandscape the frame is wider than it is tall
+const ProfileOrientationLandscape = "landscape"
+
+// ProfileOrientationPortrait the frame is taller than it is wide
+const ProfileOrientationPortrait = "portrait"
+
+// ProfileColorModeColor the frame shows colours
+const ProfileColorModeColor = "colour"
+
+// ProfileColorModeGrayscale the frame only shows shades of gray
+const ProfileColorModeGrayscale = "grayscale"
+
+// OverlayTypeDate shows the date the photo was taken, or the date it was uploaded if it is not known
+const OverlayTypeDate = "date"
+
+// OverlayTypeCaption shows the caption of image
+const OverlayTypeCaption = "caption"
+
+// OverlayTypeAlbum shows the name of the album of image
+const OverlayTypeAlbum = "album"
+
+// OverlayTypeWatermark shows a custom text
+const OverlayTypeWatermark = "watermark"
+
+// OverlayPositionTopLeft puts the overlay in the top left corner
+const OverlayPositionTopLeft = "topLeft"
+
+// OverlayPositionTopCenter puts the overlay in the middle of the top edge
+const OverlayPositionTopCenter = "topCenter"
+
+// OverlayPositionTopRight puts the overlay in the top right corner
+const OverlayPositionTopRight = "topRight"
+
+// OverlayPositionCenter puts the overlay in the middle of image
+const OverlayPositionCenter = "center"
+
+// OverlayPositionBottomLeft puts the overlay in the bottom left corner
+const OverlayPositionBottomLeft = "bottomLeft"
+
+// OverlayPositionBottomCenter puts the overlay in the middle of the bottom edge
+const OverlayPositionBottomCenter = "bottomCenter"
+
+// OverlayPositionBottomRight puts the overlay in the bottom right corner
+const OverlayPositionBottomRight = "bottomRight"
+
+// ShareTargetAlbum the share link gives access to an album
+const ShareTargetAlbum = "album"
+
+// ShareTargetSlideshow the share link gives access to a slideshow
+const ShareTargetSlideshow = "slideshow"
+
+// ShareScopeView the share link only allows viewing the shared images
+const ShareScopeView = "view"
+
+// LibraryRoleOwner the member manages the library, its members and all of its images
+const LibraryRoleOwner = "owner"
+
+// LibraryRoleContributor the member can add images to the library and remove its own images
+const LibraryRoleContributor = "contributor"
+
+// LibraryRoleViewer the member can only view the images of library
+const LibraryRoleViewer = "viewer"
@@ -13,8 +13,25 @@ type User struct {
 	SecurityInfo SecurityInformation
 	Name         string
 	CreationDate time.Time
-	ImageQuota   int
-	Images       []ImageInfo
+	// the bytes the user can store, zero means the default quota of server
+	StorageQuota int64
+	// the bytes of the originals and derivatives of images of user
+	StorageUsed int64
+	// increased with every change of the storage used, so a recomputed usage is only saved if the usage
+	// has not changed while it was recomputed
+	UsageVersion int64
+	// the IANA name of the timezone of user, memories are picked by the calendar day in it
+	Timezone   string
+	Images     []ImageInfo
+	Albums     []Album
+	Slideshows []Slideshow
+	ShareLinks []ShareLink
+	Profiles   []DeviceProfile
+	Inboxes    []MailInbox
+	// the email addresses that can send photos to the inboxes of user
+	AllowedSenders []string
+	AppPasswords   []AppPassword
+	Devices        []Device
 }
 
 // ImageInfo keeps information about an uploaded image
@@ -24,4 +41,306 @@ type ImageInfo struct {
 	Height     uint
 	UploadDate time.Time
 	Name       string
+	// content hashes of the stored image and thumbnail, they are used as their versions
+	Hash          string
+	ThumbnailHash string
+	// the status of generating the derivatives, images uploaded before processing was asynchronous have no status
+	Status string
+	// the name of the uploaded file as it was received, inside the originals directory of user
+	OriginalFile string
+	// the edits applied in order on the original when the derivatives are generated
+	Edits []ImageEdit
+	// the version of edits is increased whenever they change, the applied version is the version of edits the
+	// stored derivatives were generated with. The image stays ready with its previous derivatives while a
+	// change of edits is pending.
+	EditVersion        int
+	AppliedEditVersion int
+	// the bytes of the original, the image and the thumbnail on disk, the rendered variants are not counted
+	Size int64
+	// the time image was moved to trash, zero if the image is not in trash
+	DeletionDate time.Time
+	Caption      string
+	Tags         []string
+	Favorite     bool
+	// the rating of user between 0 and 5, zero means the image is not rated
+	Rating int
+	// the image is never picked by slideshows
+	NeverShow bool
+	// the local time the photo was taken from its EXIF data, it is kept as UTC since EXIF does not have
+	// the timezone, zero if it is not known
+	CaptureDate time.Time
+	// the placeholders clients show while the thumbnail is loading, the colours are in #rrggbb format
+	BlurHash     string
+	AverageColor string
+	Palette      []string
+}
+
+// ImageEdit keeps a single non-destructive edit operation of an image
+type ImageEdit struct {
+	Type string
+	// clockwise rotation in degrees, a multiple of 90
+	Angle int
+	// the crop rectangle relative to the width and height of image
+	X      float64
+	Y      float64
+	Width  float64
+	Height float64
+	// horizontal or vertical flip
+	Direction string
+	// brightness or contrast change in percent between -100 and 100
+	Amount float64
+}
+
+// HasPendingEdits checks whether the stored derivatives are not generated with the current edits yet
+func (img ImageInfo) HasPendingEdits() bool {
+	return img.EditVersion != img.AppliedEditVersion
+}
+
+// IsReady checks whether the image and its derivatives can be served
+func (img ImageInfo) IsReady() bool {
+	return img.Status == "" || img.Status == ImageStatusReady
+}
+
+// IsTrashed checks whether the image is in trash
+func (img ImageInfo) IsTrashed() bool {
+	return !img.DeletionDate.IsZero()
+}
+
+// Job keeps the information about a background job
+type Job struct {
+	ID          string
+	Type        string
+	UserID      string
+	Payload     map[string]string
+	Status      string
+	Attempts    int
+	MaxAttempts int
+	Error       string
+	// the job is done or failed, finished jobs are removed after a retention
+	Finished     bool
+	CreationDate time.Time
+	UpdateDate   time.Time
+	NextRunDate  time.Time
+}
+
+// Album keeps a named and ordered selection of the images of user
+type Album struct {
+	ID           string
+	Name         string
+	ImageIDs     []string
+	CreationDate time.Time
+}
+
+// Slideshow keeps the settings of a slideshow played on frames
+type Slideshow struct {
+	ID   string
+	Name string
+	// the album whose images are shown, all images of user are shown if it is empty
+	AlbumID string
+	// the seconds each image is shown
+	Interval int
+	// the order images are shown in, sequential, shuffle or weighted
+	Order string
+	// the number of slides before the same image can be picked again in weighted order
+	RepeatWindow int
+	// memories shows the images taken around the same day in previous years instead of the album
+	Source string
+	// how images are put on slides, single or portraitPairs
+	Layout string
+	// how portrait images are paired in portraitPairs layout, by date or album
+	Pairing string
+	// the pixels between paired images and the colour around them in #rrggbb format
+	Gutter     int
+	Background string
+	// the texts drawn on the images rendered for the slideshow
+	Overlays     []Overlay
+	CreationDate time.Time
+}
+
+// DeviceProfile describes the screen of a kind of frame, the images of user are pre-rendered for each profile
+type DeviceProfile struct {
+	ID     string
+	Name   string
+	Width  int
+	Height int
+	// landscape or portrait, the longer side of resolution is the width of landscape frames
+	Orientation string
+	// how images with another aspect ratio are fitted on the screen, contain, cover, fill or pad
+	Fit string
+	// colour or grayscale
+	ColorMode string
+	// the biggest file the frame can download in bytes, zero means no limit
+	MaxFileSize int64
+	// the texts drawn on the images rendered for the profile
+	Overlays []Overlay
+	// changes whenever the profile is updated, so the renderings of older settings are not served
+	Version      string
+	CreationDate time.Time
+}
+
+// Overlay is a text drawn on rendered images for frames that can not draw text
+type Overlay struct {
+	// date, caption, album or watermark
+	Type string
+	// the text of watermark
+	Text string
+	// the corner, edge or center of image the text is put at
+	Position string
+	// the height of text in pixels of the rendered image
+	FontSize int
+	// the colour of text in #rrggbb format
+	Color  string
+	Shadow bool
+	// between 0 and 1
+	Opacity float64
+}
+
+// MailInbox is a secret email address, the photos attached to the emails sent to it are added to the images
+// of user and to the album if it is set
+type MailInbox struct {
+	ID string
+	// the random local part of the address, so the address can not be guessed
+	Token        string
+	AlbumID      string
+	CreationDate time.Time
+}
+
+// AppPassword lets the apps that can not sign in with a session, like WebDAV clients, access the library of
+// user, only the hash of password is kept
+type AppPassword struct {
+	ID           string
+	Name         string
+	PasswordHash string
+	CreationDate time.Time
+	// the last time the password was used, it is updated at most once an hour
+	LastUsedDate time.Time
+}
+
+// Device is a frame of user, the frame fetches its configuration with its token and only the hash of token
+// is kept
+type Device struct {
+	ID    string
+	Name  string
+	Model string
+	// the resolution of screen, zero if it is not known
+	Width  int
+	Height int
+	// landscape or portrait
+	Orientation string
+	// the IANA name of the timezone of frame, the timezone of user is used if it is empty
+	Timezone string
+	// the slideshow or the album shown on the frame, all images of user are shown if both are empty
+	SlideshowID string
+	AlbumID     string
+	// the profile the images are pre-rendered with for the frame, empty if the frame scales images itself
+	ProfileID string
+	// the seconds each slide is shown, zero means the interval of slideshow
+	SlideDuration int
+	// the brightness of screen over the day, the screen is at full brightness if it is empty
+	BrightnessSchedule []BrightnessPeriod
+	// the hex sha256 of token, the token is random so the device can be found by its hash
+	TokenHash string
+	// the last time the frame fetched its configuration or sent a heartbeat and the address it came from
+	LastSeenDate    time.Time
+	LastSeenAddress string
+	// the latest heartbeats of frame with the most recent last, zero date if it never sent one
+	Heartbeats        []Heartbeat
+	LastHeartbeatDate time.Time
+	// the minutes without heartbeats after which the owner is alerted, zero means the default of server
+	OfflineAlertMinutes int
+	// the time the owner was alerted that the frame is offline, zero once the frame is back
+	OfflineAlertDate time.Time
+	CreationDate     time.Time
+}
+
+// Heartbeat is the health a frame reports periodically
+type Heartbeat struct {
+	Date time.Time
+	// the seconds since the frame started
+	Uptime   int64
+	Firmware string
+	// the bytes free on the storage of frame
+	FreeStorage int64
+	// the image shown when the heartbeat was sent
+	CurrentImageID string
+	// the number of errors of each kind since the frame started, like failed downloads
+	ErrorCounters map[string]int
+	// the strength of Wi-Fi signal in dBm
+	WifiSignal int
+}
+
+// BrightnessPeriod sets the brightness of frame from a time of day until the next period starts
+type BrightnessPeriod struct {
+	// the local time of day in HH:MM format
+	Start string
+	// the percent of full brightness, zero turns the screen off
+	Brightness int
+}
+
+// ShareLink keeps a link that gives view access to an album or a slideshow without an account
+type ShareLink struct {
+	ID string
+	// the sha256 hash of the secret part of link, the link is found by it and the token itself is only
+	// returned when the link is created
+	TokenHash  string
+	TargetType string
+	TargetID   string
+	Scope      string
+	// the hashed password of link, empty if the link is not protected
+	PasswordHash string
+	// the time link stops working, zero if it does not expire
+	ExpiryDate   time.Time
+	Views        int64
+	CreationDate time.Time
+}
+
+// Library keeps the images that several users share, the images stay in the library of their uploader
+type Library struct {
+	ID           string
+	Name         string
+	Members      []LibraryMember
+	Invitations  []LibraryInvitation
+	Images       []LibraryImage
+	CreationDate time.Time
+}
+
+// LibraryMember keeps a user of a shared library and its role
+type LibraryMember struct {
+	UserID   string
+	Email    string
+	Role     string
+	JoinDate time.Time
+}
+
+// LibraryInvitation keeps an invitation to a shared library that is not accepted yet
+type LibraryInvitation struct {
+	Token        string
+	Email        string
+	Role         string
+	InvitedBy    string
+	CreationDate time.Time
+}
+
+// LibraryImage references an image of a user that is added to a shared library
+type LibraryImage struct {
+	ImageID    string
+	UploaderID string
+	AddDate    time.Time
+}
+
+// ImageSearchEntry keeps the searchable fields of an image of user, the entries are kept in sync with the
+// images of users so searches can use the indexes of images collection
+type ImageSearchEntry struct {
+	UserID     string
+	ImageID    string
+	Name       string
+	Caption    string
+	Tags       []string
+	AlbumIDs   []string
+	UploadDate time.Time
+	// zero if the capture date of image is not known
+	CaptureDate time.Time
+	// the capture date of image or its upload date if it is not known, date ranges are searched by it
+	Date    time.Time
+	Trashed bool
 }
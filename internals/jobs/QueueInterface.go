@@ -0,0 +1,27 @@
+package jobs
+
+import (
+	"errors"
+	"time"
+
+	"github.com/matba/slyde-server/internals/db"
+)
+
+// Handler runs a job, returning an error makes the job to be retried until it runs out of attempts
+type Handler func(job *db.Job) error
+
+// Queue The interface that represents a queue of background jobs run by a pool of workers
+type Queue interface {
+	// Add a job of the type for the user to the queue
+	Enqueue(jobType string, userID string, payload map[string]string) (*db.Job, error)
+	// gets the job with id or NotFound if it does not exist
+	GetJob(jobID string) (*db.Job, error)
+	// gets the jobs of user that have been updated after the time
+	GetUserJobsUpdatedSince(userID string, since time.Time) ([]db.Job, error)
+	// registers the handler that runs the jobs of the type
+	RegisterHandler(jobType string, handler Handler)
+	// starts the workers, the handlers should be registered before
+	Start(workers int)
+}
+
+var NotFound = errors.New("The job not found.")
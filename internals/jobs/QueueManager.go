@@ -0,0 +1,18 @@
+package jobs
+
+import (
+	"sync"
+)
+
+var queue Queue
+var mux sync.Mutex
+
+// GetQueue Get an instance of job queue
+func GetQueue() Queue {
+	mux.Lock()
+	if queue == nil {
+		queue = newMongoQueue()
+	}
+	mux.Unlock()
+	return queue
+}
@@ -0,0 +1,318 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/matba/slyde-server/internals/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxAttempts = 3
+const retryDelay = 30 * time.Second
+const pollInterval = time.Second
+
+// a running job that is not updated for this long belongs to a worker that has died, the workers touch their
+// running jobs more often than that
+const staleJobTimeout = 10 * time.Minute
+const runningJobTouchInterval = staleJobTimeout / 4
+
+// the finished jobs are kept for this long so their statuses can still be followed
+const finishedJobRetention = 7 * 24 * time.Hour
+
+// mongoQueue keeps the jobs in DB, so they survive restarts and can be claimed by the workers of any server
+type mongoQueue struct {
+	mutex    sync.Mutex
+	client   *mongo.Client
+	handlers map[string]Handler
+}
+
+func newMongoQueue() *mongoQueue {
+	return &mongoQueue{handlers: make(map[string]Handler)}
+}
+
+// getCollection connects lazily, the client is shared by all workers
+func (q *mongoQueue) getCollection() (*mongo.Collection, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.client == nil {
+		client, err := db.CreateMongoClient()
+		if err != nil {
+			return nil, err
+		}
+		q.client = client
+	}
+	return (*q.client).Database(db.MainDbName).Collection(db.JobsCollection), nil
+}
+
+func (q *mongoQueue) Enqueue(jobType string, userID string, payload map[string]string) (*db.Job, error) {
+	collection, err := q.getCollection()
+	if err != nil {
+		return nil, err
+	}
+
+	id, _ := uuid.NewUUID()
+	now := time.Now()
+	job := db.Job{
+		ID:           id.String(),
+		Type:         jobType,
+		UserID:       userID,
+		Payload:      payload,
+		Status:       db.JobStatusQueued,
+		MaxAttempts:  maxAttempts,
+		CreationDate: now,
+		UpdateDate:   now,
+		NextRunDate:  now,
+	}
+	_, err = collection.InsertOne(context.TODO(), job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (q *mongoQueue) GetJob(jobID string) (*db.Job, error) {
+	collection, err := q.getCollection()
+	if err != nil {
+		return nil, err
+	}
+
+	var job db.Job
+	err = collection.FindOne(context.TODO(), bson.D{{"id", jobID}}).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, NotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (q *mongoQueue) GetUserJobsUpdatedSince(userID string, since time.Time) ([]db.Job, error) {
+	collection, err := q.getCollection()
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.D{{"userid", userID}, {"updatedate", bson.D{{"$gt", since}}}}
+	cursor, err := collection.Find(context.TODO(), filter, options.Find().SetSort(bson.D{{"updatedate", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	jobs := []db.Job{}
+	err = cursor.All(context.TODO(), &jobs)
+	return jobs, err
+}
+
+func (q *mongoQueue) RegisterHandler(jobType string, handler Handler) {
+	q.mutex.Lock()
+	q.handlers[jobType] = handler
+	q.mutex.Unlock()
+}
+
+func (q *mongoQueue) Start(workers int) {
+	err := q.ensureIndexes()
+	if err != nil {
+		log.Printf("Cannot create the indexes of jobs: %s", err.Error())
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+}
+
+// ensureIndexes creates the indexes the workers claim the jobs with, and the index that expires finished jobs
+func (q *mongoQueue) ensureIndexes() error {
+	collection, err := q.getCollection()
+	if err != nil {
+		return err
+	}
+	_, err = collection.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{"status", 1}, {"type", 1}, {"nextrundate", 1}},
+			Options: options.Index().SetName("status_type_next_run"),
+		},
+		{
+			Keys:    bson.D{{"status", 1}, {"updatedate", 1}},
+			Options: options.Index().SetName("status_update_date"),
+		},
+		{
+			Keys:    bson.D{{"userid", 1}, {"updatedate", 1}},
+			Options: options.Index().SetName("user_update_date"),
+		},
+		{
+			Keys: bson.D{{"updatedate", 1}},
+			Options: options.Index().SetName("finished_ttl").
+				SetExpireAfterSeconds(int32(finishedJobRetention.Seconds())).
+				SetPartialFilterExpression(bson.D{{"finished", true}}),
+		},
+		{
+			Keys:    bson.D{{"id", 1}},
+			Options: options.Index().SetName("job_id").SetUnique(true),
+		},
+	})
+	return err
+}
+
+// work claims the jobs one at a time and runs them, it waits when there is nothing to do
+func (q *mongoQueue) work() {
+	for {
+		job, err := q.claim()
+		if err != nil && err != mongo.ErrNoDocuments {
+			log.Printf("Claiming a job failed: %s", err.Error())
+		}
+		if job == nil {
+			q.failStaleJobs()
+			time.Sleep(pollInterval)
+			continue
+		}
+		q.run(job)
+	}
+}
+
+// claim atomically marks the oldest runnable job as running, so no other worker picks it
+func (q *mongoQueue) claim() (*db.Job, error) {
+	collection, err := q.getCollection()
+	if err != nil {
+		return nil, err
+	}
+
+	q.mutex.Lock()
+	types := []string{}
+	for jobType := range q.handlers {
+		types = append(types, jobType)
+	}
+	q.mutex.Unlock()
+
+	now := time.Now()
+	filter := bson.D{
+		{"type", bson.D{{"$in", types}}},
+		{"$or", bson.A{
+			bson.D{{"status", db.JobStatusQueued}, {"nextrundate", bson.D{{"$lte", now}}}},
+			bson.D{
+				{"status", db.JobStatusRunning},
+				{"updatedate", bson.D{{"$lt", now.Add(-staleJobTimeout)}}},
+				{"$expr", bson.D{{"$lt", bson.A{"$attempts", "$maxattempts"}}}},
+			},
+		}},
+	}
+	update := bson.D{
+		{"$set", bson.D{{"status", db.JobStatusRunning}, {"updatedate", now}}},
+		{"$inc", bson.D{{"attempts", 1}}},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{"nextrundate", 1}}).
+		SetReturnDocument(options.After)
+
+	var job db.Job
+	err = collection.FindOneAndUpdate(context.TODO(), filter, update, opts).Decode(&job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// run calls the handler of job and records the result, failed jobs are retried with a growing delay
+func (q *mongoQueue) run(job *db.Job) {
+	q.mutex.Lock()
+	handler := q.handlers[job.Type]
+	q.mutex.Unlock()
+
+	stopTouching := q.touchWhileRunning(job)
+	err := runHandler(handler, job)
+	close(stopTouching)
+
+	update := bson.D{{"updatedate", time.Now()}}
+	if err == nil {
+		update = append(update, bson.E{"status", db.JobStatusDone}, bson.E{"error", ""}, bson.E{"finished", true})
+	} else if job.Attempts < job.MaxAttempts {
+		log.Printf("Job %q of type %q failed, it will be retried: %s", job.ID, job.Type, err.Error())
+		update = append(update,
+			bson.E{"status", db.JobStatusQueued},
+			bson.E{"error", err.Error()},
+			bson.E{"nextrundate", time.Now().Add(time.Duration(job.Attempts) * retryDelay)})
+	} else {
+		log.Printf("Job %q of type %q failed: %s", job.ID, job.Type, err.Error())
+		update = append(update, bson.E{"status", db.JobStatusFailed}, bson.E{"error", err.Error()}, bson.E{"finished", true})
+	}
+
+	collection, err := q.getCollection()
+	if err != nil {
+		log.Printf("Updating job %q failed: %s", job.ID, err.Error())
+		return
+	}
+	// the job may have been claimed again by another worker, then the result of that run is kept
+	result, err := collection.UpdateOne(context.TODO(), bson.D{{"id", job.ID}, {"attempts", job.Attempts}}, bson.D{{"$set", update}})
+	if err != nil {
+		log.Printf("Updating job %q failed: %s", job.ID, err.Error())
+	} else if result.MatchedCount == 0 {
+		log.Printf("Job %q of type %q was claimed again while it was running", job.ID, job.Type)
+	}
+}
+
+// touchWhileRunning updates the job periodically until the returned channel is closed, so the job is not
+// taken as stale and claimed by another worker while it runs for long
+func (q *mongoQueue) touchWhileRunning(job *db.Job) chan struct{} {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(runningJobTouchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				collection, err := q.getCollection()
+				if err == nil {
+					filter := bson.D{{"id", job.ID}, {"attempts", job.Attempts}, {"status", db.JobStatusRunning}}
+					_, err = collection.UpdateOne(context.TODO(), filter, bson.D{{"$set", bson.D{{"updatedate", time.Now()}}}})
+				}
+				if err != nil {
+					log.Printf("Updating job %q failed: %s", job.ID, err.Error())
+				}
+			}
+		}
+	}()
+	return stop
+}
+
+// failStaleJobs fails the stale running jobs that have no attempts left, like a job that crashes the server
+// every time it runs
+func (q *mongoQueue) failStaleJobs() {
+	collection, err := q.getCollection()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	filter := bson.D{
+		{"status", db.JobStatusRunning},
+		{"updatedate", bson.D{{"$lt", now.Add(-staleJobTimeout)}}},
+		{"$expr", bson.D{{"$gte", bson.A{"$attempts", "$maxattempts"}}}},
+	}
+	update := bson.D{{"$set", bson.D{
+		{"status", db.JobStatusFailed},
+		{"error", "Job did not finish in time"},
+		{"finished", true},
+		{"updatedate", now},
+	}}}
+	_, err = collection.UpdateMany(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf("Failing stale jobs failed: %s", err.Error())
+	}
+}
+
+// runHandler keeps a panicking handler from killing the worker
+func runHandler(handler Handler, job *db.Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("Job handler panicked")
+			log.Printf("Job %q of type %q panicked: %v", job.ID, job.Type, r)
+		}
+	}()
+	return handler(job)
+}
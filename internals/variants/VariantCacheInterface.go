@@ -0,0 +1,33 @@
+package variants
+
+// VariantCache The interface that represents the cache of files derived from images, like resized renderings
+type VariantCache interface {
+	// checks if the variant file is cached and marks it as recently used, the result is counted as hit or miss
+	Lookup(path string) bool
+	// registers a newly created variant file of the image, least recently used variants are evicted if needed
+	Add(imageKey string, path string) error
+	// keeps track of a variant that already exists on disk as the least recently used one, so existing
+	// variants should be tracked from the most recently used to the least
+	Track(imageKey string, path string, size int64)
+	// deletes all variants of the image from disk
+	RemoveImage(imageKey string)
+	// deletes the variant file from disk if it is cached
+	Remove(path string)
+	// gets the statistics of cache
+	Stats() Statistics
+}
+
+// Statistics keeps the counters of a variant cache
+type Statistics struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	Budget    int64 `json:"budget"`
+}
+
+// ImageKey creates the key that groups the variants of an image of a user
+func ImageKey(userID string, imageID string) string {
+	return userID + "/" + imageID
+}
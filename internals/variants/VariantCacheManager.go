@@ -0,0 +1,20 @@
+package variants
+
+import (
+	"sync"
+
+	"github.com/matba/slyde-server/internals/config"
+)
+
+var variantCache VariantCache
+var mux sync.Mutex
+
+// GetVariantCache Get an instance of variant cache
+func GetVariantCache() VariantCache {
+	mux.Lock()
+	if variantCache == nil {
+		variantCache = newLruVariantCache(config.GetServerConfig().VariantCacheBudget)
+	}
+	mux.Unlock()
+	return variantCache
+}
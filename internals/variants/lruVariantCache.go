@@ -0,0 +1,173 @@
+package variants
+
+import (
+	"container/list"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type variantEntry struct {
+	imageKey string
+	path     string
+	size     int64
+}
+
+// lruVariantCache keeps the variants in the order of their usage and removes the least recently
+// used ones when the total size goes over the budget
+type lruVariantCache struct {
+	mutex   sync.Mutex
+	budget  int64
+	bytes   int64
+	order   *list.List
+	entries map[string]*list.Element
+	images  map[string]map[string]bool
+	stats   Statistics
+}
+
+func newLruVariantCache(budget int64) *lruVariantCache {
+	return &lruVariantCache{
+		budget:  budget,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		images:  make(map[string]map[string]bool),
+	}
+}
+
+func (c *lruVariantCache) Lookup(path string) bool {
+	c.mutex.Lock()
+	element, ok := c.entries[path]
+	if ok {
+		c.order.MoveToFront(element)
+		c.stats.Hits++
+	} else {
+		c.stats.Misses++
+	}
+	c.mutex.Unlock()
+
+	if ok {
+		// the modification time keeps the usage order across restarts
+		now := time.Now()
+		os.Chtimes(path, now, now)
+	}
+	return ok
+}
+
+func (c *lruVariantCache) Add(imageKey string, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.insert(imageKey, path, info.Size(), true)
+	evicted := c.evict()
+	c.mutex.Unlock()
+
+	removeFiles(evicted)
+	return nil
+}
+
+func (c *lruVariantCache) Track(imageKey string, path string, size int64) {
+	c.mutex.Lock()
+	c.insert(imageKey, path, size, false)
+	evicted := c.evict()
+	c.mutex.Unlock()
+
+	removeFiles(evicted)
+}
+
+func (c *lruVariantCache) RemoveImage(imageKey string) {
+	c.mutex.Lock()
+	removed := []string{}
+	for path := range c.images[imageKey] {
+		if element, ok := c.entries[path]; ok {
+			c.remove(element)
+			removed = append(removed, path)
+		}
+	}
+	delete(c.images, imageKey)
+	c.mutex.Unlock()
+
+	removeFiles(removed)
+}
+
+func (c *lruVariantCache) Remove(path string) {
+	c.mutex.Lock()
+	element, ok := c.entries[path]
+	if ok {
+		c.remove(element)
+	}
+	c.mutex.Unlock()
+
+	if ok {
+		removeFiles([]string{path})
+	}
+}
+
+func (c *lruVariantCache) Stats() Statistics {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Bytes = c.bytes
+	stats.Budget = c.budget
+	return stats
+}
+
+// insert puts the variant in front of the usage order, it should be called while holding the mutex
+func (c *lruVariantCache) insert(imageKey string, path string, size int64, front bool) {
+	if element, ok := c.entries[path]; ok {
+		c.remove(element)
+	}
+	entry := &variantEntry{imageKey: imageKey, path: path, size: size}
+	if front {
+		c.entries[path] = c.order.PushFront(entry)
+	} else {
+		c.entries[path] = c.order.PushBack(entry)
+	}
+	c.bytes += size
+	c.addToImage(imageKey, path)
+}
+
+func (c *lruVariantCache) addToImage(imageKey string, path string) {
+	if c.images[imageKey] == nil {
+		c.images[imageKey] = make(map[string]bool)
+	}
+	c.images[imageKey][path] = true
+}
+
+// remove drops the entry from the cache without touching the disk, it should be called while holding the mutex
+func (c *lruVariantCache) remove(element *list.Element) {
+	entry := element.Value.(*variantEntry)
+	c.order.Remove(element)
+	delete(c.entries, entry.path)
+	delete(c.images[entry.imageKey], entry.path)
+	if len(c.images[entry.imageKey]) == 0 {
+		delete(c.images, entry.imageKey)
+	}
+	c.bytes -= entry.size
+}
+
+// evict drops the least recently used entries until the cache fits the budget and returns their paths,
+// the most recently used entry is always kept. It should be called while holding the mutex.
+func (c *lruVariantCache) evict() []string {
+	evicted := []string{}
+	for c.bytes > c.budget && c.order.Len() > 1 {
+		element := c.order.Back()
+		evicted = append(evicted, element.Value.(*variantEntry).path)
+		c.remove(element)
+		c.stats.Evictions++
+	}
+	return evicted
+}
+
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Removing variant %q failed: %s", path, err.Error())
+		}
+	}
+}